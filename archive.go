@@ -0,0 +1,176 @@
+package seal
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func archiveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "archive",
+		Short: "seals and verifies the contents of zip and tar archives",
+		Long: `Seals the files inside of .zip, .tar, .tar.gz and .tar.zst archives. The
+archive can't hold seal files, so the seals of all its directories are
+stored next to it in a sidecar file, named like the archive with
+` + SealFile + ` appended.`,
+	}
+	cmd.AddCommand(archiveSealCmd())
+	cmd.AddCommand(archiveVerifyCmd())
+	return cmd
+}
+
+func archiveSealCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "seal ARCHIVE...",
+		Short: "seals the contents of archives into their sidecar files",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("need at least one archive to seal")
+			}
+			start := time.Now()
+			opts := SealOptions{
+				Prefixes:         PathPrefixes,
+				PrintProgress:    true,
+				ProgressInterval: PrintInterval,
+				PrintChanges:     true,
+			}
+			var stop func()
+			opts.OnEvent, stop = startProgressUI()
+			defer stop()
+			opts.PrintProgress = opts.OnEvent == nil
+			for _, archivePath := range args {
+				_, err := SealArchive(archivePath, opts)
+				if err != nil {
+					return errors.Wrapf(err, "SealArchive %q", archivePath)
+				}
+			}
+			log.Println("ran for", time.Since(start))
+			return nil
+		},
+	}
+}
+
+func archiveVerifyCmd() *cobra.Command {
+	var extracted, sealedDir string
+	cmd := &cobra.Command{
+		Use:   "verify ARCHIVE...",
+		Short: "verifies the contents of archives against their sidecar files",
+		Long: `Verifies the contents of archives against the seals in their sidecar files.
+
+With --extracted, the extracted directory is verified against the sidecar
+file of the archive instead. With --sealed-dir, the archive is verified
+against the seal files of a sealed directory, for example the directory
+that the archive was created from. Both directories have to match the
+root of the archive.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("need at least one archive to verify")
+			}
+			if (extracted != "" || sealedDir != "") && len(args) > 1 {
+				return errors.New("--extracted and --sealed-dir need a single archive")
+			}
+			if extracted != "" && sealedDir != "" {
+				return errors.New("can't use --extracted and --sealed-dir together")
+			}
+			start := time.Now()
+			opts := VerifyOptions{
+				Prefixes:         PathPrefixes,
+				PrintDifferences: true,
+				ProgressInterval: PrintInterval,
+			}
+			var stop func()
+			opts.OnEvent, stop = startProgressUI()
+			defer stop()
+			opts.PrintProgress = opts.OnEvent == nil
+			for _, archivePath := range args {
+				var err error
+				if extracted != "" {
+					_, err = VerifyExtracted(extracted, archivePath, opts)
+				} else {
+					_, err = VerifyArchive(archivePath, sealedDir, opts)
+				}
+				if err != nil {
+					return errors.Wrapf(err, "verify %q", archivePath)
+				}
+			}
+			log.Println("ran for", time.Since(start))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&extracted, "extracted", "", "verify this extracted directory against the archive seal")
+	cmd.Flags().StringVar(&sealedDir, "sealed-dir", "", "verify the archive against the seal files of this directory")
+	return cmd
+}
+
+// ArchiveSealPath returns the path of the sidecar seal file of an archive,
+// which is a Manifest of the directories in the archive.
+func ArchiveSealPath(archivePath string) string {
+	return archivePath + SealFile
+}
+
+// SealArchive seals the contents of an archive and writes the seals
+// into its sidecar file. An existing sidecar file is updated like
+// seal files, so deleted files and old versions are kept.
+func SealArchive(archivePath string, opts SealOptions) ([]Dir, error) {
+	archive, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenArchive")
+	}
+	defer archive.Close()
+
+	manifest, err := loadOrNewManifest(ArchiveSealPath(archivePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "loadOrNewManifest")
+	}
+
+	opts.FS = &sidecarFS{fsys: archive, seals: manifest}
+	dirs, err := NewSealer(opts).Seal(".")
+	if err != nil {
+		return nil, errors.Wrap(err, "Seal")
+	}
+	manifest.Root = filepath.Base(archivePath)
+	return dirs, errors.Wrap(manifest.Save(ArchiveSealPath(archivePath)), "Save")
+}
+
+// VerifyArchive verifies the contents of an archive against its sidecar
+// seal file, or against the seal files of sealedDir if it is set.
+func VerifyArchive(archivePath, sealedDir string, opts VerifyOptions) ([]Dir, error) {
+	archive, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenArchive")
+	}
+	defer archive.Close()
+
+	fsys := &sidecarFS{fsys: archive}
+	if sealedDir != "" {
+		// the root seal of the directory has its name, not "."
+		abs, err := filepath.Abs(sealedDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "Abs")
+		}
+		fsys.seals = DirFS(sealedDir)
+		fsys.rootName = filepath.Base(abs)
+	} else {
+		fsys.seals, err = LoadManifest(ArchiveSealPath(archivePath))
+		if err != nil {
+			return nil, errors.Wrap(err, "LoadManifest")
+		}
+	}
+	opts.FS = fsys
+	return NewVerifier(opts).Verify(".")
+}
+
+// VerifyExtracted verifies a directory that was extracted from
+// an archive against the sidecar seal file of the archive.
+func VerifyExtracted(dirPath, archivePath string, opts VerifyOptions) ([]Dir, error) {
+	seals, err := LoadManifest(ArchiveSealPath(archivePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadManifest")
+	}
+	opts.FS = &sidecarFS{fsys: DirFS(dirPath), seals: seals}
+	return NewVerifier(opts).Verify(".")
+}
@@ -0,0 +1,344 @@
+package seal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Archive is a zip or tar archive that is opened as a read only file
+// system. The root of the archive is ".".
+type Archive struct {
+	fs.FS
+	close func() error
+}
+
+// Close closes the archive and removes temporary files.
+func (a *Archive) Close() error {
+	return a.close()
+}
+
+// OpenArchive opens a .zip, .tar, .tar.gz or .tar.zst archive. Compressed
+// tar archives are decompressed into a temporary file first, because the
+// files are read in a different order than they are stored.
+func OpenArchive(archivePath string) (*Archive, error) {
+	name := strings.ToLower(archivePath)
+	if strings.HasSuffix(name, ".zip") {
+		r, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "zip.OpenReader")
+		}
+		return &Archive{FS: &r.Reader, close: r.Close}, nil
+	}
+
+	var decompress func(io.Reader) (io.ReadCloser, error)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		decompress = func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		decompress = func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown archive type of %q", archivePath)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open")
+	}
+	closeFile := f.Close
+	if decompress != nil {
+		tmp, err := decompressTemp(f, decompress)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decompress")
+		}
+		f = tmp
+		closeFile = func() error {
+			tmp.Close()
+			return os.Remove(tmp.Name())
+		}
+	}
+
+	fsys, err := newTarFS(f)
+	if err != nil {
+		closeFile()
+		return nil, errors.Wrapf(err, "reading %q", archivePath)
+	}
+	return &Archive{FS: fsys, close: closeFile}, nil
+}
+
+// decompressTemp writes the decompressed contents of r into a temporary file.
+func decompressTemp(r io.Reader, decompress func(io.Reader) (io.ReadCloser, error)) (*os.File, error) {
+	dec, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	tmp, err := os.CreateTemp("", "seal-*.tar")
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateTemp")
+	}
+	start := time.Now()
+	n, err := io.Copy(tmp, dec)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errors.Wrap(err, "Copy")
+	}
+	log.Printf("decompressed %s in %v", formatBytes(n), time.Since(start))
+	return tmp, nil
+}
+
+// tarFS is the file system of an uncompressed tar archive. The headers
+// are read once, file contents are read directly from their offsets.
+type tarFS struct {
+	r     io.ReaderAt
+	files map[string]*archiveEntry
+}
+
+func newTarFS(r io.ReaderAt) (*tarFS, error) {
+	t := &tarFS{
+		r:     r,
+		files: map[string]*archiveEntry{".": {name: ".", mode: fs.ModeDir | 0755}},
+	}
+	sr := io.NewSectionReader(r, 0, 1<<63-1)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Next")
+		}
+		name, err := archiveName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		if isSparse(hdr) {
+			return nil, fmt.Errorf("sparse file %q is not supported", hdr.Name)
+		}
+		// the reader is at the start of the file contents after Next
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errors.Wrap(err, "Seek")
+		}
+
+		info := hdr.FileInfo()
+		e := &archiveEntry{
+			name:    path.Base(name),
+			mode:    info.Mode(),
+			size:    info.Size(),
+			modTime: hdr.ModTime,
+			offset:  offset,
+		}
+		if info.IsDir() {
+			e.size = 0
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target, err := archiveName(hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			linked, ok := t.files[target]
+			if !ok || !linked.mode.IsRegular() {
+				return nil, fmt.Errorf("hard link %q to missing file %q", hdr.Name, hdr.Linkname)
+			}
+			e.size = linked.size
+			e.offset = linked.offset
+		}
+		if existing, ok := t.files[name]; ok && existing.IsDir() && e.IsDir() {
+			existing.mode = e.mode
+			existing.modTime = e.modTime
+			continue
+		}
+		t.addParents(name)
+		t.files[name] = e
+	}
+
+	for name, e := range t.files {
+		if name == "." {
+			continue
+		}
+		parent := t.files[path.Dir(name)]
+		parent.entries = append(parent.entries, e)
+	}
+	for _, e := range t.files {
+		sort.Slice(e.entries, func(i, j int) bool {
+			return e.entries[i].Name() < e.entries[j].Name()
+		})
+	}
+	return t, nil
+}
+
+// addParents adds the missing parent directories of name, because
+// archives don't need to contain entries for directories.
+func (t *tarFS) addParents(name string) {
+	dir := path.Dir(name)
+	if dir == "." {
+		return
+	}
+	if _, ok := t.files[dir]; ok {
+		return
+	}
+	t.addParents(dir)
+	t.files[dir] = &archiveEntry{name: path.Base(dir), mode: fs.ModeDir | 0755}
+}
+
+// archiveName turns the name of an archive entry into a valid fs.FS name.
+func archiveName(name string) (string, error) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+	return name, nil
+}
+
+// isSparse reports if the header is a sparse file. Their contents
+// can't be read from a single offset.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tarFS) lookup(op, name string) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(t.r), nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	return t.lookup("stat", name)
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	out := make([]fs.DirEntry, len(e.entries))
+	for i, entry := range e.entries {
+		out[i] = entry
+	}
+	return out, nil
+}
+
+// archiveEntry is a file or directory in an archive. It is
+// both the fs.FileInfo and the fs.DirEntry of the file.
+type archiveEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	// offset of the contents in the archive
+	offset int64
+	// entries of a directory, sorted by name
+	entries []*archiveEntry
+}
+
+func (e *archiveEntry) Name() string               { return e.name }
+func (e *archiveEntry) Size() int64                { return e.size }
+func (e *archiveEntry) Mode() fs.FileMode          { return e.mode }
+func (e *archiveEntry) ModTime() time.Time         { return e.modTime }
+func (e *archiveEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() interface{}           { return nil }
+func (e *archiveEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *archiveEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *archiveEntry) open(r io.ReaderAt) fs.File {
+	f := &archiveFile{entry: e}
+	if !e.IsDir() {
+		f.r = io.NewSectionReader(r, e.offset, e.size)
+	}
+	return f
+}
+
+// archiveFile is an open archiveEntry.
+type archiveFile struct {
+	entry  *archiveEntry
+	r      *io.SectionReader
+	dirPos int
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *archiveFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.entry.name, Err: errors.New("is a directory")}
+	}
+	return f.r.Read(b)
+}
+
+func (f *archiveFile) Close() error {
+	return nil
+}
+
+func (f *archiveFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.entry.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.entry.name, Err: errors.New("not a directory")}
+	}
+	rest := f.entry.entries[f.dirPos:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	f.dirPos += len(rest)
+	out := make([]fs.DirEntry, len(rest))
+	for i, entry := range rest {
+		out[i] = entry
+	}
+	return out, nil
+}
@@ -0,0 +1,149 @@
+package seal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testArchiveFiles = []string{"a.txt", "sub/c.txt", "sub/d.txt"}
+
+// writeArchiveSource writes the files of the test archives into dir.
+func writeArchiveSource(t *testing.T, dir string) {
+	modified := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range testArchiveFiles {
+		fullPath := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+		randomFile(t, fullPath, int64(i+1))
+		require.NoError(t, os.Chtimes(fullPath, modified, modified))
+	}
+}
+
+// writeTestArchive archives the files of dir into archivePath.
+func writeTestArchive(t *testing.T, dir, archivePath string) {
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var w io.Writer = f
+	switch filepath.Ext(archivePath) {
+	case ".zip":
+		zw := zip.NewWriter(f)
+		for _, name := range testArchiveFiles {
+			info, err := os.Stat(filepath.Join(dir, name))
+			require.NoError(t, err)
+			hdr, err := zip.FileInfoHeader(info)
+			require.NoError(t, err)
+			hdr.Name = name
+			fw, err := zw.CreateHeader(hdr)
+			require.NoError(t, err)
+			copyTestFile(t, fw, filepath.Join(dir, name))
+		}
+		require.NoError(t, zw.Close())
+		return
+	case ".gz":
+		gw := gzip.NewWriter(f)
+		defer func() { require.NoError(t, gw.Close()) }()
+		w = gw
+	case ".zst":
+		zw, err := zstd.NewWriter(f)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, zw.Close()) }()
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	// the directory sub has no entry of its own
+	for _, name := range append([]string{"."}, testArchiveFiles...) {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		hdr, err := tar.FileInfoHeader(info, "")
+		require.NoError(t, err)
+		hdr.Name = "./" + name
+		require.NoError(t, tw.WriteHeader(hdr))
+		if !info.IsDir() {
+			copyTestFile(t, tw, filepath.Join(dir, name))
+		}
+	}
+	require.NoError(t, tw.Close())
+}
+
+func copyTestFile(t *testing.T, w io.Writer, filePath string) {
+	f, err := os.Open(filePath)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	require.NoError(t, err)
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	writeArchiveSource(t, source)
+
+	for _, name := range []string{"test.tar", "test.tar.gz", "test.tar.zst", "test.zip"} {
+		archivePath := filepath.Join(dir, name)
+		writeTestArchive(t, source, archivePath)
+		archive, err := OpenArchive(archivePath)
+		require.NoError(t, err, name)
+		assert.NoError(t, fstest.TestFS(archive, testArchiveFiles...), name)
+
+		info, err := fs.Stat(archive, "sub/d.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2656), info.Size())
+		assert.NoError(t, archive.Close())
+	}
+
+	_, err := OpenArchive(filepath.Join(dir, "test.rar"))
+	assert.Error(t, err)
+}
+
+func TestSealArchive(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	writeArchiveSource(t, source)
+	archivePath := filepath.Join(dir, "test.tar.zst")
+	writeTestArchive(t, source, archivePath)
+
+	_, err := SealArchive(archivePath, SealOptions{})
+	require.NoError(t, err)
+	seals, err := LoadManifest(ArchiveSealPath(archivePath))
+	require.NoError(t, err)
+	assert.Equal(t, "test.tar.zst", seals.Root)
+	require.Contains(t, seals.Dirs, ".")
+	assert.Equal(t, int64(3*2656), seals.Dirs["."].TotalSize)
+	assert.Contains(t, seals.Dirs, "sub")
+
+	assertIdentical := func(dirs []Dir, err error) {
+		require.NoError(t, err)
+		assert.Equal(t, 2, len(dirs))
+		for _, dir := range dirs {
+			assert.True(t, dir.HashDiff.Identical, dir.Path)
+		}
+	}
+	assertIdentical(VerifyArchive(archivePath, "", VerifyOptions{}))
+	assertIdentical(VerifyExtracted(source, archivePath, VerifyOptions{}))
+
+	// the archive matches the seal files of the directory it was made from
+	_, err = SealPath(source, nil)
+	require.NoError(t, err)
+	assertIdentical(VerifyArchive(archivePath, source, VerifyOptions{}))
+
+	randomFile(t, filepath.Join(source, "sub/c.txt"), 5)
+	dirs, err := VerifyExtracted(source, archivePath, VerifyOptions{})
+	require.NoError(t, err)
+	for _, dir := range dirs {
+		assert.Equal(t, dir.Path != "sub", dir.HashDiff.Identical, dir.Path)
+	}
+}
@@ -0,0 +1,513 @@
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func bagCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bag",
+		Short: "makes and validates BagIt bags",
+		Long: `Makes and validates BagIt bags (RFC 8493) with SHA256 manifests. The
+payload of a bag is in the data directory of the bag.`,
+	}
+	cmd.AddCommand(bagMakeCmd())
+	cmd.AddCommand(bagValidateCmd())
+	return cmd
+}
+
+func bagMakeCmd() *cobra.Command {
+	var store string
+	cmd := &cobra.Command{
+		Use:   "make BAG",
+		Short: "writes the BagIt manifests of a bag from the seals of its payload",
+		Long: `Writes bagit.txt, bag-info.txt, manifest-sha256.txt and
+tagmanifest-sha256.txt for the sealed payload in BAG/data, without hashing
+the payload again. The seals are read from the seal files, or from the
+manifest passed with --store. The seals have to be up to date with the
+payload. Seal files in the payload are listed in the manifest like other
+payload files, so that other validators accept the bag.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one bag directory")
+			}
+			return MakeBag(args[0], store)
+		},
+	}
+	cmd.Flags().StringVar(&store, "store", "", "manifest file with the seals of the payload")
+	return cmd
+}
+
+func bagValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate BAG",
+		Short: "validates a bag against its BagIt manifests",
+		Long: `Validates a bag by converting manifest-sha256.txt into directory seals,
+and comparing them with the hashed payload like verify does. The tag
+manifest and the Payload-Oxum of bag-info.txt are checked as well.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one bag directory")
+			}
+			onEvent, stop := startProgressUI()
+			v, err := ValidateBag(args[0], onEvent)
+			stop()
+			if err != nil {
+				return err
+			}
+			v.Print()
+			if !v.OK() {
+				return errors.New("bag is invalid")
+			}
+			log.Println("bag is valid")
+			return nil
+		},
+	}
+}
+
+const (
+	bagDataDir       = "data"
+	bagDeclaration   = "bagit.txt"
+	bagInfo          = "bag-info.txt"
+	bagManifest      = "manifest-sha256.txt"
+	bagTagManifest   = "tagmanifest-sha256.txt"
+	bagItDeclaration = "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"
+)
+
+// MakeBag writes the tag files of the bag at bagDir from the seals of
+// the payload in its data directory. The seals are read from the seal
+// files, or from the manifest file store if it is set. The payload is
+// checked against the seals by name and size, but not hashed.
+func MakeBag(bagDir, store string) error {
+	dataDir := filepath.Join(bagDir, bagDataDir)
+	// the root seal is named like the data directory
+	var fsys fs.FS = &sidecarFS{fsys: DirFS(dataDir), seals: DirFS(dataDir), rootName: bagDataDir}
+	if store != "" {
+		m, err := LoadManifest(store)
+		if err != nil {
+			return errors.Wrap(err, "LoadManifest")
+		}
+		fsys, err = manifestTreeFS(dataDir, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	loadSeals := true
+	dirs, err := walkDirectories(".", loadSeals, walkOptions{FS: fsys})
+	if err != nil {
+		return errors.Wrap(err, "walkDirectories")
+	}
+	if len(dirs) == 0 || dirs[len(dirs)-1].Path != "." {
+		return errors.Errorf("payload %q isn't sealed", dataDir)
+	}
+
+	sealer := NewSealer(SealOptions{FS: fsys})
+	var sums []Checksum
+	var oxumBytes, oxumFiles int64
+	for _, dir := range dirs {
+		current, err := sealer.sealDir(dir.Path, false)
+		if err != nil {
+			return errors.Wrapf(err, "sealDir %q", dir.Path)
+		}
+		if diff := DiffSeals(dir.Seal, current, false); !diff.Identical {
+			diff.PrintDifferences()
+			return errors.Errorf("seal of %q is out of date, seal the payload first", dir.Path)
+		}
+		for _, f := range dir.Seal.Files {
+			if f.IsDir || !f.exists() {
+				continue
+			}
+			sums = append(sums, Checksum{Path: path.Join(bagDataDir, dir.Path, f.Name), SHA256: f.SHA256, Size: f.Size})
+			oxumBytes += f.Size
+			oxumFiles++
+		}
+		if store != "" {
+			continue
+		}
+		// seal files are payload for other validators
+		sealPath := filepath.Join(dataDir, filepath.FromSlash(dir.Path), SealFile)
+		info, err := os.Stat(sealPath)
+		if err != nil {
+			return errors.Wrap(err, "Stat seal")
+		}
+		hash, err := hashFile(sealPath)
+		if err != nil {
+			return errors.Wrap(err, "hash seal")
+		}
+		sums = append(sums, Checksum{Path: path.Join(bagDataDir, dir.Path, SealFile), SHA256: hash, Size: info.Size()})
+		oxumBytes += info.Size()
+		oxumFiles++
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		return sums[i].Path < sums[j].Path
+	})
+
+	err = os.WriteFile(filepath.Join(bagDir, bagDeclaration), []byte(bagItDeclaration), 0666)
+	if err != nil {
+		return errors.Wrap(err, "write bagit.txt")
+	}
+	err = writeBagInfo(filepath.Join(bagDir, bagInfo), map[string]string{
+		"Bagging-Date":       time.Now().Format("2006-01-02"),
+		"Payload-Oxum":       fmt.Sprintf("%d.%d", oxumBytes, oxumFiles),
+		"Bag-Software-Agent": "seal",
+	})
+	if err != nil {
+		return errors.Wrap(err, "write bag-info.txt")
+	}
+	err = writeBagManifest(filepath.Join(bagDir, bagManifest), sums)
+	if err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+
+	var tagSums []Checksum
+	for _, name := range []string{bagDeclaration, bagInfo, bagManifest} {
+		hash, err := hashFile(filepath.Join(bagDir, name))
+		if err != nil {
+			return errors.Wrapf(err, "hash %q", name)
+		}
+		tagSums = append(tagSums, Checksum{Path: name, SHA256: hash})
+	}
+	err = writeBagManifest(filepath.Join(bagDir, bagTagManifest), tagSums)
+	return errors.Wrap(err, "write tag manifest")
+}
+
+// writeBagInfo writes bag-info.txt with the fields, keeping all
+// other fields of an existing file.
+func writeBagInfo(infoPath string, fields map[string]string) error {
+	var buf bytes.Buffer
+	existing, err := os.ReadFile(infoPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	skipping := false
+	for _, line := range strings.Split(string(existing), "\n") {
+		// indented lines continue the value of the previous field
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if !skipping {
+				buf.WriteString(line + "\n")
+			}
+			continue
+		}
+		label := strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+		_, skipping = fields[label]
+		if !skipping && strings.TrimSpace(line) != "" {
+			buf.WriteString(line + "\n")
+		}
+	}
+	labels := make([]string, 0, len(fields))
+	for label := range fields {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(&buf, "%s: %s\n", label, fields[label])
+	}
+	return os.WriteFile(infoPath, buf.Bytes(), 0666)
+}
+
+// readBagInfo returns the fields of bag-info.txt.
+func readBagInfo(infoPath string) (map[string]string, error) {
+	buf, err := os.ReadFile(infoPath)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	var last string
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && last != "" {
+			fields[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		last = strings.TrimSpace(parts[0])
+		fields[last] = strings.TrimSpace(parts[1])
+	}
+	return fields, nil
+}
+
+// bagPathEscaper encodes the characters that can't be used in
+// manifest paths, like RFC 8493 section 2.1.3.
+var (
+	bagPathEscaper   = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	bagPathUnescaper = strings.NewReplacer("%25", "%", "%0D", "\r", "%0A", "\n", "%0d", "\r", "%0a", "\n")
+)
+
+func writeBagManifest(manifestPath string, sums []Checksum) error {
+	var buf bytes.Buffer
+	for _, sum := range sums {
+		fmt.Fprintf(&buf, "%x  %s\n", sum.SHA256, bagPathEscaper.Replace(sum.Path))
+	}
+	return os.WriteFile(manifestPath, buf.Bytes(), 0666)
+}
+
+// readBagManifest reads a SHA256 manifest or tag manifest.
+func readBagManifest(manifestPath string) ([]Checksum, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var sums []Checksum
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		i := strings.IndexAny(text, " \t")
+		if i < 0 {
+			return nil, errors.Errorf("line %d: no path", line)
+		}
+		name := bagPathUnescaper.Replace(strings.TrimLeft(text[i:], " \t"))
+		sum, err := newChecksum(strings.TrimPrefix(name, "./"), text[:i], -1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		sums = append(sums, sum)
+	}
+	return sums, errors.Wrap(scanner.Err(), "Scan")
+}
+
+// BagValidation is the result of validating a bag. Dirs are the
+// directories of the payload, with the differences between the
+// manifest and the payload in their HashDiff.
+type BagValidation struct {
+	Dirs []Dir
+	// Errors of the tag files, the Payload-Oxum and the
+	// payload files that are never sealed.
+	Errors []string
+}
+
+// OK reports if the bag is valid.
+func (v *BagValidation) OK() bool {
+	if len(v.Errors) > 0 {
+		return false
+	}
+	for _, dir := range v.Dirs {
+		if !dir.HashDiff.Identical {
+			return false
+		}
+	}
+	return true
+}
+
+// Print logs the errors and differences.
+func (v *BagValidation) Print() {
+	for _, e := range v.Errors {
+		log.Println(color.RedString(e))
+	}
+	for _, dir := range v.Dirs {
+		if !dir.HashDiff.Identical {
+			log.Println(color.RedString("differences in %q:", dir.Path))
+			dir.HashDiff.PrintDifferences()
+		}
+	}
+}
+
+// ValidateBag validates the bag at bagDir. The SHA256 manifest is
+// converted into directory seals, which are compared with the seals of
+// the hashed payload by DiffSeals. The tag manifest and Payload-Oxum are
+// checked if the bag has them.
+func ValidateBag(bagDir string, onEvent EventHandler) (*BagValidation, error) {
+	declaration, err := os.ReadFile(filepath.Join(bagDir, bagDeclaration))
+	if err != nil {
+		return nil, errors.Wrap(err, "not a bag")
+	}
+	if !bytes.HasPrefix(declaration, []byte("BagIt-Version:")) {
+		return nil, errors.New("bagit.txt has no BagIt-Version")
+	}
+	sums, err := readBagManifest(filepath.Join(bagDir, bagManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New("bag has no manifest-sha256.txt, other algorithms are not supported")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+
+	v := &BagValidation{}
+	checkFile := func(sum Checksum, what string) {
+		hash, err := hashFile(filepath.Join(bagDir, filepath.FromSlash(sum.Path)))
+		if err != nil {
+			v.Errors = append(v.Errors, fmt.Sprintf("%s %q: %v", what, sum.Path, err))
+		} else if !bytes.Equal(hash, sum.SHA256) {
+			v.Errors = append(v.Errors, fmt.Sprintf("%s %q doesn't match the manifest", what, sum.Path))
+		}
+	}
+	tagSums, err := readBagManifest(filepath.Join(bagDir, bagTagManifest))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.Wrap(err, "read tag manifest")
+	}
+	for _, sum := range tagSums {
+		checkFile(sum, "tag file")
+	}
+
+	dataDir := filepath.Join(bagDir, bagDataDir)
+	err = checkPayloadOxum(bagDir, v)
+	if err != nil {
+		return nil, err
+	}
+
+	want := map[string]*DirSeal{}
+	for _, sum := range sums {
+		if !strings.HasPrefix(sum.Path, bagDataDir+"/") {
+			v.Errors = append(v.Errors, fmt.Sprintf("manifest path %q is outside of the payload", sum.Path))
+			continue
+		}
+		if filesToIgnore[path.Base(sum.Path)] {
+			// never part of seals, so they are checked directly
+			checkFile(sum, "payload file")
+			continue
+		}
+		rel := strings.TrimPrefix(sum.Path, bagDataDir+"/")
+		if !fs.ValidPath(rel) {
+			v.Errors = append(v.Errors, fmt.Sprintf("invalid manifest path %q", sum.Path))
+			continue
+		}
+		f := &FileSeal{Name: path.Base(rel), SHA256: sum.SHA256}
+		// the manifest has no sizes, they are needed for the
+		// directory hashes and checked by the Payload-Oxum
+		if info, err := os.Lstat(filepath.Join(dataDir, filepath.FromSlash(rel))); err == nil {
+			f.Size = info.Size()
+		}
+		dir := bagDirSeal(want, path.Dir(rel))
+		dir.Files = append(dir.Files, f)
+		dir.TotalSize += f.Size
+	}
+	err = hashBagDirs(want)
+	if err != nil {
+		return nil, err
+	}
+
+	have, err := NewSealer(SealOptions{OnEvent: onEvent}).Scan(dataDir, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Scan")
+	}
+	for i, dir := range have {
+		rel, err := filepath.Rel(dataDir, dir.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Rel")
+		}
+		rel = filepath.ToSlash(rel)
+		wantSeal, ok := want[rel]
+		if !ok {
+			wantSeal = &DirSeal{Name: dir.Seal.Name}
+			wantSeal.hash()
+		}
+		have[i].Path = rel
+		have[i].HashDiff = DiffSeals(wantSeal, dir.Seal, true)
+	}
+	v.Dirs = have
+	return v, nil
+}
+
+// bagDirSeal returns the seal of a directory of the manifest,
+// adding it and its parents if they don't exist yet.
+func bagDirSeal(dirs map[string]*DirSeal, dirPath string) *DirSeal {
+	if d, ok := dirs[dirPath]; ok {
+		return d
+	}
+	d := &DirSeal{Name: path.Base(dirPath)}
+	if dirPath == "." {
+		d.Name = bagDataDir
+	} else {
+		bagDirSeal(dirs, path.Dir(dirPath))
+	}
+	dirs[dirPath] = d
+	return d
+}
+
+// hashBagDirs hashes the directories of the manifest from the deepest
+// up, adding every directory to the files of its parent.
+func hashBagDirs(dirs map[string]*DirSeal) error {
+	paths := make([]string, 0, len(dirs))
+	for p := range dirs {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return pathDepth(paths[i]) > pathDepth(paths[j])
+	})
+	for _, p := range paths {
+		d := dirs[p]
+		err := d.hash()
+		if err != nil {
+			return errors.Wrapf(err, "hash %q", p)
+		}
+		if p == "." {
+			continue
+		}
+		parent := dirs[path.Dir(p)]
+		parent.Files = append(parent.Files, &FileSeal{
+			Name:   d.Name,
+			IsDir:  true,
+			Size:   d.TotalSize,
+			SHA256: d.SHA256,
+		})
+		parent.TotalSize += d.TotalSize
+	}
+	return nil
+}
+
+// checkPayloadOxum compares the Payload-Oxum of bag-info.txt
+// with the bytes and number of files in the payload.
+func checkPayloadOxum(bagDir string, v *BagValidation) error {
+	info, err := readBagInfo(filepath.Join(bagDir, bagInfo))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read bag-info.txt")
+	}
+	oxum, ok := info["Payload-Oxum"]
+	if !ok {
+		return nil
+	}
+	var files, size int64
+	err = filepath.WalkDir(filepath.Join(bagDir, bagDataDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "WalkDir payload")
+	}
+	parts := strings.SplitN(oxum, ".", 2)
+	wantSize, err1 := strconv.ParseInt(parts[0], 10, 64)
+	var wantFiles int64
+	var err2 error = errors.New("missing file count")
+	if len(parts) == 2 {
+		wantFiles, err2 = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if err1 != nil || err2 != nil {
+		v.Errors = append(v.Errors, fmt.Sprintf("invalid Payload-Oxum %q", oxum))
+	} else if wantSize != size || wantFiles != files {
+		v.Errors = append(v.Errors, fmt.Sprintf("Payload-Oxum is %d.%d, want %s", size, files, oxum))
+	}
+	return nil
+}
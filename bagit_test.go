@@ -0,0 +1,60 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeValidateBag(t *testing.T) {
+	SetupTestDir(t)
+	bag := t.TempDir()
+	data := filepath.Join(bag, bagDataDir)
+	copyTestTree(t, data)
+	require.NoError(t, os.WriteFile(filepath.Join(bag, bagInfo), []byte("Source-Organization: Test\n"), 0644))
+
+	assert.Error(t, MakeBag(bag, ""), "payload isn't sealed")
+	_, err := SealPath(data, nil)
+	require.NoError(t, err)
+	require.NoError(t, MakeBag(bag, ""))
+
+	manifest, err := os.ReadFile(filepath.Join(bag, bagManifest))
+	require.NoError(t, err)
+	assert.Contains(t, string(manifest), "  data/sub/c.txt\n")
+	assert.Contains(t, string(manifest), "  data/"+SealFile+"\n")
+	info, err := readBagInfo(filepath.Join(bag, bagInfo))
+	require.NoError(t, err)
+	assert.Equal(t, "Test", info["Source-Organization"])
+	assert.True(t, strings.HasSuffix(info["Payload-Oxum"], ".5"), info["Payload-Oxum"])
+
+	v, err := ValidateBag(bag, nil)
+	require.NoError(t, err)
+	assert.True(t, v.OK(), v.Errors)
+	assert.Equal(t, 2, len(v.Dirs))
+
+	// a changed payload file shows up in the seal of its directory
+	randomFile(t, filepath.Join(data, "sub", "d.txt"), 4)
+	v, err = ValidateBag(bag, nil)
+	require.NoError(t, err)
+	assert.False(t, v.OK())
+	for _, dir := range v.Dirs {
+		if dir.Path == "sub" {
+			require.Equal(t, 1, len(dir.HashDiff.FilesChanged))
+			assert.Equal(t, "d.txt", dir.HashDiff.FilesChanged[0].Have.Name)
+		}
+	}
+	assert.Error(t, MakeBag(bag, ""), "seal is out of date")
+
+	// an unlisted payload file and a changed tag file
+	randomFile(t, filepath.Join(data, "sub", "d.txt"), 3)
+	require.NoError(t, os.WriteFile(filepath.Join(data, "new.txt"), []byte("new"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(bag, bagDeclaration), []byte("BagIt-Version: 0.97\n"), 0644))
+	v, err = ValidateBag(bag, nil)
+	require.NoError(t, err)
+	assert.False(t, v.OK())
+	assert.Equal(t, 2, len(v.Errors), v.Errors)
+}
@@ -0,0 +1,438 @@
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func importChecksumsCmd() *cobra.Command {
+	var trust bool
+	cmd := &cobra.Command{
+		Use:   "import-checksums FILE [PATH]",
+		Short: "seals a directory tree from sha256sum, BSD or hashdeep checksum files",
+		Long: `Seals the directory tree at PATH, or the directory of FILE, and checks
+the files against the SHA256 checksums in FILE. The format is detected,
+FILE can be written by sha256sum, shasum -a 256, BSD sha256 or hashdeep.
+Paths in FILE are relative to PATH.
+
+By default all files are hashed and the seals are only written if all
+listed files exist and match their checksums. With --trust, the listed
+checksums are used without hashing the files, only files that aren't
+listed are hashed. Sizes in hashdeep files are always checked.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 || len(args) > 2 {
+				return errors.New("need a checksum file and an optional directory path")
+			}
+			dirPath := filepath.Dir(args[0])
+			if len(args) == 2 {
+				dirPath = args[1]
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return errors.Wrap(err, "Open")
+			}
+			sums, err := ParseChecksums(f)
+			f.Close()
+			if err != nil {
+				return errors.Wrapf(err, "parse %q", args[0])
+			}
+			report, err := ImportChecksums(sums, dirPath, trust)
+			if report != nil {
+				report.Print()
+			}
+			return err
+		},
+	}
+	cmd.Flags().BoolVar(&trust, "trust", false, "use the checksums without hashing the listed files")
+	return cmd
+}
+
+func exportChecksumsCmd() *cobra.Command {
+	var output, format string
+	cmd := &cobra.Command{
+		Use:   "export-checksums PATH",
+		Short: "writes the file hashes of the seal files as sha256sum, BSD or hashdeep file",
+		Long: `Writes the SHA256 of all files in the seal files of a directory tree
+in a format that other tools can verify, with paths relative to PATH:
+  sha256sum  "HASH  PATH" lines for sha256sum -c and shasum -c
+  bsd        "SHA256 (PATH) = HASH" lines for BSD sha256 -c
+  hashdeep   a hashdeep file with sizes for hashdeep -a -k FILE`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one directory path to export checksums")
+			}
+			sums, err := SealChecksums(args[0])
+			if err != nil {
+				return err
+			}
+			out := os.Stdout
+			if output != "" {
+				out, err = os.Create(output)
+				if err != nil {
+					return errors.Wrap(err, "Create")
+				}
+				defer out.Close()
+			}
+			return WriteChecksums(out, sums, ChecksumFormat(format))
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write, standard output if empty")
+	cmd.Flags().StringVar(&format, "format", string(ChecksumSHA256Sum), "checksum format: sha256sum, bsd or hashdeep")
+	return cmd
+}
+
+// ChecksumFormat is the format of a checksum file.
+type ChecksumFormat string
+
+const (
+	// ChecksumSHA256Sum is the format of sha256sum and shasum.
+	ChecksumSHA256Sum ChecksumFormat = "sha256sum"
+	// ChecksumBSD is the tagged format of BSD sha256 and sha256sum --tag.
+	ChecksumBSD ChecksumFormat = "bsd"
+	// ChecksumHashdeep is the format of hashdeep, with file sizes.
+	ChecksumHashdeep ChecksumFormat = "hashdeep"
+)
+
+// Checksum is the SHA256 of a file in a checksum file.
+// Size is -1 if the format doesn't include sizes.
+type Checksum struct {
+	Path   string
+	SHA256 []byte
+	Size   int64
+}
+
+var (
+	gnuChecksumLine = regexp.MustCompile(`^\\?([0-9a-fA-F]{64}) [ *](.+)$`)
+	bsdChecksumLine = regexp.MustCompile(`^\\?SHA256 ?\((.+)\) ?= ?([0-9a-fA-F]{64})$`)
+)
+
+const hashdeepHeader = "%%%% HASHDEEP-1.0"
+
+// ParseChecksums reads a checksum file in any of the formats. Empty
+// lines and comments starting with # are skipped.
+func ParseChecksums(r io.Reader) ([]Checksum, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var sums []Checksum
+	// columns of hashdeep files, from the header
+	var hashdeepColumns []string
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if line == 1 && text == hashdeepHeader {
+			hashdeepColumns = []string{}
+			continue
+		}
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var sum Checksum
+		var err error
+		switch {
+		case hashdeepColumns != nil:
+			if strings.HasPrefix(text, "%%%% ") {
+				hashdeepColumns = strings.Split(strings.TrimPrefix(text, "%%%% "), ",")
+				continue
+			}
+			sum, err = parseHashdeepLine(text, hashdeepColumns)
+		case bsdChecksumLine.MatchString(text):
+			m := bsdChecksumLine.FindStringSubmatch(text)
+			sum, err = newChecksum(checksumName(text, m[1]), m[2], -1)
+		case gnuChecksumLine.MatchString(text):
+			m := gnuChecksumLine.FindStringSubmatch(text)
+			sum, err = newChecksum(checksumName(text, m[2]), m[1], -1)
+		default:
+			err = errors.New("not a SHA256 checksum")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		sums = append(sums, sum)
+	}
+	return sums, errors.Wrap(scanner.Err(), "Scan")
+}
+
+// parseHashdeepLine parses a line with the columns of the header.
+// The file name is the last column and can contain commas.
+func parseHashdeepLine(text string, columns []string) (Checksum, error) {
+	if len(columns) == 0 || columns[len(columns)-1] != "filename" {
+		return Checksum{}, errors.New("hashdeep file without column header")
+	}
+	fields := strings.SplitN(text, ",", len(columns))
+	if len(fields) != len(columns) {
+		return Checksum{}, errors.Errorf("want %d columns", len(columns))
+	}
+	size := int64(-1)
+	var hash string
+	for i, column := range columns {
+		switch column {
+		case "size":
+			var err error
+			size, err = strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return Checksum{}, errors.Wrap(err, "size")
+			}
+		case "sha256":
+			hash = fields[i]
+		}
+	}
+	if hash == "" {
+		return Checksum{}, errors.New("hashdeep file without sha256 column")
+	}
+	return newChecksum(fields[len(fields)-1], hash, size)
+}
+
+func newChecksum(name, hexHash string, size int64) (Checksum, error) {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil || len(hash) != 32 {
+		return Checksum{}, errors.Errorf("invalid SHA256 %q", hexHash)
+	}
+	return Checksum{Path: name, SHA256: hash, Size: size}, nil
+}
+
+// checksumName returns the name of a checksum line. Lines that start
+// with a backslash have backslashes and newlines in the name escaped.
+func checksumName(line, name string) string {
+	if line[0] != '\\' {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			i++
+			if name[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// escapeChecksumName escapes backslashes and newlines in a name
+// like sha256sum, the line then starts with the prefix.
+func escapeChecksumName(name string) (prefix, escaped string) {
+	if !strings.ContainsAny(name, "\\\n") {
+		return "", name
+	}
+	return "\\", strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+}
+
+// WriteChecksums writes the checksums in the format.
+func WriteChecksums(w io.Writer, sums []Checksum, format ChecksumFormat) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case ChecksumSHA256Sum:
+		for _, sum := range sums {
+			prefix, name := escapeChecksumName(sum.Path)
+			fmt.Fprintf(bw, "%s%x  %s\n", prefix, sum.SHA256, name)
+		}
+	case ChecksumBSD:
+		for _, sum := range sums {
+			prefix, name := escapeChecksumName(sum.Path)
+			fmt.Fprintf(bw, "%sSHA256 (%s) = %x\n", prefix, name, sum.SHA256)
+		}
+	case ChecksumHashdeep:
+		fmt.Fprintln(bw, hashdeepHeader)
+		fmt.Fprintln(bw, "%%%% size,sha256,filename")
+		fmt.Fprintln(bw, "## written by seal export-checksums")
+		fmt.Fprintln(bw, "##")
+		for _, sum := range sums {
+			fmt.Fprintf(bw, "%d,%x,%s\n", sum.Size, sum.SHA256, sum.Path)
+		}
+	default:
+		return errors.Errorf("unknown checksum format %q", format)
+	}
+	return errors.Wrap(bw.Flush(), "Flush")
+}
+
+// SealChecksums returns the checksums of all existing files in the
+// seal files below dirPath, with paths relative to dirPath.
+func SealChecksums(dirPath string) ([]Checksum, error) {
+	loadSeals := true
+	dirs, err := walkDirectories(dirPath, loadSeals, walkOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "walkDirectories")
+	}
+	var sums []Checksum
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dirPath, dir.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Rel")
+		}
+		for _, f := range dir.Seal.Files {
+			if f.IsDir || !f.exists() {
+				continue
+			}
+			sums = append(sums, Checksum{
+				Path:   path.Join(filepath.ToSlash(rel), f.Name),
+				SHA256: f.SHA256,
+				Size:   f.Size,
+			})
+		}
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		return sums[i].Path < sums[j].Path
+	})
+	return sums, nil
+}
+
+// ChecksumImport reports how the files of a tree matched a checksum file.
+type ChecksumImport struct {
+	Dirs int
+	// Matched files were hashed and match their checksum,
+	// Trusted files were not hashed because of their checksum.
+	Matched int
+	Trusted int
+	// Unlisted files are not in the checksum file and were hashed.
+	Unlisted []string
+	// Mismatched files don't match their checksum or size.
+	Mismatched []string
+	// Missing files are in the checksum file, but not in the tree.
+	Missing []string
+}
+
+// OK reports if all listed files exist and match.
+func (c *ChecksumImport) OK() bool {
+	return len(c.Mismatched) == 0 && len(c.Missing) == 0
+}
+
+// Print logs the result of the import.
+func (c *ChecksumImport) Print() {
+	for _, p := range c.Unlisted {
+		log.Println(color.YellowString("not in checksums: %q", p))
+	}
+	for _, p := range c.Mismatched {
+		log.Println(color.RedString("checksum mismatch: %q", p))
+	}
+	for _, p := range c.Missing {
+		log.Println(color.RedString("missing file: %q", p))
+	}
+	log.Printf("%d directories, %d files matched, %d trusted, %d not in checksums, %d mismatched, %d missing",
+		c.Dirs, c.Matched, c.Trusted, len(c.Unlisted), len(c.Mismatched), len(c.Missing))
+}
+
+// checksumPath normalizes a path from a checksum file to a slash
+// separated path relative to the root.
+func checksumPath(root, name string) string {
+	name = filepath.ToSlash(name)
+	if filepath.IsAbs(name) {
+		if rel, err := filepath.Rel(root, filepath.FromSlash(name)); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+	}
+	return path.Clean(name)
+}
+
+// ImportChecksums seals the directory tree at dirPath and checks the
+// files against the checksums. Without trust all files are hashed,
+// with trust the listed checksums are used without hashing. The seal
+// files are only written if all listed files exist and match.
+func ImportChecksums(sums []Checksum, dirPath string, trust bool) (*ChecksumImport, error) {
+	root, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Abs")
+	}
+	listed := map[string]Checksum{}
+	for _, sum := range sums {
+		listed[checksumPath(root, sum.Path)] = sum
+	}
+
+	sealer := NewSealer(SealOptions{})
+	loadSeals := false
+	dirs, err := sealer.walk(dirPath, loadSeals)
+	if err != nil {
+		return nil, errors.Wrap(err, "indexDirectories")
+	}
+	report := &ChecksumImport{Dirs: len(dirs)}
+	seen := map[string]bool{}
+	scanned := map[string]*DirSeal{}
+	loadScanned := func(dirPath string) (*DirSeal, error) {
+		seal, ok := scanned[filepath.Clean(dirPath)]
+		if !ok {
+			return nil, errors.Wrapf(fs.ErrNotExist, "%q wasn't sealed", dirPath)
+		}
+		return seal, nil
+	}
+	for i, dir := range dirs {
+		hash := !trust
+		seal, err := sealer.sealDirWith(dir.Path, hash, loadScanned)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sealDir %q", dir.Path)
+		}
+		rel, err := filepath.Rel(dirPath, dir.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Rel")
+		}
+		for _, f := range seal.Files {
+			if f.IsDir {
+				continue
+			}
+			filePath := path.Join(filepath.ToSlash(rel), f.Name)
+			sum, ok := listed[filePath]
+			seen[filePath] = ok
+			if !ok {
+				report.Unlisted = append(report.Unlisted, filePath)
+				if trust {
+					f.SHA256, err = hashFile(filepath.Join(dir.Path, f.Name))
+					if err != nil {
+						return nil, errors.Wrapf(err, "hash %q", filePath)
+					}
+				}
+				continue
+			}
+			if sum.Size >= 0 && sum.Size != f.Size {
+				report.Mismatched = append(report.Mismatched, filePath)
+				continue
+			}
+			if trust {
+				f.SHA256 = sum.SHA256
+				report.Trusted++
+			} else if bytes.Equal(f.SHA256, sum.SHA256) {
+				report.Matched++
+			} else {
+				report.Mismatched = append(report.Mismatched, filePath)
+			}
+		}
+		err = seal.hash()
+		if err != nil {
+			return nil, errors.Wrap(err, "hash")
+		}
+		dirs[i].Seal = seal
+		scanned[dir.Path] = seal
+	}
+	for filePath := range listed {
+		if !seen[filePath] {
+			report.Missing = append(report.Missing, filePath)
+		}
+	}
+	sort.Strings(report.Missing)
+	if !report.OK() {
+		return report, errors.New("files don't match the checksums, no seals were written")
+	}
+
+	for _, dir := range dirs {
+		err = dir.Seal.updateSeal(osFS{}, dir.Path, PrintSealing, &WriteLock, nil)
+		if err != nil {
+			return report, errors.Wrapf(err, "update seal %q", dir.Path)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,108 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChecksum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestParseChecksums(t *testing.T) {
+	files := map[string]string{
+		"sha256sum": testChecksum + "  a.txt\n" + testChecksum + " *sub/b c.txt\n\\" + testChecksum + "  sub/new\\nline\n",
+		"bsd":       "# comment\nSHA256 (a.txt) = " + testChecksum + "\nSHA256 (sub/b c.txt) = " + testChecksum + "\n\\SHA256 (sub/new\\nline) = " + testChecksum + "\n",
+		"hashdeep": "%%%% HASHDEEP-1.0\n%%%% size,md5,sha256,filename\n## Invoked from: /\n##\n" +
+			"4,d41d8cd98f00b204e9800998ecf8427e," + testChecksum + ",a.txt\n" +
+			"5,d41d8cd98f00b204e9800998ecf8427e," + testChecksum + ",sub/b c.txt\n",
+	}
+	for format, file := range files {
+		sums, err := ParseChecksums(strings.NewReader(file))
+		require.NoError(t, err, format)
+		require.True(t, len(sums) >= 2, format)
+		assert.Equal(t, "a.txt", sums[0].Path, format)
+		assert.Equal(t, "sub/b c.txt", sums[1].Path, format)
+		assert.Equal(t, testChecksum, hex.EncodeToString(sums[0].SHA256), format)
+		if format == "hashdeep" {
+			assert.Equal(t, int64(5), sums[1].Size)
+		} else {
+			assert.Equal(t, int64(-1), sums[1].Size, format)
+		}
+		if format != "hashdeep" {
+			assert.Equal(t, "sub/new\nline", sums[2].Path, format)
+		}
+	}
+
+	_, err := ParseChecksums(strings.NewReader("d41d8cd98f00b204e9800998ecf8427e  a.txt\n"))
+	assert.Error(t, err, "MD5 sums are not supported")
+}
+
+func TestExportImportChecksums(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	sums, err := SealChecksums(TestDir)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(sums))
+	assert.Equal(t, "sub/c.txt", sums[1].Path)
+
+	for _, format := range []ChecksumFormat{ChecksumSHA256Sum, ChecksumBSD, ChecksumHashdeep} {
+		var buf bytes.Buffer
+		require.NoError(t, WriteChecksums(&buf, sums, format))
+		parsed, err := ParseChecksums(&buf)
+		require.NoError(t, err, format)
+		require.Equal(t, len(sums), len(parsed), format)
+		for i := range sums {
+			assert.Equal(t, sums[i].Path, parsed[i].Path, format)
+			assert.Equal(t, sums[i].SHA256, parsed[i].SHA256, format)
+		}
+	}
+
+	target := filepath.Join(t.TempDir(), "copy")
+	copyTestTree(t, target)
+	report, err := ImportChecksums(sums, target, false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Matched)
+	copied, err := loadSeal(target)
+	require.NoError(t, err)
+	root, err := loadSeal(TestDir)
+	require.NoError(t, err)
+	assert.Equal(t, root.SHA256, copied.SHA256)
+}
+
+func TestImportChecksumsMismatch(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	sums, err := SealChecksums(TestDir)
+	require.NoError(t, err)
+	sums[0].SHA256 = bytes.Repeat([]byte{1}, 32)
+	sums = append(sums, Checksum{Path: "gone.txt", SHA256: sums[1].SHA256, Size: -1})
+
+	target := filepath.Join(t.TempDir(), "copy")
+	copyTestTree(t, target)
+	report, err := ImportChecksums(sums, target, false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a.txt"}, report.Mismatched)
+	assert.Equal(t, []string{"gone.txt"}, report.Missing)
+	_, err = os.Stat(filepath.Join(target, SealFile))
+	assert.True(t, os.IsNotExist(err), "no seals are written")
+
+	// trusted checksums end up in the seals without hashing
+	report, err = ImportChecksums(sums[:3], target, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Trusted)
+	copied, err := loadSeal(target)
+	require.NoError(t, err)
+	for _, f := range copied.Files {
+		if f.Name == "a.txt" {
+			assert.Equal(t, sums[0].SHA256, f.SHA256)
+		}
+	}
+}
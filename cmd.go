@@ -15,15 +15,17 @@ import (
 
 var (
 	beforeFlag  string
+	keyFile     string
 	timeLayouts = []string{
 		"2006-01-02T15:04:05",
 		"2006-01-02T15:04",
 		"2006-01-02",
 	}
-	Before        time.Time
-	PrintInterval time.Duration
-	IndexFile     string
-	PathPrefixes  []string
+	Before           time.Time
+	PrintInterval    time.Duration
+	IndexFile        string
+	PathPrefixes     []string
+	IndexStorageType string
 
 	WriteLock sync.Mutex
 )
@@ -48,6 +50,9 @@ func RootCmd() *cobra.Command {
 					}
 				}
 			}
+			if err == nil {
+				err = loadPassphrase()
+			}
 
 			go func() {
 				sigs := make(chan os.Signal, 1)
@@ -65,34 +70,125 @@ func RootCmd() *cobra.Command {
 	cmd.AddCommand(indexCmd)
 	cmd.AddCommand(indexBenchCmd())
 	cmd.AddCommand(compareCmd())
+	cmd.AddCommand(dupesCmd())
+	cmd.AddCommand(applyPlanCmd())
+	cmd.AddCommand(findCmd())
+	cmd.AddCommand(statsCmd())
+	cmd.AddCommand(historyCmd())
+	cmd.AddCommand(archiveCmd())
+	cmd.AddCommand(exportCmd())
+	cmd.AddCommand(importCmd())
+	cmd.AddCommand(importChecksumsCmd())
+	cmd.AddCommand(exportChecksumsCmd())
+	cmd.AddCommand(bagCmd())
+	cmd.AddCommand(keygenCmd())
 
 	cmd.PersistentFlags().StringVarP(&beforeFlag, "before", "b", "", "ignore directories sealed after this time")
 	cmd.PersistentFlags().DurationVarP(&PrintInterval, "interval", "i", time.Minute, "interval at which progress is reported")
 	cmd.PersistentFlags().StringVarP(&IndexFile, "file", "f", "", "index file path")
 	cmd.PersistentFlags().StringArrayVarP(&PathPrefixes, "prefixes", "p", nil, "relative path prefixes to include")
+	cmd.PersistentFlags().StringVar(&IndexStorageType, "storage", "", "index storage type: sqlite, boltdb, pebble or memory, detected if empty")
+	cmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "file with the passphrase of encrypted indices, or set SEAL_PASSPHRASE")
 	return cmd
 }
 
+// loadPassphrase sets the IndexPassphrase from the key file, or from
+// the SEAL_PASSPHRASE environment variable. The whole key file is
+// used as the passphrase, so it can also hold random bytes.
+func loadPassphrase() error {
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return errors.Wrap(err, "read key file")
+		}
+		IndexPassphrase = key
+		return nil
+	}
+	if passphrase := os.Getenv("SEAL_PASSPHRASE"); passphrase != "" {
+		IndexPassphrase = []byte(passphrase)
+	}
+	return nil
+}
+
+// progressUIInterval is how often the progress is redrawn on a terminal.
+const progressUIInterval = 200 * time.Millisecond
+
+// startProgressUI shows a progress line if stdout is a terminal. It
+// returns the handler for the OnEvent option, which is nil without a
+// terminal, and a function that removes the progress line.
+func startProgressUI() (EventHandler, func()) {
+	if !IsTerminal(os.Stdout) {
+		return nil, func() {}
+	}
+	ui := NewProgressUI(os.Stdout)
+	return ui.Handle, ui.Start(progressUIInterval)
+}
+
 var sealCmd = &cobra.Command{
 	Use:   "seal",
 	Short: "seals all new files and directories",
 	RunE:  runSealCmd,
 }
 
+// storeFile is the manifest that seal and verify use
+// instead of seal files, if it is set.
+var storeFile string
+
+var (
+	signKeyFile    string
+	verifyKeyFiles []string
+)
+
+func init() {
+	storeUsage := "manifest file that holds all seals instead of seal files in every directory"
+	sealCmd.Flags().StringVar(&storeFile, "store", "", storeUsage)
+	verifyCmd.Flags().StringVar(&storeFile, "store", "", storeUsage)
+	sealCmd.Flags().StringVar(&signKeyFile, "sign-key", "", "private key file from keygen that signs the seals")
+	verifyCmd.Flags().StringArrayVar(&verifyKeyFiles, "verify-key", nil, "public key file of a key that the seals have to be signed with")
+}
+
 func runSealCmd(cmd *cobra.Command, args []string) error {
 	if len(args) == 0 {
 		return errors.New("need at least one path argument to seal")
 	}
 
 	start := time.Now()
+	opts := SealOptions{
+		Prefixes:         PathPrefixes,
+		Before:           Before,
+		PrintProgress:    true,
+		ProgressInterval: PrintInterval,
+		PrintChanges:     true,
+		WriteLock:        &WriteLock,
+	}
+	if signKeyFile != "" {
+		key, err := LoadSigningKey(signKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "LoadSigningKey")
+		}
+		opts.SigningKey = key
+	}
+	var stop func()
+	opts.OnEvent, stop = startProgressUI()
+	defer stop()
+	opts.PrintProgress = opts.OnEvent == nil
+	if storeFile != "" {
+		if len(args) > 1 {
+			return errors.New("--store holds the seals of a single path")
+		}
+		_, err := SealToManifest(args[0], storeFile, opts)
+		if err != nil {
+			return errors.Wrap(err, "SealToManifest")
+		}
+		log.Println("ran for", time.Since(start))
+		return nil
+	}
+	sealer := NewSealer(opts)
 	for _, path := range args {
-		PrintSealing = true
-		PrintIndexProgress = true
-		_, err := SealPath(path, PathPrefixes)
+		_, err := sealer.Seal(path)
 		if err != nil {
-			return errors.Wrap(err, "SealPath")
+			return errors.Wrap(err, "Seal")
 		}
-
 	}
 	log.Println("ran for", time.Since(start))
 	return nil
@@ -110,16 +206,48 @@ func runVerifyCmd(cmd *cobra.Command, args []string) error {
 	}
 
 	start := time.Now()
-	for _, path := range args {
-		PrintVerify = true
-		PrintIndexProgress = true
-		printDifferences := true
-		_, err := VerifyPath(path, printDifferences, PathPrefixes)
+	opts := VerifyOptions{
+		Prefixes:         PathPrefixes,
+		Before:           Before,
+		PrintDifferences: true,
+		PrintProgress:    true,
+		ProgressInterval: PrintInterval,
+	}
+	for _, keyFile := range verifyKeyFiles {
+		key, err := LoadVerifyKey(keyFile)
 		if err != nil {
-			return errors.Wrap(err, "VerifyPath")
+			return errors.Wrap(err, "LoadVerifyKey")
+		}
+		opts.VerifyKeys = append(opts.VerifyKeys, key)
+	}
+	var stop func()
+	opts.OnEvent, stop = startProgressUI()
+	defer stop()
+	opts.PrintProgress = opts.OnEvent == nil
+	var unsigned int
+	if storeFile != "" {
+		if len(args) > 1 {
+			return errors.New("--store holds the seals of a single path")
+		}
+		dirs, err := VerifyManifest(args[0], storeFile, opts)
+		if err != nil {
+			return errors.Wrap(err, "VerifyManifest")
+		}
+		unsigned = signatureFailures(dirs)
+	} else {
+		verifier := NewVerifier(opts)
+		for _, path := range args {
+			dirs, err := verifier.Verify(path)
+			if err != nil {
+				return errors.Wrap(err, "Verify")
+			}
+			unsigned += signatureFailures(dirs)
 		}
 	}
 	log.Println("ran for", time.Since(start))
+	if unsigned > 0 {
+		return errors.Errorf("%d seals have missing or invalid signatures", unsigned)
+	}
 	return nil
 }
 
@@ -129,6 +257,22 @@ var indexCmd = &cobra.Command{
 	RunE:  runIndexCmd,
 }
 
+var (
+	indexFormat     string
+	indexEntries    bool
+	indexVolumeName string
+	indexEncrypt    bool
+)
+
+func init() {
+	indexCmd.AddCommand(indexConvertCmd())
+	indexCmd.AddCommand(indexCheckCmd())
+	indexCmd.Flags().StringVar(&indexFormat, "format", "", "record format of a new index: json or binary")
+	indexCmd.Flags().StringVar(&indexVolumeName, "volume", "", "name of the indexed volume, defaults to the absolute path")
+	indexCmd.Flags().BoolVar(&indexEntries, "entries", false, "also write the seals to a table with one column per field for SQL queries")
+	indexCmd.Flags().BoolVar(&indexEncrypt, "encrypt", false, "encrypt a new index with the passphrase from --key-file or SEAL_PASSPHRASE; reading it by path keeps all paths in memory and is limited to 2M seals")
+}
+
 func runIndexCmd(cmd *cobra.Command, args []string) error {
 	if len(args) == 0 {
 		return errors.New("need at least one path argument to index")
@@ -137,7 +281,13 @@ func runIndexCmd(cmd *cobra.Command, args []string) error {
 	PrintIndexProgress = true
 	start := time.Now()
 	for _, path := range args {
-		err := IndexPath(path, IndexFile, PathPrefixes)
+		opts := &IndexOptions{
+			Format:  RecordFormat(indexFormat),
+			Entries: indexEntries,
+			Volume:  indexVolumeName,
+			Encrypt: indexEncrypt,
+		}
+		err := IndexPath(path, IndexFile, StorageType(IndexStorageType), PathPrefixes, opts)
 		if err != nil {
 			return errors.Wrap(err, "IndexPath")
 		}
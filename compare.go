@@ -1,71 +1,586 @@
 package seal
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
+	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 func compareCmd() *cobra.Command {
+	var (
+		summary      bool
+		typeA, typeB string
+
+		planFile, planFormat   string
+		planDelete             bool
+		sourceRoot, targetRoot string
+	)
 	cmd := &cobra.Command{
-		Use:   "compare",
-		Short: "compare indexes",
+		Use:   "compare A B",
+		Short: "compare indexes and directory trees",
+		Long: `Compares two indices or directory trees and reports for every file of
+one side whether the same content exists on the other side, at the
+same path, at a different path or not at all.
+
+The type of each side is either an index storage type (sqlite, boltdb,
+pebble), or one of these directory tree types:
+  seals  use the seal files of the directory tree
+  scan   hash all files of the directory tree without writing seal files
+  quick  only read file metadata and compare files by size
+Directories with a seal file default to seals, for everything else the
+type set with --storage is used, or detected from the index.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 2 {
-				return errors.New("need two index paths to compare indices")
+				return errors.New("need two index or directory paths to compare")
+			}
+			a := CompareSource{Path: args[0], Type: typeA}
+			b := CompareSource{Path: args[1], Type: typeB}
+			if IndexStorageType != "" {
+				for _, s := range []*CompareSource{&a, &b} {
+					if s.Type == "" && !s.isTree() {
+						s.Type = IndexStorageType
+					}
+				}
+			}
+			opts := CompareOptions{
+				Prefixes:         PathPrefixes,
+				Before:           Before,
+				ProgressInterval: IndexProgressInterval,
+				Summary:          summary,
+				Plan:             planFile != "",
+				PlanDelete:       planDelete,
+			}
+			report, err := Compare(a, b, opts)
+			if err != nil {
+				return err
+			}
+			report.Print(!summary)
+
+			if planFile == "" {
+				return nil
+			}
+			plan := report.Plan
+			if sourceRoot != "" {
+				plan.SourceRoot = sourceRoot
 			}
-			return CompareIndices(args[0], args[1])
+			if targetRoot != "" {
+				plan.TargetRoot = targetRoot
+			}
+			err = WritePlanFile(planFile, plan, planFormat)
+			if err != nil {
+				return errors.Wrap(err, "WritePlanFile")
+			}
+			log.Printf("wrote plan with %d steps to %q", len(plan.Steps), planFile)
+			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&summary, "summary", false, "only print the totals, not every moved and absent file")
+	cmd.Flags().StringVar(&typeA, "type-a", "", "type of the first index or directory tree")
+	cmd.Flags().StringVar(&typeB, "type-b", "", "type of the second index or directory tree")
+	cmd.Flags().StringVar(&planFile, "plan", "", "write a plan that copies missing and outdated files from A to B")
+	cmd.Flags().StringVar(&planFormat, "plan-format", PlanFormatJSON, "format of the plan: json, shell or rsync")
+	cmd.Flags().BoolVar(&planDelete, "plan-delete", false, "delete files that only exist in B in the plan")
+	cmd.Flags().StringVar(&sourceRoot, "source-root", "", "directory of A used in the plan, defaults to A for directory trees")
+	cmd.Flags().StringVar(&targetRoot, "target-root", "", "directory of B used in the plan, defaults to B for directory trees")
 	return cmd
 }
 
-func CompareIndices(pathA, pathB string) error {
-	PrintIndexProgress = true
+// Directory tree types of a CompareSource.
+const (
+	SourceSeals     = "seals"
+	SourceScan      = "scan"
+	SourceQuickScan = "quick"
+)
+
+// CompareSource is one side of a comparison. Type is either a
+// StorageType for indices, or SourceSeals, SourceScan or
+// SourceQuickScan for directory trees.
+type CompareSource struct {
+	Path string
+	Type string
+}
+
+// sourceType returns the type of the source, detecting sealed
+// directory trees if no type is set. For all other sources it
+// returns StorageTypeAuto, which detects the type of the index.
+func (s CompareSource) sourceType() string {
+	if s.Type != "" {
+		return s.Type
+	}
+	_, err := os.Stat(filepath.Join(s.Path, SealFile))
+	if err == nil {
+		return SourceSeals
+	}
+	return string(StorageTypeAuto)
+}
+
+// isTree is true for directory tree sources.
+func (s CompareSource) isTree() bool {
+	switch s.sourceType() {
+	case SourceSeals, SourceScan, SourceQuickScan:
+		return true
+	}
+	return false
+}
+
+// open opens the source with paths relative to its base path.
+// Indices are streamed, directory trees are loaded into memory.
+func (s CompareSource) open(walk walkOptions) (sealSource, error) {
+	var dirs []Dir
+	var err error
+	switch s.sourceType() {
+	case SourceSeals:
+		loadSeals := true
+		dirs, err = walkDirectories(s.Path, loadSeals, walk)
+		if err != nil {
+			return nil, errors.Wrap(err, "walkDirectories")
+		}
+	case SourceScan, SourceQuickScan:
+		hash := s.sourceType() == SourceScan
+		sealer := NewSealer(SealOptions{Prefixes: walk.Prefixes, Before: walk.Before})
+		dirs, err = sealer.Scan(s.Path, hash)
+		if err != nil {
+			return nil, errors.Wrap(err, "Scan")
+		}
+	default:
+		storage, err := openStorage(StorageType(s.sourceType()), s.Path, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "openStorage")
+		}
+		return &storageSource{storage: storage}, nil
+	}
+	return dirsSource(dirs, s.Path)
+}
+
+// CompareOptions configure what Compare does.
+type CompareOptions struct {
+	// Prefixes limit which parts of directory trees are loaded.
+	Prefixes []string
+	// Before skips directories that were sealed after this time.
+	Before time.Time
+	// ProgressInterval logs the progress of loading directory
+	// trees if it is set.
+	ProgressInterval time.Duration
+	// Summary only counts files instead of listing them.
+	Summary bool
+	// Plan creates a plan that syncs A to B.
+	Plan bool
+	// PlanDelete deletes files that only exist in B in the plan.
+	PlanDelete bool
+}
+
+// CompareReport holds the differences between the root seals
+// and the coverage of both indices in the other one.
+type CompareReport struct {
+	NameA, NameB string
+	RootDiff     *Diff
+	AInB         *Coverage
+	BInA         *Coverage
+	Plan         *Plan `json:",omitempty"`
+}
+
+// Coverage describes how many of the files of one index
+// exist with the same content in another index.
+type Coverage struct {
+	SamePath CoverageCount
+	Moved    CoverageCount
+	Absent   CoverageCount
+
+	MovedFiles  []CoverageFile
+	AbsentFiles []CoverageFile
+}
+
+// CoverageCount counts files and their bytes.
+type CoverageCount struct {
+	Files int
+	Bytes int64
+}
+
+func (c *CoverageCount) add(size int64) {
+	c.Files++
+	c.Bytes += size
+}
+
+// CoverageFile is a file of one index. For moved files,
+// OtherPath is a path in the other index with the same content.
+type CoverageFile struct {
+	Path      string
+	Size      int64
+	OtherPath string `json:",omitempty"`
+}
 
+// Complete is true if all files exist in the other index.
+func (c *Coverage) Complete() bool {
+	return c.Absent.Files == 0
+}
+
+// CompareIndices compares two indices, detecting the storage type
+// of each from its file header or directory layout.
+func CompareIndices(pathA, pathB string) (*CompareReport, error) {
+	a := CompareSource{Path: pathA, Type: string(StorageTypeAuto)}
+	b := CompareSource{Path: pathB, Type: string(StorageTypeAuto)}
+	return Compare(a, b, CompareOptions{})
+}
+
+// Compare compares two indices or directory trees. Both sides are
+// walked concurrently as sorted streams, first ordered by hash to
+// find files with the same content, then ordered by path to create
+// the plan. If a side is a quick scan without hashes, files are only
+// compared at the same path.
+func Compare(a, b CompareSource, opts CompareOptions) (*CompareReport, error) {
+	walk := walkOptions{
+		Prefixes:         opts.Prefixes,
+		Before:           opts.Before,
+		ProgressInterval: opts.ProgressInterval,
+	}
 	start := time.Now()
-	indexA, err := LoadIndex(pathA, StorageTypeSQLite)
+	sourceA, err := a.open(walk)
 	if err != nil {
-		return errors.Wrap(err, "LoadIndex pathA")
+		return nil, errors.Wrapf(err, "open %q", a.Path)
 	}
+	defer sourceA.Close()
+	sourceB, err := b.open(walk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", b.Path)
+	}
+	defer sourceB.Close()
+	log.Println("opened both sides after", time.Since(start))
 
-	log.Println("len by path", len(indexA.ByPath), "by hash", len(indexA.ByHash), "dirs", len(indexA.Dirs))
+	c := &comparison{
+		report:     &CompareReport{NameA: a.Path, NameB: b.Path, AInB: &Coverage{}, BInA: &Coverage{}},
+		listFiles:  !opts.Summary,
+		planDelete: opts.PlanDelete,
+	}
+	byHash := a.hashed() && b.hashed()
+	if byHash {
+		err = c.coverageByHash(sourceA.iterateByHash(), sourceB.iterateByHash())
+		if err != nil {
+			return nil, errors.Wrap(err, "coverageByHash")
+		}
+	}
+	if !byHash || opts.Plan {
+		if opts.Plan {
+			c.report.Plan = &Plan{}
+			if a.isTree() {
+				c.report.Plan.SourceRoot = a.Path
+			}
+			if b.isTree() {
+				c.report.Plan.TargetRoot = b.Path
+			}
+		}
+		c.pathCoverage = !byHash
+		err = c.compareByPath(sourceA.iterateByPath(), sourceB.iterateByPath())
+		if err != nil {
+			return nil, errors.Wrap(err, "compareByPath")
+		}
+	}
+
+	if c.rootA != nil && c.rootB != nil {
+		checkHash := len(c.rootA.SHA256) > 0 && len(c.rootB.SHA256) > 0
+		c.report.RootDiff = DiffSeals(c.rootA, c.rootB, checkHash)
+	}
+	c.report.AInB.sort()
+	c.report.BInA.sort()
+	log.Println("done comparing after", time.Since(start))
+	return c.report, nil
+}
 
-	// count := 0
-	// for key, seal := range indexA.ByPath {
-	// 	log.Printf("key %q path %q\n", key, seal.Path)
-	// 	printStoredSeal(seal)
-	// 	count++
-	// 	if count > 10 {
-	// 		break
-	// 	}
-	// }
+// hashed is false for sources without file hashes.
+func (s CompareSource) hashed() bool {
+	return s.sourceType() != SourceQuickScan
+}
+
+// comparison holds the state of a merge join between two sources.
+type comparison struct {
+	report       *CompareReport
+	listFiles    bool
+	planDelete   bool
+	pathCoverage bool
+
+	rootA, rootB *DirSeal
+}
 
-	indexB, err := LoadIndex(pathB, StorageTypeSQLite)
+// coverageByHash walks both sources ordered by hash. Only the
+// seals sharing the current hash are kept in memory.
+func (c *comparison) coverageByHash(a, b SealIterator) error {
+	groupsA, groupsB := hashGroups(a), hashGroups(b)
+	ga, err := groupsA.next()
 	if err != nil {
-		return errors.Wrap(err, "LoadIndex pathB")
+		return err
+	}
+	gb, err := groupsB.next()
+	if err != nil {
+		return err
 	}
-	log.Println("loaded both indices after", time.Since(start))
 
-	rootA := indexA.ByPath["."]
-	rootB := indexB.ByPath["."]
-	// printStoredSeal(rootA)
-	// printStoredSeal(rootB)
-	// fmt.Println()
+	for ga != nil || gb != nil {
+		cmp := 0
+		switch {
+		case ga == nil:
+			cmp = 1
+		case gb == nil:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(ga[0].hash(), gb[0].hash())
+		}
 
-	diff := DiffSeals(rootA.Dir, rootB.Dir, true)
-	log.Println("Differences:")
-	diff.PrintDifferences()
+		if cmp <= 0 {
+			c.rootA = newerRoot(c.rootA, ga)
+			var other []StoredSeal
+			if cmp == 0 {
+				other = gb
+			}
+			c.coverGroup(c.report.AInB, ga, other)
+		}
+		if cmp >= 0 {
+			c.rootB = newerRoot(c.rootB, gb)
+			var other []StoredSeal
+			if cmp == 0 {
+				other = ga
+			}
+			c.coverGroup(c.report.BInA, gb, other)
+		}
 
-	compareDirsWithIndex(indexA.Dirs, indexB)
-	compareDirsWithIndex(indexB.Dirs, indexA)
-	log.Println("done comparing indices after", time.Since(start))
+		if cmp <= 0 {
+			ga, err = groupsA.next()
+			if err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			gb, err = groupsB.next()
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// coverGroup adds all existing files of a group of seals with the
+// same hash to the coverage, looking them up in the group of seals
+// from the other side with the same hash.
+func (c *comparison) coverGroup(coverage *Coverage, group, other []StoredSeal) {
+	otherPaths := map[string]bool{}
+	var firstOther string
+	for _, s := range other {
+		if s.File == nil || !s.File.exists() {
+			continue
+		}
+		otherPaths[s.Path] = true
+		if firstOther == "" {
+			firstOther = s.Path
+		}
+	}
+
+	for _, s := range group {
+		if s.File == nil || !s.File.exists() {
+			continue
+		}
+		switch {
+		case otherPaths[s.Path]:
+			coverage.SamePath.add(s.File.Size)
+		case firstOther != "":
+			coverage.Moved.add(s.File.Size)
+			if c.listFiles {
+				coverage.MovedFiles = append(coverage.MovedFiles, CoverageFile{Path: s.Path, Size: s.File.Size, OtherPath: firstOther})
+			}
+		default:
+			c.absent(coverage, s.Path, s.File.Size)
+		}
+	}
+}
+
+func (c *comparison) absent(coverage *Coverage, path string, size int64) {
+	coverage.Absent.add(size)
+	if c.listFiles {
+		coverage.AbsentFiles = append(coverage.AbsentFiles, CoverageFile{Path: path, Size: size})
+	}
+}
+
+// compareByPath walks both sources ordered by path and creates the
+// plan. If pathCoverage is set, it also fills the coverage by only
+// comparing files at the same path.
+func (c *comparison) compareByPath(a, b SealIterator) error {
+	groupsA, groupsB := pathGroups(a), pathGroups(b)
+	ga, err := groupsA.next()
+	if err != nil {
+		return err
+	}
+	gb, err := groupsB.next()
+	if err != nil {
+		return err
+	}
+
+	var deletes []PlanStep
+	for ga != nil || gb != nil {
+		cmp := 0
+		switch {
+		case ga == nil:
+			cmp = 1
+		case gb == nil:
+			cmp = -1
+		case ga[0].Path < gb[0].Path:
+			cmp = -1
+		case ga[0].Path > gb[0].Path:
+			cmp = 1
+		}
+
+		var fileA, fileB *FileSeal
+		if cmp <= 0 {
+			fileA = currentFile(ga)
+			if c.pathCoverage {
+				c.rootA = newerRoot(c.rootA, ga)
+			}
+		}
+		if cmp >= 0 {
+			fileB = currentFile(gb)
+			if c.pathCoverage {
+				c.rootB = newerRoot(c.rootB, gb)
+			}
+		}
+
+		if fileA != nil && fileB != nil && sameContent(fileA, fileB) {
+			if c.pathCoverage {
+				c.report.AInB.SamePath.add(fileA.Size)
+				c.report.BInA.SamePath.add(fileB.Size)
+			}
+		} else {
+			if fileA != nil {
+				if c.pathCoverage {
+					c.absent(c.report.AInB, ga[0].Path, fileA.Size)
+				}
+				if c.report.Plan != nil {
+					c.report.Plan.Steps = append(c.report.Plan.Steps, PlanStep{
+						Action: PlanCopy,
+						Path:   ga[0].Path,
+						Size:   fileA.Size,
+						SHA256: fileA.SHA256,
+					})
+				}
+			}
+			if fileB != nil {
+				if c.pathCoverage {
+					c.absent(c.report.BInA, gb[0].Path, fileB.Size)
+				}
+				if c.report.Plan != nil && c.planDelete && fileA == nil {
+					deletes = append(deletes, PlanStep{
+						Action: PlanDelete,
+						Path:   gb[0].Path,
+						Size:   fileB.Size,
+						SHA256: fileB.SHA256,
+					})
+				}
+			}
+		}
+
+		if cmp <= 0 {
+			ga, err = groupsA.next()
+			if err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			gb, err = groupsB.next()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// delete the deepest paths first
+	for i := len(deletes) - 1; i >= 0; i-- {
+		c.report.Plan.Steps = append(c.report.Plan.Steps, deletes[i])
+	}
+	return nil
+}
+
+// currentFile returns the newest seal of a group of seals with
+// the same path if it is an existing file.
+func currentFile(group []StoredSeal) *FileSeal {
+	current := &group[0]
+	for i := range group[1:] {
+		if group[i+1].newerThan(current) {
+			current = &group[i+1]
+		}
+	}
+	if current.File == nil || !current.File.exists() {
+		return nil
+	}
+	return current.File
+}
+
+// newerRoot returns the newest root directory seal
+// out of the current root and the seals in the group.
+func newerRoot(root *DirSeal, group []StoredSeal) *DirSeal {
+	for _, s := range group {
+		if s.Path != "." || s.Dir == nil {
+			continue
+		}
+		if root == nil || s.Dir.Sealed.After(root.Sealed) {
+			root = s.Dir
+		}
+	}
+	return root
+}
+
+// sort sorts the listed files by path.
+func (c *Coverage) sort() {
+	sort.Slice(c.MovedFiles, func(i, j int) bool {
+		return c.MovedFiles[i].Path < c.MovedFiles[j].Path
+	})
+	sort.Slice(c.AbsentFiles, func(i, j int) bool {
+		return c.AbsentFiles[i].Path < c.AbsentFiles[j].Path
+	})
+}
+
+// sameContent compares the hashes of both files,
+// or only their sizes if one of them isn't hashed.
+func sameContent(a, b *FileSeal) bool {
+	if len(a.SHA256) == 0 || len(b.SHA256) == 0 {
+		return a.Size == b.Size
+	}
+	return bytes.Equal(a.SHA256, b.SHA256)
+}
+
+// Print logs the root differences and the coverage in both directions.
+func (r *CompareReport) Print(listFiles bool) {
+	if r.RootDiff != nil {
+		log.Println("Differences:")
+		r.RootDiff.PrintDifferences()
+	}
+	r.AInB.print(fmt.Sprintf("files of %q in %q", r.NameA, r.NameB), listFiles)
+	r.BInA.print(fmt.Sprintf("files of %q in %q", r.NameB, r.NameA), listFiles)
+}
+
+func (c *Coverage) print(title string, listFiles bool) {
+	log.Println(title + ":")
+	if listFiles {
+		for _, f := range c.MovedFiles {
+			log.Println(color.YellowString("moved file: %q to %q", f.Path, f.OtherPath))
+		}
+		for _, f := range c.AbsentFiles {
+			log.Println(color.RedString("absent file: %q", f.Path))
+		}
+	}
+	log.Printf("%d files (%s) at the same path", c.SamePath.Files, formatBytes(c.SamePath.Bytes))
+	log.Printf("%d files (%s) moved", c.Moved.Files, formatBytes(c.Moved.Bytes))
+	summary := fmt.Sprintf("%d files (%s) absent", c.Absent.Files, formatBytes(c.Absent.Bytes))
+	if c.Complete() {
+		log.Println(color.GreenString(summary))
+	} else {
+		log.Println(color.RedString(summary))
+	}
+}
+
 func printStoredSeal(seal *StoredSeal) {
 	fmt.Printf("seal for %q is a ", seal.Path)
 	if seal.Dir != nil {
@@ -87,7 +602,3 @@ func printDirSeal(seal *DirSeal) {
 		fmt.Printf("    %#v\n", file)
 	}
 }
-
-func compareDirsWithIndex(dirs []Dir, index *LoadedIndex) error {
-	return nil
-}
@@ -0,0 +1,89 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func indexTestDir(t *testing.T, indexFile string, storageType StorageType) {
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	dirs, err := indexDirectories(TestDir, true, nil)
+	require.NoError(t, err)
+	require.NoError(t, DirsToIndex(indexFile, dirs, TestDir, storageType, nil))
+	if storageType == StorageTypeMemory {
+		t.Cleanup(func() { DropMemoryIndex(indexFile) })
+	}
+}
+
+func TestCompareIndices(t *testing.T) {
+	SetupTestDir(t)
+	tmp := t.TempDir()
+	indexA := filepath.Join(tmp, "a.db")
+	indexB := filepath.Join(tmp, "b.db")
+	indexTestDir(t, indexA, StorageTypeSQLite)
+
+	require.NoError(t, os.Rename(TestDir+"/a.txt", TestDir+"/sub/a.txt"))
+	require.NoError(t, os.Remove(TestDir+"/sub/d.txt"))
+	randomFile(t, TestDir+"/b.txt", 5) // new file
+	indexTestDir(t, indexB, StorageTypeSQLite)
+
+	report, err := CompareIndices(indexA, indexB)
+	require.NoError(t, err)
+	require.NotNil(t, report.RootDiff)
+	assert.False(t, report.RootDiff.Identical)
+
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2656}, report.AInB.SamePath)
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2656}, report.AInB.Moved)
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2656}, report.AInB.Absent)
+	assert.Equal(t, []CoverageFile{{Path: "a.txt", Size: 2656, OtherPath: "sub/a.txt"}}, report.AInB.MovedFiles)
+	assert.Equal(t, []CoverageFile{{Path: "sub/d.txt", Size: 2656}}, report.AInB.AbsentFiles)
+	assert.False(t, report.AInB.Complete())
+
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2656}, report.BInA.SamePath)
+	assert.Equal(t, []CoverageFile{{Path: "sub/a.txt", Size: 2656, OtherPath: "a.txt"}}, report.BInA.MovedFiles)
+	assert.Equal(t, []CoverageFile{{Path: "b.txt", Size: 2656}}, report.BInA.AbsentFiles)
+}
+
+func TestCompareTreeWithIndex(t *testing.T) {
+	SetupTestDir(t)
+	indexFile := filepath.Join(t.TempDir(), "index")
+	indexTestDir(t, indexFile, StorageTypeMemory)
+
+	require.NoError(t, os.Rename(TestDir+"/a.txt", TestDir+"/sub/a.txt"))
+	index := CompareSource{Path: indexFile, Type: string(StorageTypeMemory)}
+
+	for _, sourceType := range []string{SourceScan, SourceQuickScan} {
+		tree := CompareSource{Path: TestDir, Type: sourceType}
+		report, err := Compare(tree, index, CompareOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, CoverageCount{Files: 2, Bytes: 5312}, report.AInB.SamePath, sourceType)
+		if sourceType == SourceScan {
+			assert.Equal(t, []CoverageFile{{Path: "sub/a.txt", Size: 2656, OtherPath: "a.txt"}}, report.AInB.MovedFiles)
+			assert.Equal(t, []CoverageFile{{Path: "a.txt", Size: 2656, OtherPath: "sub/a.txt"}}, report.BInA.MovedFiles)
+		} else {
+			// without hashes moved files can't be found
+			assert.Equal(t, []CoverageFile{{Path: "sub/a.txt", Size: 2656}}, report.AInB.AbsentFiles)
+			assert.Equal(t, []CoverageFile{{Path: "a.txt", Size: 2656}}, report.BInA.AbsentFiles)
+		}
+	}
+
+	// scanning doesn't write seal files
+	seal, err := loadSeal(TestDir + "/sub")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(seal.Files))
+
+	_, err = SealPath(TestDir, nil)
+	require.NoError(t, err)
+	tree := CompareSource{Path: TestDir}
+	assert.Equal(t, SourceSeals, tree.sourceType())
+	report, err := Compare(tree, index, CompareOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, CoverageCount{Files: 2, Bytes: 5312}, report.AInB.SamePath)
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2656}, report.AInB.Moved)
+}
@@ -0,0 +1,176 @@
+package seal
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func indexConvertCmd() *cobra.Command {
+	var from, to, format string
+	var entries, encrypt bool
+	cmd := &cobra.Command{
+		Use:   "convert",
+		Short: "copies all seals of an index into a new index",
+		Long: `Copies all seals of an index into a new index of another storage type
+or record format, and validates afterwards that both indices contain
+the same paths and hashes.
+
+Indices are given as TYPE:PATH, like sqlite:a.db or pebble:b/. Without
+a type, the type of the source is detected and the target is SQLite.
+With --encrypt the new index is encrypted, converting an encrypted
+index without it writes a plain copy.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" || to == "" {
+				return errors.New("need --from and --to indices to convert")
+			}
+			fromType, fromPath := parseIndexLocation(from)
+			toType, toPath := parseIndexLocation(to)
+			start := time.Now()
+			count, err := ConvertIndex(fromType, fromPath, toType, toPath,
+				&IndexOptions{Format: RecordFormat(format), Entries: entries, Encrypt: encrypt})
+			if err != nil {
+				return err
+			}
+			log.Println("converted", count, "seals in", time.Since(start))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "index to read from, as TYPE:PATH")
+	cmd.Flags().StringVar(&to, "to", "", "index to write to, as TYPE:PATH")
+	cmd.Flags().StringVar(&format, "format", "", "record format of the new index: json or binary")
+	cmd.Flags().BoolVar(&entries, "entries", false, "write the entries table of a new SQLite index for SQL queries")
+	cmd.Flags().BoolVar(&encrypt, "encrypt", false, "encrypt the new index with the passphrase from --key-file or SEAL_PASSPHRASE")
+	return cmd
+}
+
+// parseIndexLocation splits a TYPE:PATH argument. Arguments
+// that don't start with a known storage type are only a path.
+func parseIndexLocation(location string) (StorageType, string) {
+	i := strings.Index(location, ":")
+	if i < 0 {
+		return StorageTypeAuto, location
+	}
+	switch t := StorageType(location[:i]); t {
+	case StorageTypeSQLite, StorageTypeBoltDB, StorageTypePebble, StorageTypeMemory:
+		return t, location[i+1:]
+	}
+	return StorageTypeAuto, location
+}
+
+// ConvertIndex streams all seals from one index into a new index and
+// then checks that both contain the same number of seals with the
+// same paths and hashes. It returns the number of converted seals.
+func ConvertIndex(fromType StorageType, fromPath string, toType StorageType, toPath string, opts *IndexOptions) (int, error) {
+	source, err := openStorage(fromType, fromPath, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "open source")
+	}
+	defer source.Close()
+
+	if toType == StorageTypeAuto {
+		toType = StorageTypeSQLite
+	}
+	target, err := openStorage(toType, toPath, opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "open target")
+	}
+	defer target.Close()
+
+	existing, err := target.LoadAfterHash(nil, 1)
+	if err != nil {
+		return 0, errors.Wrap(err, "LoadAfterHash")
+	}
+	if len(existing) > 0 {
+		return 0, errors.Errorf("target index %q is not empty", toPath)
+	}
+
+	count := 0
+	batch := make([]*StoredSeal, 0, loadFromIndex)
+	it := IterateByHash(source)
+	for it.Next() {
+		s := it.Seal()
+		batch = append(batch, &s)
+		if len(batch) < cap(batch) {
+			continue
+		}
+		err = target.AddSeals(batch)
+		if err != nil {
+			return count, errors.Wrap(err, "AddSeals")
+		}
+		count += len(batch)
+		batch = batch[:0]
+	}
+	if it.Err() != nil {
+		return count, errors.Wrap(it.Err(), "read source")
+	}
+	err = target.AddSeals(batch)
+	if err != nil {
+		return count, errors.Wrap(err, "AddSeals")
+	}
+	count += len(batch)
+
+	// both roots only match if all seals were copied unchanged
+	sourceRoot, err := source.GetMeta(merkleRootMetaKey)
+	if err != nil {
+		return count, errors.Wrap(err, "GetMeta")
+	}
+	var targetRoot []byte
+	if len(sourceRoot) > 0 {
+		targetRoot, err = merkleRoot(target)
+		if err != nil {
+			return count, errors.Wrap(err, "merkleRoot")
+		}
+		if !bytes.Equal(sourceRoot, targetRoot) {
+			return count, errors.New("Merkle root of the converted index doesn't match")
+		}
+	}
+	err = target.SetMeta(merkleRootMetaKey, targetRoot)
+	if err != nil {
+		return count, errors.Wrap(err, "SetMeta")
+	}
+	flusher, ok := target.(interface{ Flush() error })
+	if ok {
+		err = flusher.Flush()
+		if err != nil {
+			return count, errors.Wrap(err, "Flush")
+		}
+	}
+
+	err = compareIndexRecords(source, target)
+	if err != nil {
+		return count, errors.Wrap(err, "validate")
+	}
+	return count, nil
+}
+
+// compareIndexRecords checks that both indices contain the same
+// seals, by iterating over both of them in hash order.
+func compareIndexRecords(a, b IndexStorage) error {
+	itA, itB := IterateByHash(a), IterateByHash(b)
+	count := 0
+	for {
+		nextA, nextB := itA.Next(), itB.Next()
+		if !nextA || !nextB {
+			if itA.Err() != nil {
+				return errors.Wrap(itA.Err(), "read source")
+			}
+			if itB.Err() != nil {
+				return errors.Wrap(itB.Err(), "read target")
+			}
+			if nextA != nextB {
+				return errors.Errorf("record counts differ after %d seals", count)
+			}
+			return nil
+		}
+		sA, sB := itA.Seal(), itB.Seal()
+		if sA.Path != sB.Path || !bytes.Equal(sA.hash(), sB.hash()) {
+			return errors.Errorf("seal %d differs: %q in source, %q in target", count, sA.Path, sB.Path)
+		}
+		count++
+	}
+}
@@ -0,0 +1,46 @@
+package seal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertIndex(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from.db")
+	require.NoError(t, DirsToIndex(from, testIndexDirs(), "base", StorageTypeSQLite, nil))
+
+	to := filepath.Join(dir, "to")
+	opts := &IndexOptions{Format: FormatBinary}
+	count, err := ConvertIndex(StorageTypeAuto, from, StorageTypePebble, to, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	detected, err := DetectStorageType(to)
+	require.NoError(t, err)
+	assert.Equal(t, StorageTypePebble, detected)
+
+	_, err = ConvertIndex(StorageTypeSQLite, from, StorageTypePebble, to, opts)
+	assert.Error(t, err, "target is not empty")
+
+	storage, err := openStorage(StorageTypeBoltDB, filepath.Join(dir, "other.bolt"), nil)
+	require.NoError(t, err)
+	defer storage.Close()
+	source, err := openStorage(StorageTypePebble, to, nil)
+	require.NoError(t, err)
+	defer source.Close()
+	assert.Error(t, compareIndexRecords(source, storage))
+}
+
+func TestParseIndexLocation(t *testing.T) {
+	storageType, path := parseIndexLocation("pebble:b/")
+	assert.Equal(t, StorageTypePebble, storageType)
+	assert.Equal(t, "b/", path)
+
+	storageType, path = parseIndexLocation("c:/index.db")
+	assert.Equal(t, StorageTypeAuto, storageType)
+	assert.Equal(t, "c:/index.db", path)
+}
@@ -24,6 +24,10 @@ type Diff struct {
 	FilesAdded   []*FileSeal
 	FilesMissing []*FileSeal
 	FilesChanged []*FileDiff
+
+	// SignatureError is set if the wanted seal has to be signed,
+	// but its signature is missing or invalid.
+	SignatureError error
 }
 
 // FileDiff holds the differences between two FileSeals.
@@ -133,6 +137,9 @@ func (d *Diff) PrintDifferences() {
 	if d.Identical {
 		return
 	}
+	if d.SignatureError != nil {
+		log.Println(color.RedString("signature of %q: %v", d.Want.Name, d.SignatureError))
+	}
 	var meta string
 	if !d.NameMatches {
 		meta += fmt.Sprintf("Name is:%q want:%q", d.Have.Name, d.Want.Name)
@@ -0,0 +1,403 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func dupesCmd() *cobra.Command {
+	var (
+		jsonOutput bool
+		planFile   string
+		planAction string
+		planFormat string
+	)
+	cmd := &cobra.Command{
+		Use:   "dupes [PATH...]",
+		Short: "finds duplicate files and directories",
+		Long: `Finds groups of identical files and directory trees, either in the
+seal files of the given paths or in the index file passed with --file.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if planAction != "hardlink" && planAction != "delete" {
+				return errors.Errorf("unknown plan action %q", planAction)
+			}
+
+			var report *DupesReport
+			var err error
+			if len(args) > 0 {
+				report, err = DupesFromPaths(args, PathPrefixes)
+			} else if IndexFile != "" {
+				report, err = DupesFromIndex(IndexFile, StorageType(IndexStorageType))
+			} else {
+				return errors.New("need a path argument or an index file to find duplicates")
+			}
+			if err != nil {
+				return err
+			}
+
+			if planFile != "" {
+				plan := report.Plan(planAction)
+				if len(args) > 0 {
+					err = absolutePlan(plan)
+					if err != nil {
+						return errors.Wrap(err, "absolutePlan")
+					}
+				}
+				err = WritePlanFile(planFile, plan, planFormat)
+				if err != nil {
+					return errors.Wrap(err, "WritePlanFile")
+				}
+			}
+
+			if jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "\t")
+				return enc.Encode(report)
+			}
+			report.Print(os.Stdout)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the report as JSON")
+	cmd.Flags().StringVar(&planFile, "plan", "", "write a plan that removes the duplicates to this file")
+	cmd.Flags().StringVar(&planAction, "plan-action", "hardlink", "how duplicates are removed by the plan: hardlink or delete")
+	cmd.Flags().StringVar(&planFormat, "plan-format", PlanFormatShell, "format of the plan: shell or json")
+	return cmd
+}
+
+// DupeGroup is a group of identical files or directory trees.
+// Reclaimable is the number of bytes that all but one of the
+// copies take up, without the copies inside of directories that
+// are reclaimed by another group.
+type DupeGroup struct {
+	IsDir       bool `json:",omitempty"`
+	SHA256      []byte
+	Size        int64
+	Reclaimable int64
+	Paths       []string
+
+	// paths that aren't inside of directories deleted by the plan
+	live []string
+}
+
+// DupesReport holds all duplicates sorted by reclaimable bytes.
+// Groups that only consist of paths inside of duplicate directories
+// are left out, because they are covered by the directory group.
+// TotalReclaimable only counts copies that aren't inside of
+// directories that are already reclaimed by another group.
+type DupesReport struct {
+	TotalReclaimable int64
+	Groups           []*DupeGroup
+
+	// all groups, including the ones inside of duplicate directories
+	all []*DupeGroup
+}
+
+// DupesFromIndex finds all duplicates in an index.
+func DupesFromIndex(indexPath string, t StorageType) (*DupesReport, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+
+	finder := &dupeFinder{}
+	it := IterateByHash(storage)
+	for it.Next() {
+		finder.add(it.Seal())
+	}
+	if it.Err() != nil {
+		return nil, errors.Wrap(it.Err(), "IterateByHash")
+	}
+	return finder.report(), nil
+}
+
+// DupesFromPaths finds all duplicates in the seal files of the given paths.
+func DupesFromPaths(paths []string, prefixes []string) (*DupesReport, error) {
+	var all []StoredSeal
+	for _, basePath := range paths {
+		loadSeals := true
+		dirs, err := indexDirectories(basePath, loadSeals, prefixes)
+		if err != nil {
+			return nil, errors.Wrap(err, "indexDirectories")
+		}
+		for i := range dirs {
+			stored, err := storedSeals(&dirs[i], basePath)
+			if err != nil {
+				return nil, errors.Wrap(err, "storedSeals")
+			}
+			for _, s := range stored {
+				s.Path = filepath.Join(basePath, s.Path)
+				all = append(all, *s)
+			}
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		c := bytes.Compare(all[i].hash(), all[j].hash())
+		if c != 0 {
+			return c < 0
+		}
+		return all[i].Path < all[j].Path
+	})
+
+	finder := &dupeFinder{}
+	for _, s := range all {
+		finder.add(s)
+	}
+	return finder.report(), nil
+}
+
+// dupeFinder groups seals that are added in hash order.
+type dupeFinder struct {
+	current []StoredSeal
+	groups  []*DupeGroup
+}
+
+func (f *dupeFinder) add(s StoredSeal) {
+	if len(f.current) > 0 && !bytes.Equal(f.current[0].hash(), s.hash()) {
+		f.flush()
+	}
+	f.current = append(f.current, s)
+}
+
+// flush turns the seals with the current hash into groups,
+// one for files and one for directories.
+func (f *dupeFinder) flush() {
+	files := &DupeGroup{}
+	dirs := &DupeGroup{IsDir: true}
+	for _, s := range f.current {
+		if s.Dir != nil {
+			dirs.SHA256 = s.Dir.SHA256
+			dirs.Size = s.Dir.TotalSize
+			dirs.Paths = append(dirs.Paths, s.Path)
+		} else if s.File.exists() {
+			files.SHA256 = s.File.SHA256
+			files.Size = s.File.Size
+			files.Paths = append(files.Paths, s.Path)
+		}
+	}
+	for _, g := range []*DupeGroup{files, dirs} {
+		if len(g.Paths) < 2 || g.Size == 0 {
+			continue
+		}
+		sort.Strings(g.Paths)
+		g.Reclaimable = g.Size * int64(len(g.Paths)-1)
+		f.groups = append(f.groups, g)
+	}
+	f.current = f.current[:0]
+}
+
+func (f *dupeFinder) report() *DupesReport {
+	f.flush()
+
+	dupeDirs := map[string]bool{}
+	for _, g := range f.groups {
+		if g.IsDir {
+			for _, p := range g.Paths {
+				dupeDirs[p] = true
+			}
+		}
+	}
+
+	report := &DupesReport{all: f.groups}
+	for _, g := range f.groups {
+		covered := true
+		for _, p := range g.Paths {
+			if !insideDirs(p, dupeDirs) {
+				covered = false
+				break
+			}
+		}
+		if !covered {
+			report.Groups = append(report.Groups, g)
+		}
+	}
+
+	// Directories are visited from the largest down, so that parents
+	// are removed before the groups of their subdirectories are seen.
+	var dirGroups []*DupeGroup
+	for _, g := range report.Groups {
+		if g.IsDir {
+			dirGroups = append(dirGroups, g)
+		}
+	}
+	sort.SliceStable(dirGroups, func(i, j int) bool {
+		if dirGroups[i].Size != dirGroups[j].Size {
+			return dirGroups[i].Size > dirGroups[j].Size
+		}
+		return len(dirGroups[i].Paths[0]) < len(dirGroups[j].Paths[0])
+	})
+	removed := map[string]bool{}
+	for _, g := range dirGroups {
+		for _, p := range livePaths(g.Paths, removed)[1:] {
+			removed[p] = true
+		}
+	}
+	for _, g := range report.Groups {
+		g.live = livePaths(g.Paths, removed)
+		g.Reclaimable = g.Size * int64(len(g.live)-1)
+		report.TotalReclaimable += g.Reclaimable
+	}
+
+	sort.SliceStable(report.Groups, func(i, j int) bool {
+		return report.Groups[i].Reclaimable > report.Groups[j].Reclaimable
+	})
+	return report
+}
+
+// livePaths returns the paths that aren't inside of the removed
+// directories. Groups that are reported have at least one.
+func livePaths(paths []string, removed map[string]bool) []string {
+	var live []string
+	for _, p := range paths {
+		if !insideDirs(p, removed) {
+			live = append(live, p)
+		}
+	}
+	return live
+}
+
+// insideDirs reports if any parent directory of path is in dirs.
+func insideDirs(path string, dirs map[string]bool) bool {
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		if dirs[parent] {
+			return true
+		}
+		path = parent
+	}
+}
+
+// Print writes the report in a human readable format.
+func (r *DupesReport) Print(w io.Writer) {
+	for _, g := range r.Groups {
+		thing := "files"
+		if g.IsDir {
+			thing = "dirs"
+		}
+		fmt.Fprintf(w, "%d identical %s of %s, %s reclaimable\n",
+			len(g.Paths), thing, formatBytes(g.Size), formatBytes(g.Reclaimable))
+		for _, p := range g.Paths {
+			fmt.Fprintf(w, "    %s\n", p)
+		}
+	}
+	fmt.Fprintf(w, "%d groups of duplicates, %s reclaimable in total\n",
+		len(r.Groups), formatBytes(r.TotalReclaimable))
+}
+
+// Plan creates a plan that keeps the first path of every group and
+// hardlinks or deletes all other paths. Directories can't be
+// hardlinked, so the hardlink plan links all files of duplicate
+// directories instead. The delete plan skips paths inside of deleted
+// directories, and keeps the first path outside of them.
+func (r *DupesReport) Plan(action string) *Plan {
+	plan := &Plan{}
+	groups := r.Groups
+	if action == "hardlink" {
+		groups = r.all
+	}
+	for _, g := range groups {
+		paths := g.Paths
+		if action != "hardlink" && g.live != nil {
+			paths = g.live
+		}
+		keep := paths[0]
+		for _, p := range paths[1:] {
+			step := PlanStep{
+				Action: PlanDelete,
+				Path:   p,
+				IsDir:  g.IsDir,
+				Size:   g.Size,
+				SHA256: g.SHA256,
+			}
+			if action == "hardlink" {
+				if g.IsDir {
+					continue
+				}
+				step.Action = PlanLink
+				step.Source = keep
+			}
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+	return plan
+}
+
+// absolutePlan roots a plan with paths that are relative to the
+// working directory in the deepest directory that holds all of them.
+func absolutePlan(plan *Plan) error {
+	var root string
+	for i, step := range plan.Steps {
+		for _, p := range []*string{&plan.Steps[i].Path, &plan.Steps[i].Source} {
+			if p == &plan.Steps[i].Source && step.Source == "" {
+				continue
+			}
+			abs, err := filepath.Abs(*p)
+			if err != nil {
+				return errors.Wrap(err, "Abs")
+			}
+			*p = abs
+			if root == "" {
+				root = filepath.Dir(abs)
+			}
+			for !pathInDir(abs, root) {
+				if filepath.Dir(root) == root {
+					return errors.Errorf("%q and %q have no common directory", abs, root)
+				}
+				root = filepath.Dir(root)
+			}
+		}
+	}
+	for i, step := range plan.Steps {
+		for _, p := range []*string{&plan.Steps[i].Path, &plan.Steps[i].Source} {
+			if p == &plan.Steps[i].Source && step.Source == "" {
+				continue
+			}
+			rel, err := filepath.Rel(root, *p)
+			if err != nil {
+				return errors.Wrap(err, "Rel")
+			}
+			*p = filepath.ToSlash(rel)
+		}
+	}
+	plan.TargetRoot = root
+	return nil
+}
+
+// pathInDir reports if the absolute path is below dir.
+func pathInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// shellQuote quotes a string to be used as a single shell argument.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
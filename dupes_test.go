@@ -0,0 +1,89 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDupesTestDir(t *testing.T) {
+	SetupTestDir(t)
+	require.NoError(t, os.MkdirAll(TestDir+"/sub2", 0755))
+	randomFile(t, TestDir+"/e.txt", 1)      // duplicate of a.txt
+	randomFile(t, TestDir+"/sub2/c.txt", 2) // sub2 is identical to sub
+	randomFile(t, TestDir+"/sub2/d.txt", 3)
+
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+}
+
+func TestDupesFromPaths(t *testing.T) {
+	setupDupesTestDir(t)
+
+	report, err := DupesFromPaths([]string{TestDir}, nil)
+	require.NoError(t, err)
+	checkDupesReport(t, report, "testdir")
+}
+
+func TestDupesFromIndex(t *testing.T) {
+	setupDupesTestDir(t)
+
+	dirs, err := indexDirectories(TestDir, true, nil)
+	require.NoError(t, err)
+	indexFile := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, DirsToIndex(indexFile, dirs, TestDir, StorageTypeMemory, nil))
+	defer DropMemoryIndex(indexFile)
+
+	report, err := DupesFromIndex(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	checkDupesReport(t, report, ".")
+}
+
+func checkDupesReport(t *testing.T, report *DupesReport, base string) {
+	require.Equal(t, 2, len(report.Groups))
+	assert.Equal(t, int64(7968), report.TotalReclaimable)
+
+	assert.True(t, report.Groups[0].IsDir)
+	assert.Equal(t, int64(5312), report.Groups[0].Reclaimable)
+	assert.Equal(t, []string{filepath.Join(base, "sub"), filepath.Join(base, "sub2")}, report.Groups[0].Paths)
+
+	assert.False(t, report.Groups[1].IsDir)
+	assert.Equal(t, int64(2656), report.Groups[1].Reclaimable)
+	assert.Equal(t, []string{filepath.Join(base, "a.txt"), filepath.Join(base, "e.txt")}, report.Groups[1].Paths)
+	assert.Equal(t, 4, len(report.all))
+}
+
+func TestDupesInsideDirs(t *testing.T) {
+	setupDupesTestDir(t)
+	randomFile(t, TestDir+"/x.txt", 2) // also in sub and sub2
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+
+	report, err := DupesFromPaths([]string{TestDir}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(report.Groups))
+	var files *DupeGroup
+	for _, g := range report.Groups {
+		if len(g.Paths) == 3 {
+			files = g
+		}
+	}
+	require.NotNil(t, files)
+	assert.Equal(t, files.Size, files.Reclaimable)
+	// the copy in sub2 is reclaimed with its directory
+	assert.Equal(t, int64(7968)+files.Size, report.TotalReclaimable)
+	var sum int64
+	for _, g := range report.Groups {
+		sum += g.Reclaimable
+	}
+	assert.Equal(t, report.TotalReclaimable, sum)
+
+	var deleted []string
+	for _, step := range report.Plan("delete").Steps {
+		deleted = append(deleted, step.Path)
+	}
+	assert.ElementsMatch(t, []string{"testdir/sub2", "testdir/e.txt", "testdir/x.txt"}, deleted)
+}
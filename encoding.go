@@ -0,0 +1,377 @@
+package seal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RecordFormat is the encoding of the StoredSeals in an index.
+type RecordFormat string
+
+const (
+	// FormatJSON stores seals as JSON objects.
+	FormatJSON RecordFormat = "json"
+	// FormatBinary stores seals in a compact varint based layout
+	// with raw hashes and without field names.
+	FormatBinary RecordFormat = "binary"
+)
+
+// The first byte of every record tells its format. JSON records
+// always start with an opening brace, which also keeps records
+// of indices written before formats existed readable.
+//
+// New records are wrapped in a checksum envelope, which holds a
+// CRC-32C of the wrapped JSON or binary record in 4 big endian bytes.
+const (
+	jsonTag     byte = '{'
+	binaryTag   byte = 0x01
+	checksumTag byte = 0x02
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const formatMetaKey = "format"
+
+// IndexOptions configure how an index is opened. Nil options
+// use the defaults.
+type IndexOptions struct {
+	// Format is used to write new records. It is stored in the
+	// index when it is created, and can't be changed afterwards.
+	// Existing indices keep their format if this is empty.
+	Format RecordFormat
+	// Entries also stores all seals in the entries table with one
+	// column per field, so that the index can be queried with SQL.
+	// Once enabled, the index keeps the table up to date. Only
+	// SQLite indices support this.
+	Entries bool
+	// Volume names the drive or directory that the index
+	// describes, it is stored in the index if it is set.
+	Volume string
+	// Encrypt encrypts a new index with the passphrase. Records and
+	// metadata are encrypted with AES-GCM, paths in keys are replaced
+	// by their HMAC. Existing indices keep their encryption.
+	Encrypt bool
+	// Passphrase is used to encrypt a new index and to open an
+	// encrypted index, IndexPassphrase is used if it is empty.
+	Passphrase []byte
+	// OnEvent receives progress events while directories are
+	// added to the index, if it is set.
+	OnEvent EventHandler
+	// Memory holds the indices of StorageTypeMemory. If it is
+	// nil, memory indices are shared by the whole process.
+	Memory *MemoryStore
+}
+
+// metaStorage stores metadata about an index next to its seals.
+type metaStorage interface {
+	GetMeta(key string) ([]byte, error)
+	SetMeta(key string, value []byte) error
+}
+
+// setupFormat returns the format of an index, storing the
+// format from the options if the index has none yet.
+func setupFormat(m metaStorage, opts *IndexOptions) (RecordFormat, error) {
+	var want RecordFormat
+	if opts != nil {
+		want = opts.Format
+	}
+	switch want {
+	case "", FormatJSON, FormatBinary:
+	default:
+		return "", errors.Errorf("unknown record format %q", want)
+	}
+
+	stored, err := m.GetMeta(formatMetaKey)
+	if err != nil {
+		return "", errors.Wrap(err, "GetMeta")
+	}
+	if len(stored) > 0 {
+		if want != "" && want != RecordFormat(stored) {
+			return "", errors.Errorf("index uses format %q, not %q", stored, want)
+		}
+		return RecordFormat(stored), nil
+	}
+
+	if want == "" {
+		want = FormatJSON
+	}
+	err = m.SetMeta(formatMetaKey, []byte(want))
+	return want, errors.Wrap(err, "SetMeta")
+}
+
+// encodeSeal encodes a seal as a record in the given format,
+// wrapped in a checksum envelope.
+func encodeSeal(format RecordFormat, s *StoredSeal) ([]byte, error) {
+	record, err := encodeRecord(format, s)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 5, 5+len(record))
+	buf[0] = checksumTag
+	binary.BigEndian.PutUint32(buf[1:5], crc32.Checksum(record, crcTable))
+	return append(buf, record...), nil
+}
+
+// encodeRecord encodes a seal without checksum envelope.
+func encodeRecord(format RecordFormat, s *StoredSeal) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		buf, err := json.Marshal(s)
+		return buf, errors.Wrap(err, "json.Marshal")
+	case FormatBinary:
+		w := &binaryWriter{buf: []byte{binaryTag}}
+		w.string(s.Path)
+		if s.Dir != nil && s.Dir.Signature != nil {
+			w.buf = append(w.buf, 2)
+			w.dirSeal(s.Dir)
+			w.string(s.Dir.Signature.KeyID)
+			w.bytes(s.Dir.Signature.Signature)
+		} else if s.Dir != nil {
+			w.buf = append(w.buf, 0)
+			w.dirSeal(s.Dir)
+		} else {
+			w.buf = append(w.buf, 1)
+			w.fileSeal(s.File)
+		}
+		return w.buf, nil
+	default:
+		return nil, errors.Errorf("unknown record format %q", format)
+	}
+}
+
+// decodeSeal decodes a record of any format, and checks
+// the checksum of records in a checksum envelope.
+func decodeSeal(buf []byte) (StoredSeal, error) {
+	if len(buf) > 0 && buf[0] == checksumTag {
+		if len(buf) < 5 {
+			return StoredSeal{}, errors.New("short checksum envelope")
+		}
+		record := buf[5:]
+		if crc32.Checksum(record, crcTable) != binary.BigEndian.Uint32(buf[1:5]) {
+			return StoredSeal{}, errors.New("record checksum mismatch")
+		}
+		if len(record) > 0 && record[0] == checksumTag {
+			return StoredSeal{}, errors.New("nested checksum envelope")
+		}
+		buf = record
+	}
+	var s StoredSeal
+	if len(buf) == 0 {
+		return s, errors.New("empty record")
+	}
+	switch buf[0] {
+	case jsonTag:
+		err := json.Unmarshal(buf, &s)
+		return s, errors.Wrap(err, "json.Unmarshal")
+	case binaryTag:
+		r := &binaryReader{buf: buf[1:]}
+		s.Path = r.string()
+		switch r.byte() {
+		case 0:
+			s.Dir = r.dirSeal()
+		case 1:
+			s.File = r.fileSeal()
+		case 2:
+			// a signed directory seal
+			s.Dir = r.dirSeal()
+			s.Dir.Signature = &SealSignature{KeyID: r.string(), Signature: r.bytes()}
+		default:
+			r.fail(errors.New("unknown seal kind"))
+		}
+		if r.err == nil && len(r.buf) > 0 {
+			r.fail(errors.New("trailing bytes"))
+		}
+		return s, errors.Wrap(r.err, "decode binary")
+	case encryptedTag:
+		return s, errors.New("encrypted record, need a passphrase")
+	default:
+		return s, errors.Errorf("unknown record tag %#x", buf[0])
+	}
+}
+
+const (
+	flagOldVersion byte = 1 << iota
+	flagDeleted
+	flagIsDir
+)
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *binaryWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) time(t time.Time) {
+	w.varint(t.Unix())
+	w.uvarint(uint64(t.Nanosecond()))
+}
+
+func (w *binaryWriter) dirSeal(d *DirSeal) {
+	w.string(d.Name)
+	w.varint(d.TotalSize)
+	w.bytes(d.SHA256)
+	w.time(d.Modified)
+	w.time(d.Sealed)
+	w.uvarint(uint64(len(d.Files)))
+	for _, f := range d.Files {
+		w.fileSeal(f)
+	}
+}
+
+func (w *binaryWriter) fileSeal(f *FileSeal) {
+	var flags byte
+	if f.OldVersion {
+		flags |= flagOldVersion
+	}
+	if f.Deleted {
+		flags |= flagDeleted
+	}
+	if f.IsDir {
+		flags |= flagIsDir
+	}
+	w.buf = append(w.buf, flags)
+	w.string(f.Name)
+	w.varint(f.Size)
+	w.bytes(f.SHA256)
+	w.time(f.Modified)
+	w.time(f.Sealed)
+}
+
+// binaryReader reads values until the first error,
+// after which it only returns zero values.
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.buf = nil
+}
+
+func (r *binaryReader) byte() byte {
+	if len(r.buf) == 0 {
+		r.fail(errors.New("unexpected end of record"))
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("invalid uvarint"))
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if uint64(len(r.buf)) < n {
+		r.fail(errors.New("unexpected end of record"))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if uint64(len(r.buf)) < n {
+		r.fail(errors.New("unexpected end of record"))
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *binaryReader) time() time.Time {
+	sec := r.varint()
+	nsec := r.uvarint()
+	if sec == zeroTimeUnix && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+// zeroTimeUnix is the Unix time of the zero time.Time.
+var zeroTimeUnix = time.Time{}.Unix()
+
+func (r *binaryReader) dirSeal() *DirSeal {
+	d := &DirSeal{
+		Name:      r.string(),
+		TotalSize: r.varint(),
+		SHA256:    r.bytes(),
+		Modified:  r.time(),
+		Sealed:    r.time(),
+	}
+	count := r.uvarint()
+	if count > uint64(len(r.buf)) {
+		r.fail(errors.New("invalid file count"))
+		return d
+	}
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		d.Files = append(d.Files, r.fileSeal())
+	}
+	return d
+}
+
+func (r *binaryReader) fileSeal() *FileSeal {
+	flags := r.byte()
+	return &FileSeal{
+		OldVersion: flags&flagOldVersion != 0,
+		Deleted:    flags&flagDeleted != 0,
+		IsDir:      flags&flagIsDir != 0,
+		Name:       r.string(),
+		Size:       r.varint(),
+		SHA256:     r.bytes(),
+		Modified:   r.time(),
+		Sealed:     r.time(),
+	}
+}
@@ -0,0 +1,70 @@
+package seal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeSeal(t *testing.T) {
+	dirs := testIndexDirs()
+	dirs[0].Seal.TotalSize = 3
+	stored, err := storedSeals(&dirs[0], "base")
+	require.NoError(t, err)
+
+	for _, format := range []RecordFormat{FormatJSON, FormatBinary} {
+		for _, s := range stored {
+			buf, err := encodeSeal(format, s)
+			require.NoError(t, err)
+			decoded, err := decodeSeal(buf)
+			require.NoError(t, err)
+			if s.Dir != nil {
+				assert.Equal(t, s.Dir.Name, decoded.Dir.Name)
+				assert.Equal(t, s.Dir.TotalSize, decoded.Dir.TotalSize)
+				assert.Equal(t, s.Dir.SHA256, decoded.Dir.SHA256)
+				assert.True(t, s.Dir.Sealed.Equal(decoded.Dir.Sealed))
+				assert.True(t, decoded.Dir.Modified.IsZero())
+				assert.Equal(t, len(s.Dir.Files), len(decoded.Dir.Files))
+				continue
+			}
+			assert.Equal(t, s.Path, decoded.Path)
+			assert.Equal(t, s.File.Name, decoded.File.Name)
+			assert.Equal(t, s.File.IsDir, decoded.File.IsDir)
+			assert.Equal(t, s.File.Size, decoded.File.Size)
+			assert.Equal(t, s.File.SHA256, decoded.File.SHA256)
+			assert.True(t, s.File.Sealed.Equal(decoded.File.Sealed))
+		}
+	}
+
+	buf, err := encodeSeal(FormatBinary, stored[0])
+	require.NoError(t, err)
+	_, err = decodeSeal(buf[:len(buf)-1])
+	assert.Error(t, err, "truncated record")
+	buf[len(buf)-1]++
+	_, err = decodeSeal(buf)
+	assert.Error(t, err, "checksum mismatch")
+
+	// records without checksum envelope are still readable
+	record, err := encodeRecord(FormatJSON, stored[1])
+	require.NoError(t, err)
+	decoded, err := decodeSeal(record)
+	require.NoError(t, err)
+	assert.Equal(t, stored[1].Path, decoded.Path)
+}
+
+func TestIndexFormatIsStored(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index")
+	storage, err := OpenSqlite(indexPath, &IndexOptions{Format: FormatBinary})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	storage, err = OpenSqlite(indexPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, FormatBinary, storage.format)
+	require.NoError(t, storage.Close())
+
+	_, err = OpenSqlite(indexPath, &IndexOptions{Format: FormatJSON})
+	assert.Error(t, err)
+}
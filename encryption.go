@@ -0,0 +1,398 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// IndexPassphrase is used to open encrypted indices and to encrypt
+// new indices, if the IndexOptions don't have a passphrase.
+var IndexPassphrase []byte
+
+// The encryption header is the only metadata of an encrypted index
+// that is stored in plain text, it holds the parameters to derive
+// the keys from the passphrase.
+const encryptionMetaKey = "encryption"
+
+// Encrypted records and metadata values start with the encryptedTag,
+// followed by the nonce and the AES-GCM sealed checksum envelope.
+const encryptedTag byte = 0x03
+
+// encryptionHeader describes how the keys of an encrypted index are
+// derived from the passphrase. Check proves that a passphrase is
+// correct without decrypting any records.
+type encryptionHeader struct {
+	Cipher string
+	KDF    string
+	Salt   []byte
+	N      int
+	R      int
+	P      int
+	Check  []byte
+}
+
+// scryptParams are used for new encrypted indices. Tests lower N
+// to keep opening indices fast.
+var scryptParams = encryptionHeader{
+	Cipher: "aes-256-gcm",
+	KDF:    "scrypt",
+	N:      1 << 15,
+	R:      8,
+	P:      1,
+}
+
+// indexCipher encrypts the records and metadata of an index and hides
+// the paths in its keys. A nil indexCipher stores everything in plain
+// text, so backends can use it without checking for encryption.
+type indexCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+
+	// paths caches the sorted paths for loadAfterPath, added holds
+	// the paths written since they were sorted.
+	pathsMu sync.Mutex
+	paths   []pathRef
+	added   []pathRef
+}
+
+// MaxEncryptedPaths limits the number of seals of encrypted indices
+// that can be read by path, because all their paths are kept in
+// memory. Plain indices have no limit.
+var MaxEncryptedPaths = 1 << 21
+
+// setupCipher returns the cipher of an encrypted index, or nil for
+// plain indices. New indices are encrypted if the options ask for it,
+// existing plain indices can't be encrypted later.
+func setupCipher(m metaStorage, opts *IndexOptions) (*indexCipher, error) {
+	var passphrase []byte
+	encrypt := false
+	if opts != nil {
+		passphrase = opts.Passphrase
+		encrypt = opts.Encrypt
+	}
+
+	stored, err := m.GetMeta(encryptionMetaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMeta")
+	}
+	if len(stored) > 0 {
+		if len(passphrase) == 0 {
+			return nil, errors.New("index is encrypted, need a passphrase")
+		}
+		var header encryptionHeader
+		err = json.Unmarshal(stored, &header)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshal encryption header")
+		}
+		c, check, err := newIndexCipher(&header, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(check, header.Check) {
+			return nil, errors.New("wrong passphrase for encrypted index")
+		}
+		return c, nil
+	}
+	if !encrypt {
+		return nil, nil
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("need a passphrase to encrypt the index")
+	}
+	format, err := m.GetMeta(formatMetaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMeta")
+	}
+	if len(format) > 0 {
+		return nil, errors.New("only new indices can be encrypted, convert the index instead")
+	}
+	header := scryptParams
+	header.Salt = make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, header.Salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "read salt")
+	}
+	c, check, err := newIndexCipher(&header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	header.Check = check
+	buf, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal encryption header")
+	}
+	return c, errors.Wrap(m.SetMeta(encryptionMetaKey, buf), "SetMeta")
+}
+
+// newIndexCipher derives the encryption and MAC keys from the
+// passphrase, and returns the check value of the keys.
+func newIndexCipher(header *encryptionHeader, passphrase []byte) (*indexCipher, []byte, error) {
+	if header.Cipher != "aes-256-gcm" || header.KDF != "scrypt" {
+		return nil, nil, errors.Errorf("unsupported encryption %s with %s", header.Cipher, header.KDF)
+	}
+	keys, err := scrypt.Key(passphrase, header.Salt, header.N, header.R, header.P, 64)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "scrypt.Key")
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "aes.NewCipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cipher.NewGCM")
+	}
+	c := &indexCipher{aead: aead, macKey: keys[32:]}
+	return c, c.mac([]byte("seal index key check")), nil
+}
+
+func (c *indexCipher) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, c.macKey)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// keyPath returns the path that is used in the keys of the index.
+// Encrypted indices use the hex encoded HMAC of the path, which keeps
+// keys of the same path equal without revealing it. Hex never
+// contains the zero byte that separates path keys.
+func (c *indexCipher) keyPath(path string) string {
+	if c == nil {
+		return path
+	}
+	return hex.EncodeToString(c.mac([]byte(path)))
+}
+
+// seal encrypts a value, the additional data binds it to its use.
+func (c *indexCipher) seal(value, additional []byte) ([]byte, error) {
+	if c == nil {
+		return value, nil
+	}
+	size := c.aead.NonceSize()
+	buf := make([]byte, 1+size, 1+size+len(value)+c.aead.Overhead())
+	buf[0] = encryptedTag
+	_, err := io.ReadFull(rand.Reader, buf[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "read nonce")
+	}
+	return c.aead.Seal(buf, buf[1:], value, additional), nil
+}
+
+// open decrypts a value that was encrypted by seal.
+func (c *indexCipher) open(buf, additional []byte) ([]byte, error) {
+	if c == nil {
+		return buf, nil
+	}
+	if len(buf) == 0 || buf[0] != encryptedTag {
+		return nil, errors.New("plain value in encrypted index")
+	}
+	size := c.aead.NonceSize()
+	if len(buf) < 1+size {
+		return nil, errors.New("short encrypted value")
+	}
+	value, err := c.aead.Open(nil, buf[1:1+size], buf[1+size:], additional)
+	return value, errors.Wrap(err, "decrypt")
+}
+
+// encode encodes and encrypts a seal. The path of a seal encoded
+// for a write is added to the cached paths.
+func (c *indexCipher) encode(format RecordFormat, s *StoredSeal) ([]byte, error) {
+	buf, err := encodeSeal(format, s)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.pathsMu.Lock()
+		if c.paths != nil {
+			c.added = append(c.added, pathRef{Path: s.Path, Hash: s.hash()})
+		}
+		c.pathsMu.Unlock()
+	}
+	return c.seal(buf, nil)
+}
+
+// decode decrypts and decodes a record.
+func (c *indexCipher) decode(buf []byte) (StoredSeal, error) {
+	record, err := c.open(buf, nil)
+	if err != nil {
+		return StoredSeal{}, err
+	}
+	return decodeSeal(record)
+}
+
+// sealMeta encrypts a metadata value, except the encryption header.
+func (c *indexCipher) sealMeta(key string, value []byte) ([]byte, error) {
+	if key == encryptionMetaKey {
+		return value, nil
+	}
+	return c.seal(value, []byte(key))
+}
+
+// openMeta decrypts a metadata value stored by sealMeta.
+func (c *indexCipher) openMeta(key string, value []byte) ([]byte, error) {
+	if key == encryptionMetaKey || value == nil {
+		return value, nil
+	}
+	return c.open(value, []byte(key))
+}
+
+// sortByHash restores the order by hash and path of seals that were
+// loaded from an encrypted index, where seals with the same hash are
+// ordered by the HMAC of their path. Pages always hold all seals of
+// a hash, so sorting a page is enough.
+func (c *indexCipher) sortByHash(seals []StoredSeal) {
+	if c == nil {
+		return
+	}
+	sort.SliceStable(seals, func(i, j int) bool {
+		cmp := bytes.Compare(seals[i].hash(), seals[j].hash())
+		if cmp != 0 {
+			return cmp < 0
+		}
+		return seals[i].Path < seals[j].Path
+	})
+}
+
+// pathRef locates the record of a path in an encrypted index.
+type pathRef struct {
+	Path string
+	Hash []byte
+}
+
+// loadAfterPath implements LoadAfterPath for encrypted indices, which
+// have no keys ordered by path. The paths and hashes of all records
+// are read and sorted once, and paths written through the cipher are
+// merged into them before the next read. The records of a page are
+// then loaded by their hash. Unlike plain indices, the memory use
+// grows with the number of paths, up to MaxEncryptedPaths.
+func (c *indexCipher) loadAfterPath(storage IndexStorage, path string, count int) ([]StoredSeal, error) {
+	c.pathsMu.Lock()
+	defer c.pathsMu.Unlock()
+	if c.paths == nil {
+		paths := []pathRef{}
+		it := IterateByHash(storage)
+		for it.Next() {
+			if len(paths) == MaxEncryptedPaths {
+				return nil, errors.Errorf("encrypted index has more than %d seals, which can't be read by path", MaxEncryptedPaths)
+			}
+			s := it.Seal()
+			paths = append(paths, pathRef{Path: s.Path, Hash: s.hash()})
+		}
+		if it.Err() != nil {
+			return nil, errors.Wrap(it.Err(), "IterateByHash")
+		}
+		sortPathRefs(paths)
+		c.paths = paths
+	}
+	if len(c.added) > 0 {
+		c.paths = mergePathRefs(c.paths, c.added)
+		c.added = nil
+	}
+	if len(c.paths) > MaxEncryptedPaths {
+		c.paths = nil
+		return nil, errors.Errorf("encrypted index has more than %d seals, which can't be read by path", MaxEncryptedPaths)
+	}
+
+	// complete the group of seals sharing the last path
+	start := sort.Search(len(c.paths), func(i int) bool {
+		return c.paths[i].Path > path
+	})
+	var page []pathRef
+	for _, ref := range c.paths[start:] {
+		if len(page) >= count && ref.Path != page[len(page)-1].Path {
+			break
+		}
+		page = append(page, ref)
+	}
+
+	out := []StoredSeal{}
+	loaded := map[string]bool{}
+	for _, ref := range page {
+		if loaded[string(ref.Hash)] {
+			continue
+		}
+		loaded[string(ref.Hash)] = true
+		seals, err := loadHash(storage, ref.Hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range seals {
+			i := sort.Search(len(page), func(i int) bool {
+				return page[i].Path >= s.Path
+			})
+			if i < len(page) && page[i].Path == s.Path && bytes.Equal(s.hash(), ref.Hash) {
+				out = append(out, s)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path != out[j].Path {
+			return out[i].Path < out[j].Path
+		}
+		return bytes.Compare(out[i].hash(), out[j].hash()) < 0
+	})
+	return out, nil
+}
+
+func comparePathRefs(a, b pathRef) int {
+	if a.Path != b.Path {
+		return strings.Compare(a.Path, b.Path)
+	}
+	return bytes.Compare(a.Hash, b.Hash)
+}
+
+func sortPathRefs(refs []pathRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		return comparePathRefs(refs[i], refs[j]) < 0
+	})
+}
+
+// mergePathRefs merges the added paths into the sorted paths.
+// Paths that were written again are only kept once.
+func mergePathRefs(paths, added []pathRef) []pathRef {
+	sortPathRefs(added)
+	merged := make([]pathRef, 0, len(paths)+len(added))
+	for len(paths) > 0 || len(added) > 0 {
+		var next pathRef
+		switch {
+		case len(added) == 0:
+			next, paths = paths[0], paths[1:]
+		case len(paths) == 0:
+			next, added = added[0], added[1:]
+		case comparePathRefs(added[0], paths[0]) < 0:
+			next, added = added[0], added[1:]
+		default:
+			next, paths = paths[0], paths[1:]
+		}
+		if len(merged) > 0 && comparePathRefs(merged[len(merged)-1], next) == 0 {
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// loadHash loads the seals with the hash. Seals without a hash are
+// the first group by hash, a prefix of zero bytes would match all.
+func loadHash(storage IndexStorage, hash []byte) ([]StoredSeal, error) {
+	if len(hash) > 0 {
+		seals, err := storage.LoadHashPrefix(hash)
+		return seals, errors.Wrap(err, "LoadHashPrefix")
+	}
+	seals, err := storage.LoadAfterHash(nil, 1)
+	return seals, errors.Wrap(err, "LoadAfterHash")
+}
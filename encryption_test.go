@@ -0,0 +1,145 @@
+package seal
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fastScrypt lowers the cost of the key derivation during a test.
+func fastScrypt(t *testing.T) {
+	params := scryptParams
+	scryptParams.N = 1 << 4
+	t.Cleanup(func() { scryptParams = params })
+}
+
+func TestEncryptedStoragePagination(t *testing.T) {
+	fastScrypt(t)
+	for _, storageType := range testStorageTypes {
+		t.Run(string(storageType), func(t *testing.T) {
+			testStoragePagination(t, storageType, &IndexOptions{
+				Format:     FormatBinary,
+				Encrypt:    true,
+				Passphrase: []byte("secret"),
+			})
+		})
+	}
+}
+
+func TestEncryptedIndex(t *testing.T) {
+	fastScrypt(t)
+	for _, storageType := range diskStorageTypes {
+		t.Run(string(storageType), func(t *testing.T) {
+			indexPath := filepath.Join(t.TempDir(), "index")
+			opts := &IndexOptions{Encrypt: true, Passphrase: []byte("secret"), Volume: "hr-archive"}
+			require.NoError(t, DirsToIndex(indexPath, testIndexDirs(), "base", storageType, opts))
+
+			_, err := openStorage(storageType, indexPath, nil)
+			assert.Error(t, err, "no passphrase")
+			_, err = openStorage(storageType, indexPath, &IndexOptions{Passphrase: []byte("wrong")})
+			assert.Error(t, err, "wrong passphrase")
+
+			storage, err := openStorage(storageType, indexPath, &IndexOptions{Passphrase: []byte("secret")})
+			require.NoError(t, err)
+			volume, err := indexVolume(storage)
+			require.NoError(t, err)
+			assert.Equal(t, "hr-archive", volume)
+			require.NoError(t, storage.Close())
+
+			// neither paths nor metadata are readable in the index files
+			files := []string{indexPath}
+			if storageType == StorageTypePebble {
+				files, err = filepath.Glob(filepath.Join(indexPath, "*"))
+				require.NoError(t, err)
+			}
+			for _, file := range files {
+				buf, err := os.ReadFile(file)
+				require.NoError(t, err)
+				assert.NotContains(t, string(buf), "sub/a", file)
+				assert.NotContains(t, string(buf), "hr-archive", file)
+			}
+		})
+	}
+}
+
+func TestEncryptedIndexPath(t *testing.T) {
+	fastScrypt(t)
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	indexPath := filepath.Join(t.TempDir(), "index.db")
+	opts := &IndexOptions{Encrypt: true, Passphrase: []byte("secret")}
+	require.NoError(t, IndexPath(TestDir, indexPath, StorageTypeSQLite, nil, opts))
+	require.NoError(t, IndexPath(TestDir, indexPath, StorageTypeSQLite, nil, opts))
+
+	storage, err := openStorage(StorageTypeSQLite, indexPath, &IndexOptions{Passphrase: []byte("secret")})
+	require.NoError(t, err)
+	defer storage.Close()
+	gens, err := loadGenerations(storage)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(gens))
+}
+
+func TestEncryptExistingIndex(t *testing.T) {
+	fastScrypt(t)
+	indexPath := filepath.Join(t.TempDir(), "index.db")
+	require.NoError(t, DirsToIndex(indexPath, testIndexDirs(), "base", StorageTypeSQLite, nil))
+
+	_, err := openStorage(StorageTypeSQLite, indexPath, &IndexOptions{Encrypt: true, Passphrase: []byte("secret")})
+	assert.Error(t, err)
+
+	encrypted := filepath.Join(t.TempDir(), "encrypted.db")
+	count, err := ConvertIndex(StorageTypeAuto, indexPath, StorageTypeSQLite, encrypted,
+		&IndexOptions{Encrypt: true, Passphrase: []byte("secret")})
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	_, err = openStorage(StorageTypeSQLite, encrypted, &IndexOptions{Entries: true, Passphrase: []byte("secret")})
+	assert.Error(t, err, "entries table of an encrypted index")
+
+	// the rejected open leaves no decrypted entries in the file
+	db, err := sql.Open("sqlite3", encrypted)
+	require.NoError(t, err)
+	defer db.Close()
+	var tables int
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'entries'`).Scan(&tables))
+	assert.Equal(t, 0, tables)
+	buf, err := os.ReadFile(encrypted)
+	require.NoError(t, err)
+	assert.NotContains(t, string(buf), "sub/a")
+}
+
+func TestEncryptedPathCache(t *testing.T) {
+	fastScrypt(t)
+	opts := &IndexOptions{Encrypt: true, Passphrase: []byte("secret"), Memory: NewMemoryStore()}
+	dirs := testIndexDirs()
+	require.NoError(t, DirsToIndex("index", dirs[:1], "base", StorageTypeMemory, opts))
+	storage, err := openStorage(StorageTypeMemory, "index", opts)
+	require.NoError(t, err)
+
+	paths := func() []string {
+		var out []string
+		it := IterateByPath(storage)
+		for it.Next() {
+			out = append(out, it.Seal().Path)
+		}
+		require.NoError(t, it.Err())
+		return out
+	}
+	assert.Equal(t, []string{".", "a", "b", "c"}, paths())
+
+	// written paths are merged into the cached paths, also if they
+	// are written again
+	require.NoError(t, storage.AddDir(&dirs[1], "base"))
+	require.NoError(t, storage.AddDir(&dirs[1], "base"))
+	assert.Equal(t, []string{".", "a", "b", "c", "sub", "sub/a", "sub/d"}, paths())
+
+	defer func(max int) { MaxEncryptedPaths = max }(MaxEncryptedPaths)
+	MaxEncryptedPaths = 5
+	_, err = storage.LoadAfterPath("", 10)
+	assert.Error(t, err, "too many paths")
+}
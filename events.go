@@ -0,0 +1,174 @@
+package seal
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is reported while directory trees are sealed, verified or
+// indexed. It is one of PhaseChanged, DirStarted, FileStarted,
+// HashProgress, FileHashed, DiffFound or DirDone.
+type Event interface {
+	isEvent()
+}
+
+// EventHandler receives events. It is called synchronously from the
+// goroutine that does the work, so it should return quickly.
+type EventHandler func(Event)
+
+// PhaseChanged starts a new pass over Dirs directories. Bytes is the
+// number of bytes that will be hashed, if it is known in advance.
+type PhaseChanged struct {
+	Phase string
+	Dirs  int
+	Bytes int64
+}
+
+// DirStarted is reported before a directory is processed.
+type DirStarted struct {
+	Path string
+}
+
+// FileStarted is reported before the contents of a file are hashed.
+type FileStarted struct {
+	Path string
+}
+
+// HashProgress is reported while a large file is hashed, Bytes
+// were hashed since the last HashProgress of the file.
+type HashProgress struct {
+	Path  string
+	Bytes int64
+}
+
+// FileHashed is reported after the contents of a file were hashed,
+// Bytes is the size of the whole file.
+type FileHashed struct {
+	Path  string
+	Bytes int64
+}
+
+// DiffFound is reported when a directory doesn't match its seal.
+type DiffFound struct {
+	Path string
+	Diff *Diff
+}
+
+// DirDone is reported after a directory was processed.
+type DirDone struct {
+	Path string
+}
+
+func (PhaseChanged) isEvent() {}
+func (DirStarted) isEvent()   {}
+func (FileStarted) isEvent()  {}
+func (HashProgress) isEvent() {}
+func (FileHashed) isEvent()   {}
+func (DiffFound) isEvent()    {}
+func (DirDone) isEvent()      {}
+
+// EventChannel returns a handler that sends all events to the channel.
+// The channel has to be read while the work is running, otherwise
+// the work blocks.
+func EventChannel(ch chan<- Event) EventHandler {
+	return func(e Event) {
+		ch <- e
+	}
+}
+
+// ProgressTracker sums up events to report the progress, throughput
+// and estimated remaining time of the current phase. It is safe to
+// call Handle and Snapshot from different goroutines.
+type ProgressTracker struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	started time.Time
+	p       Progress
+	// partial are the bytes of the current file that were
+	// already counted by HashProgress events.
+	partial int64
+}
+
+// Progress is a snapshot of a ProgressTracker. Bytes is zero if the
+// number of bytes of the phase isn't known in advance.
+type Progress struct {
+	Phase     string
+	Dirs      int
+	DirsDone  int
+	Bytes     int64
+	BytesDone int64
+	Diffs     int
+	// File is the file or directory that is worked on.
+	File string
+
+	Elapsed time.Duration
+	// BytesPerSecond is the hashing throughput of the phase.
+	BytesPerSecond float64
+	// ETA is the estimated remaining time, or zero
+	// if nothing was done yet.
+	ETA time.Duration
+}
+
+// Done returns the finished part of the phase between 0 and 1,
+// by bytes if the total is known or else by directories.
+func (p Progress) Done() float64 {
+	if p.Bytes > 0 {
+		return float64(p.BytesDone) / float64(p.Bytes)
+	}
+	if p.Dirs > 0 {
+		return float64(p.DirsDone) / float64(p.Dirs)
+	}
+	return 0
+}
+
+// Handle adds an event to the progress.
+func (t *ProgressTracker) Handle(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e := e.(type) {
+	case PhaseChanged:
+		t.started = t.clock()
+		t.p = Progress{Phase: e.Phase, Dirs: e.Dirs, Bytes: e.Bytes}
+	case DirStarted:
+		t.p.File = e.Path
+	case FileStarted:
+		t.p.File = e.Path
+		t.partial = 0
+	case HashProgress:
+		t.p.BytesDone += e.Bytes
+		t.partial += e.Bytes
+	case FileHashed:
+		t.p.BytesDone += e.Bytes - t.partial
+		t.partial = 0
+	case DiffFound:
+		t.p.Diffs++
+	case DirDone:
+		t.p.DirsDone++
+	}
+}
+
+// Snapshot returns the current progress.
+func (t *ProgressTracker) Snapshot() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.p
+	if t.started.IsZero() {
+		return p
+	}
+	p.Elapsed = t.clock().Sub(t.started)
+	if p.Elapsed > 0 {
+		p.BytesPerSecond = float64(p.BytesDone) / p.Elapsed.Seconds()
+	}
+	done := p.Done()
+	if done > 0 && done < 1 {
+		p.ETA = time.Duration(float64(p.Elapsed) * (1 - done) / done)
+	}
+	return p
+}
+
+func (t *ProgressTracker) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
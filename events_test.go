@@ -0,0 +1,91 @@
+package seal
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyEvents(t *testing.T) {
+	SetupTestDir(t)
+	var sealBytes int64
+	_, err := NewSealer(SealOptions{OnEvent: func(e Event) {
+		if p, ok := e.(PhaseChanged); ok && p.Phase == "sealing" {
+			sealBytes = p.Bytes
+		}
+	}}).Seal(TestDir)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*2656), sealBytes)
+	assert.NoError(t, os.Remove(TestDir+"/sub/d.txt"))
+
+	ch := make(chan Event)
+	var events []Event
+	done := make(chan bool)
+	go func() {
+		for e := range ch {
+			events = append(events, e)
+		}
+		close(done)
+	}()
+	verifier := NewVerifier(VerifyOptions{OnEvent: EventChannel(ch)})
+	dirs, err := verifier.Verify(TestDir)
+	require.NoError(t, err)
+	close(ch)
+	<-done
+
+	var phases []string
+	var hashBytes, hashed int64
+	diffs, dirsDone := 0, 0
+	for _, e := range events {
+		switch e := e.(type) {
+		case PhaseChanged:
+			phases = append(phases, e.Phase)
+			hashBytes = e.Bytes
+		case FileHashed:
+			hashed += e.Bytes
+		case DiffFound:
+			diffs++
+			assert.Equal(t, "testdir/sub", e.Path)
+			assert.Equal(t, 1, len(e.Diff.FilesMissing))
+		case DirDone:
+			dirsDone++
+		}
+	}
+	assert.Equal(t, []string{"walking", "metadata", "hashing"}, phases)
+	assert.Equal(t, int64(2656+2656), hashBytes)
+	assert.Equal(t, hashBytes, hashed)
+	assert.Equal(t, 2*len(dirs), dirsDone)
+	assert.Equal(t, 2, diffs, "missing file in both phases")
+
+	progress := verifier.Progress()
+	assert.Equal(t, "hashing", progress.Phase)
+	assert.Equal(t, 1.0, progress.Done())
+}
+
+func TestProgressTracker(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := &ProgressTracker{now: func() time.Time { return now }}
+
+	tracker.Handle(PhaseChanged{Phase: "hashing", Dirs: 2, Bytes: 400})
+	now = now.Add(10 * time.Second)
+	tracker.Handle(FileHashed{Bytes: 100})
+	tracker.Handle(DirDone{})
+
+	p := tracker.Snapshot()
+	assert.Equal(t, 0.25, p.Done())
+	assert.Equal(t, 10.0, p.BytesPerSecond)
+	assert.Equal(t, 30*time.Second, p.ETA)
+
+	// HashProgress of a large file isn't counted twice
+	tracker.Handle(FileStarted{Path: "large"})
+	tracker.Handle(HashProgress{Bytes: 100})
+	tracker.Handle(FileHashed{Bytes: 150})
+	assert.Equal(t, int64(250), tracker.Snapshot().BytesDone)
+
+	tracker.Handle(PhaseChanged{Phase: "indexing", Dirs: 4})
+	tracker.Handle(DirDone{})
+	assert.Equal(t, 0.25, tracker.Snapshot().Done())
+}
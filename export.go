@@ -0,0 +1,383 @@
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func exportCmd() *cobra.Command {
+	var output, format string
+	cmd := &cobra.Command{
+		Use:   "export PATH -o MANIFEST",
+		Short: "exports the seal files of a directory tree into one file",
+		Long: `Exports the seals of all directories of a sealed tree into one portable
+manifest file, with paths relative to PATH. The json format writes one
+JSON object per line, the binary format is a zstd compressed stream of
+binary records with checksums. The format is binary if the manifest
+name ends with .zst, otherwise json.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one directory path to export")
+			}
+			if output == "" {
+				return errors.New("need a manifest file to export to")
+			}
+			if format == "" {
+				format = string(FormatJSON)
+				if strings.HasSuffix(output, ".zst") {
+					format = string(FormatBinary)
+				}
+			}
+
+			f, err := os.Create(output)
+			if err != nil {
+				return errors.Wrap(err, "Create")
+			}
+			header, err := ExportSeals(args[0], f, RecordFormat(format))
+			if err != nil {
+				f.Close()
+				return err
+			}
+			err = f.Close()
+			if err != nil {
+				return errors.Wrap(err, "Close")
+			}
+			log.Printf("exported %d directories with root hash %s", header.Dirs, Base64(header.SHA256))
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "manifest file to write")
+	cmd.Flags().StringVar(&format, "format", "", "manifest format: json or binary")
+	return cmd
+}
+
+func importCmd() *cobra.Command {
+	var overwrite, verify bool
+	cmd := &cobra.Command{
+		Use:   "import MANIFEST PATH",
+		Short: "recreates the seal files of a directory tree from an exported manifest",
+		Long: `Recreates the seal files of all directories below PATH from a manifest
+written by export. Before anything is written, the hashes of all
+directories are checked against their files and subdirectories, up to
+the root hash in the manifest. All directories of the manifest have to
+exist below PATH.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("need a manifest file and a directory path to import")
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return errors.Wrap(err, "Open")
+			}
+			defer f.Close()
+			header, err := ImportSeals(f, args[1], overwrite)
+			if err != nil {
+				return err
+			}
+			log.Printf("imported %d directories with root hash %s", header.Dirs, Base64(header.SHA256))
+			if verify {
+				_, err = NewVerifier(VerifyOptions{PrintDifferences: true}).Verify(args[1])
+				return errors.Wrap(err, "Verify")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&overwrite, "overwrite", false, "replace existing seal files")
+	cmd.Flags().BoolVar(&verify, "verify", false, "verify the files against the imported seals")
+	return cmd
+}
+
+// exportMagic starts the decompressed stream of binary manifests.
+var exportMagic = []byte("SEALEXP1")
+
+// maxExportRecord limits the size of a record in a binary manifest,
+// so that a corrupted length can't allocate all memory.
+const maxExportRecord = 1 << 30
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ExportHeader is the first record of an exported manifest.
+type ExportHeader struct {
+	// Root is the name of the exported directory.
+	Root     string
+	Exported time.Time
+	// Dirs is the number of directory records that follow.
+	Dirs int
+	// SHA256 is the hash of the root directory.
+	SHA256 []byte
+}
+
+// ExportSeals writes the seals of all directories below dirPath as a
+// manifest to w, with paths relative to dirPath. Parents are written
+// before their subdirectories.
+func ExportSeals(dirPath string, w io.Writer, format RecordFormat) (*ExportHeader, error) {
+	if format != FormatJSON && format != FormatBinary {
+		return nil, errors.Errorf("unknown manifest format %q", format)
+	}
+	loadSeals := true
+	dirs, err := walkDirectories(dirPath, loadSeals, walkOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "walkDirectories")
+	}
+	records := make([]StoredSeal, 0, len(dirs))
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dirPath, dir.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Rel")
+		}
+		records = append(records, StoredSeal{Path: filepath.ToSlash(rel), Dir: dir.Seal})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return pathDepth(records[i].Path) < pathDepth(records[j].Path) ||
+			pathDepth(records[i].Path) == pathDepth(records[j].Path) && records[i].Path < records[j].Path
+	})
+	if len(records) == 0 || records[0].Path != "." {
+		return nil, errors.Errorf("%q has no seal file", dirPath)
+	}
+	header := &ExportHeader{
+		Root:     records[0].Dir.Name,
+		Exported: time.Now(),
+		Dirs:     len(records),
+		SHA256:   records[0].Dir.SHA256,
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
+	}
+
+	if format == FormatJSON {
+		bw := bufio.NewWriter(w)
+		bw.Write(headerJSON)
+		bw.WriteByte('\n')
+		for i := range records {
+			buf, err := encodeRecord(FormatJSON, &records[i])
+			if err != nil {
+				return nil, err
+			}
+			bw.Write(buf)
+			bw.WriteByte('\n')
+		}
+		return header, errors.Wrap(bw.Flush(), "Flush")
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, errors.Wrap(err, "zstd.NewWriter")
+	}
+	zw.Write(exportMagic)
+	writeExportRecord(zw, headerJSON)
+	for i := range records {
+		buf, err := encodeSeal(FormatBinary, &records[i])
+		if err != nil {
+			return nil, err
+		}
+		writeExportRecord(zw, buf)
+	}
+	// errors of the writes are returned by Close
+	return header, errors.Wrap(zw.Close(), "zstd.Close")
+}
+
+// writeExportRecord writes a record with an uvarint length prefix.
+func writeExportRecord(w io.Writer, record []byte) {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(record)))
+	w.Write(prefix[:n])
+	w.Write(record)
+}
+
+// ReadExport reads a manifest written by ExportSeals in
+// either format, and returns the seals by relative path.
+func ReadExport(r io.Reader) (*ExportHeader, map[string]*DirSeal, error) {
+	br := bufio.NewReader(r)
+	start, err := br.Peek(len(zstdMagic))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read manifest start")
+	}
+
+	var next func() ([]byte, error)
+	if bytes.Equal(start, zstdMagic) {
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "zstd.NewReader")
+		}
+		defer dec.Close()
+		zr := bufio.NewReader(dec)
+		magic := make([]byte, len(exportMagic))
+		_, err = io.ReadFull(zr, magic)
+		if err != nil || !bytes.Equal(magic, exportMagic) {
+			return nil, nil, errors.New("not a seal manifest")
+		}
+		next = func() ([]byte, error) {
+			size, err := binary.ReadUvarint(zr)
+			if err != nil {
+				return nil, err
+			}
+			if size > maxExportRecord {
+				return nil, errors.Errorf("record of %d bytes is too large", size)
+			}
+			buf := make([]byte, size)
+			_, err = io.ReadFull(zr, buf)
+			return buf, err
+		}
+	} else {
+		next = func() ([]byte, error) {
+			line, err := br.ReadBytes('\n')
+			if err == io.EOF && len(line) > 0 {
+				err = nil
+			}
+			return bytes.TrimSpace(line), err
+		}
+	}
+
+	buf, err := next()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read header")
+	}
+	var header ExportHeader
+	err = json.Unmarshal(buf, &header)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "decode header")
+	}
+	dirs := map[string]*DirSeal{}
+	for {
+		buf, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "read record %d", len(dirs)+1)
+		}
+		s, err := decodeSeal(buf)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "decode record %d", len(dirs)+1)
+		}
+		if s.Dir == nil {
+			return nil, nil, errors.Errorf("record %q is not a directory", s.Path)
+		}
+		dirs[s.Path] = s.Dir
+	}
+	if len(dirs) != header.Dirs {
+		return nil, nil, errors.Errorf("manifest has %d directories, want %d", len(dirs), header.Dirs)
+	}
+	return &header, dirs, nil
+}
+
+// checkExport checks that the hashes of all directories match their
+// files, that subdirectories match the seals of their parents and
+// that the root matches the hash of the header.
+func checkExport(header *ExportHeader, dirs map[string]*DirSeal) error {
+	root, ok := dirs["."]
+	if !ok {
+		return errors.New("manifest has no root directory")
+	}
+	if !bytes.Equal(root.SHA256, header.SHA256) {
+		return errors.Errorf("root hash is %s, want %s", Base64(root.SHA256), Base64(header.SHA256))
+	}
+	referenced := map[string]bool{".": true}
+	for dirPath, d := range dirs {
+		if !dirHashMatches(d) {
+			return errors.Errorf("hash of %q doesn't match its files", dirPath)
+		}
+		for _, f := range d.Files {
+			if !f.IsDir || !f.exists() {
+				continue
+			}
+			subPath := path.Join(dirPath, f.Name)
+			sub, ok := dirs[subPath]
+			if !ok {
+				return errors.Errorf("directory %q is missing", subPath)
+			}
+			if !bytes.Equal(sub.SHA256, f.SHA256) || sub.TotalSize != f.Size {
+				return errors.Errorf("directory %q doesn't match the seal of its parent", subPath)
+			}
+			referenced[subPath] = true
+		}
+	}
+	for dirPath := range dirs {
+		if !referenced[dirPath] {
+			return errors.Errorf("directory %q isn't part of the tree", dirPath)
+		}
+	}
+	return nil
+}
+
+// ImportSeals reads a manifest written by ExportSeals and writes the seal
+// files of all its directories below dirPath. The manifest is checked up
+// to the root hash and all directories have to exist before anything is
+// written. Existing seal files are only replaced if overwrite is set.
+// The root seal is renamed to the name of dirPath.
+func ImportSeals(r io.Reader, dirPath string, overwrite bool) (*ExportHeader, error) {
+	header, dirs, err := ReadExport(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadExport")
+	}
+	err = checkExport(header, dirs)
+	if err != nil {
+		return nil, errors.Wrap(err, "check manifest")
+	}
+
+	paths := make([]string, 0, len(dirs))
+	for relPath := range dirs {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	fsys := DirFS(dirPath)
+	for _, relPath := range paths {
+		info, err := fs.Stat(fsys, relPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "directory %q", relPath)
+		}
+		if !info.IsDir() {
+			return nil, errors.Errorf("%q is not a directory", relPath)
+		}
+		if overwrite {
+			continue
+		}
+		_, err = fs.Stat(fsys, path.Join(relPath, SealFile))
+		if err == nil {
+			return nil, errors.Errorf("%q already has a seal file", relPath)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.Wrapf(err, "seal file of %q", relPath)
+		}
+	}
+
+	abs, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Abs")
+	}
+	root := dirs["."]
+	if name := filepath.Base(abs); root.Name != name {
+		log.Printf("renaming the root seal from %q to %q", root.Name, name)
+		root.Name = name
+	}
+	for _, relPath := range paths {
+		buf, err := dirs[relPath].encodeFile()
+		if err != nil {
+			return nil, errors.Wrap(err, "Encode seal")
+		}
+		WriteLock.Lock()
+		err = fsys.WriteFile(path.Join(relPath, SealFile), buf)
+		WriteLock.Unlock()
+		if err != nil {
+			return nil, errors.Wrapf(err, "write seal of %q", relPath)
+		}
+	}
+	return header, nil
+}
@@ -0,0 +1,105 @@
+package seal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyTestTree copies the files of TestDir without seal files.
+func copyTestTree(t *testing.T, target string) {
+	err := filepath.Walk(TestDir, func(p string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(TestDir, p)
+		require.NoError(t, err)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(target, rel), 0755)
+		}
+		if info.Name() == SealFile {
+			return nil
+		}
+		buf, err := os.ReadFile(p)
+		require.NoError(t, err)
+		return os.WriteFile(filepath.Join(target, rel), buf, 0644)
+	})
+	require.NoError(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	root, err := loadSeal(TestDir)
+	require.NoError(t, err)
+
+	for _, format := range []RecordFormat{FormatJSON, FormatBinary} {
+		var buf bytes.Buffer
+		header, err := ExportSeals(TestDir, &buf, format)
+		require.NoError(t, err, format)
+		assert.Equal(t, 2, header.Dirs)
+		assert.Equal(t, "testdir", header.Root)
+		assert.Equal(t, root.SHA256, header.SHA256)
+
+		target := filepath.Join(t.TempDir(), "copy")
+		copyTestTree(t, target)
+		exported := buf.Bytes()
+		_, err = ImportSeals(bytes.NewReader(exported), target, false)
+		require.NoError(t, err, format)
+
+		imported, err := loadSeal(target)
+		require.NoError(t, err)
+		assert.Equal(t, "copy", imported.Name)
+		assert.Equal(t, root.SHA256, imported.SHA256)
+		dirs, err := NewVerifier(VerifyOptions{}).Verify(target)
+		require.NoError(t, err)
+		for _, dir := range dirs {
+			assert.True(t, dir.HashDiff.Identical, dir.Path)
+		}
+
+		_, err = ImportSeals(bytes.NewReader(exported), target, false)
+		assert.Error(t, err, "existing seal files")
+		_, err = ImportSeals(bytes.NewReader(exported), target, true)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCheckExport(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = ExportSeals(TestDir, &buf, FormatJSON)
+	require.NoError(t, err)
+
+	read := func() (*ExportHeader, map[string]*DirSeal) {
+		header, dirs, err := ReadExport(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		return header, dirs
+	}
+	header, dirs := read()
+	assert.NoError(t, checkExport(header, dirs))
+
+	header, dirs = read()
+	dirs["sub"].Files[0].SHA256[0]++
+	assert.Error(t, checkExport(header, dirs), "file hash")
+
+	header, dirs = read()
+	dirs["sub"].Files = dirs["sub"].Files[:1]
+	assert.NoError(t, dirs["sub"].hash())
+	assert.Error(t, checkExport(header, dirs), "subdirectory hash")
+
+	header, dirs = read()
+	header.SHA256 = dirs["sub"].SHA256
+	assert.Error(t, checkExport(header, dirs), "root hash")
+
+	header, dirs = read()
+	delete(dirs, "sub")
+	assert.Error(t, checkExport(header, dirs), "missing directory")
+
+	_, _, err = ReadExport(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	assert.Error(t, err)
+}
@@ -0,0 +1,436 @@
+package seal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func findCmd() *cobra.Command {
+	var (
+		query      FindQuery
+		useRegex   bool
+		sizeRange  string
+		timeRange  string
+		jsonOutput bool
+	)
+	cmd := &cobra.Command{
+		Use:   "find PATTERN [INDEX...]",
+		Short: "finds files and directories in indices",
+		Long: `Finds files and directories in the given indices, or in the index
+passed with --file, and prints the volume and path of every hit.
+
+PATTERN is a glob that is matched against the name, or against the
+whole path if it contains a slash. With --regex it is a regular
+expression that is matched against the path. Use "*" to only filter
+by size, modification time or hash.
+
+Ranges are written as MIN..MAX, either side can be left out:
+  --size 10MiB..1GiB   --modified 2019-01-01..2020-01-01`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("need a pattern to find")
+			}
+			var err error
+			if useRegex {
+				pattern := args[0]
+				if query.IgnoreCase {
+					pattern = "(?i)" + pattern
+				}
+				query.Regex, err = regexp.Compile(pattern)
+				if err != nil {
+					return errors.Wrap(err, "regexp.Compile")
+				}
+			} else {
+				query.Glob = args[0]
+			}
+			query.MinSize, query.MaxSize, err = parseSizeRange(sizeRange)
+			if err != nil {
+				return err
+			}
+			query.ModifiedAfter, query.ModifiedBefore, err = parseTimeRange(timeRange)
+			if err != nil {
+				return err
+			}
+
+			indices := args[1:]
+			if len(indices) == 0 {
+				if IndexFile == "" {
+					return errors.New("need an index argument or an index file to search")
+				}
+				indices = []string{IndexFile}
+			}
+			var hits []FindHit
+			for _, indexPath := range indices {
+				found, err := FindInIndex(indexPath, StorageType(IndexStorageType), &query)
+				if err != nil {
+					return errors.Wrapf(err, "FindInIndex %q", indexPath)
+				}
+				hits = append(hits, found...)
+			}
+
+			if jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "\t")
+				return enc.Encode(hits)
+			}
+			printHits(os.Stdout, hits)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&useRegex, "regex", false, "the pattern is a regular expression")
+	cmd.Flags().BoolVar(&query.IgnoreCase, "ignore-case", false, "match the pattern case insensitively")
+	cmd.Flags().StringVar(&sizeRange, "size", "", "size range like 10MiB..1GiB")
+	cmd.Flags().StringVar(&timeRange, "modified", "", "modification time range like 2019-01-01..2020-01-01")
+	cmd.Flags().StringVar(&query.HashPrefix, "hash", "", "hex prefix of the SHA256")
+	cmd.Flags().BoolVar(&query.All, "all", false, "also find deleted files and old versions")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the hits as JSON")
+	return cmd
+}
+
+// FindQuery filters the seals of an index. Empty fields match everything.
+type FindQuery struct {
+	// Glob is matched against the name, or against the whole path
+	// if it contains a slash.
+	Glob string
+	// Regex is matched against the path.
+	Regex *regexp.Regexp
+	// IgnoreCase matches the glob case insensitively, including
+	// its character classes.
+	IgnoreCase bool
+
+	MinSize, MaxSize int64
+
+	ModifiedAfter, ModifiedBefore time.Time
+
+	// HashPrefix is a hex prefix of the SHA256.
+	HashPrefix string
+
+	// All also matches deleted files and old versions.
+	All bool
+}
+
+// FindHit is a file or directory found in an index.
+type FindHit struct {
+	Volume   string
+	Path     string
+	IsDir    bool `json:",omitempty"`
+	Size     int64
+	Modified time.Time
+	SHA256   []byte
+}
+
+// FindInIndex returns all seals of the index that match the query. Hash
+// prefixes are looked up directly, everything else scans the index.
+func FindInIndex(indexPath string, t StorageType, query *FindQuery) ([]FindHit, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+
+	volume, err := indexVolume(storage)
+	if err != nil {
+		return nil, err
+	}
+	if volume == "" {
+		volume = indexPath
+	}
+	var folded *regexp.Regexp
+	if query.Glob != "" && query.IgnoreCase {
+		folded, err = foldGlob(query.Glob)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hits := []FindHit{}
+	add := func(s *StoredSeal) error {
+		ok, err := query.match(s, folded)
+		if err != nil || !ok {
+			return err
+		}
+		hits = append(hits, newFindHit(volume, s))
+		return nil
+	}
+
+	if query.HashPrefix != "" {
+		prefix, err := hashPrefixBytes(query.HashPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(prefix) == 0 {
+			return hits, findByHash(storage, query.HashPrefix, add)
+		}
+		seals, err := storage.LoadHashPrefix(prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "LoadHashPrefix")
+		}
+		for i := range seals {
+			err = add(&seals[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return hits, nil
+	}
+
+	it := IterateByPath(storage)
+	for it.Next() {
+		s := it.Seal()
+		err = add(&s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hits, errors.Wrap(it.Err(), "IterateByPath")
+}
+
+// hashPrefixBytes returns the whole bytes of a hex prefix. The
+// last digit of odd length prefixes is checked by match.
+func hashPrefixBytes(prefix string) ([]byte, error) {
+	for _, r := range prefix {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return nil, errors.Errorf("invalid hash prefix %q", prefix)
+		}
+	}
+	b, err := hex.DecodeString(prefix[:len(prefix)/2*2])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid hash prefix %q", prefix)
+	}
+	return b, nil
+}
+
+// findByHash adds the seals whose hash starts with a prefix that is
+// shorter than a byte. They are read in pages in hash order, which
+// stops after the last hash with the prefix.
+func findByHash(storage IndexStorage, prefix string, add func(*StoredSeal) error) error {
+	prefix = strings.ToLower(prefix)
+	it := IterateByHash(storage)
+	for it.Next() {
+		s := it.Seal()
+		hash := hex.EncodeToString(s.hash())
+		if len(hash) > len(prefix) {
+			hash = hash[:len(prefix)]
+		}
+		if hash > prefix {
+			break
+		}
+		err := add(&s)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(it.Err(), "IterateByHash")
+}
+
+// foldGlob translates a glob into a case insensitive regular
+// expression with the same meaning as filepath.Match, so that
+// classes like [A-Z] and escapes keep working.
+func foldGlob(glob string) (*regexp.Regexp, error) {
+	_, err := filepath.Match(glob, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", glob)
+	}
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	inClass := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case inClass && c == ']':
+			inClass = false
+			b.WriteByte(']')
+		case inClass && c == '-':
+			b.WriteByte('-')
+		case inClass:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			inClass = true
+			b.WriteByte('[')
+			if i+1 < len(glob) && glob[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
+
+func (q *FindQuery) match(s *StoredSeal, folded *regexp.Regexp) (bool, error) {
+	if !q.All && !s.exists() {
+		return false, nil
+	}
+	if q.Glob != "" {
+		name := s.Path
+		if !strings.Contains(q.Glob, "/") {
+			name = filepath.Base(name)
+		}
+		var ok bool
+		var err error
+		if folded != nil {
+			ok = folded.MatchString(name)
+		} else {
+			ok, err = filepath.Match(q.Glob, name)
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "filepath.Match")
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if q.Regex != nil && !q.Regex.MatchString(s.Path) {
+		return false, nil
+	}
+
+	hit := newFindHit("", s)
+	if q.MinSize > 0 && hit.Size < q.MinSize {
+		return false, nil
+	}
+	if q.MaxSize > 0 && hit.Size > q.MaxSize {
+		return false, nil
+	}
+	if !q.ModifiedAfter.IsZero() && hit.Modified.Before(q.ModifiedAfter) {
+		return false, nil
+	}
+	if !q.ModifiedBefore.IsZero() && !hit.Modified.Before(q.ModifiedBefore) {
+		return false, nil
+	}
+	if q.HashPrefix != "" && !strings.HasPrefix(hex.EncodeToString(hit.SHA256), strings.ToLower(q.HashPrefix)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func newFindHit(volume string, s *StoredSeal) FindHit {
+	if s.Dir != nil {
+		return FindHit{Volume: volume, Path: s.Path, IsDir: true, Size: s.Dir.TotalSize,
+			Modified: s.Dir.Modified, SHA256: s.Dir.SHA256}
+	}
+	return FindHit{Volume: volume, Path: s.Path, Size: s.File.Size,
+		Modified: s.File.Modified, SHA256: s.File.SHA256}
+}
+
+func printHits(w io.Writer, hits []FindHit) {
+	for _, h := range hits {
+		path := h.Path
+		if h.IsDir {
+			path += "/"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.Volume, path, formatBytes(h.Size), h.Modified.Format("2006-01-02 15:04"))
+	}
+}
+
+// parseSizeRange parses a MIN..MAX range of sizes like 10MiB or 2G.
+func parseSizeRange(r string) (int64, int64, error) {
+	if r == "" {
+		return 0, 0, nil
+	}
+	lower, upper, err := splitRange(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	var minSize, maxSize int64
+	if lower != "" {
+		minSize, err = parseBytes(lower)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if upper != "" {
+		maxSize, err = parseBytes(upper)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return minSize, maxSize, nil
+}
+
+// parseTimeRange parses a MIN..MAX range of times in local time.
+func parseTimeRange(r string) (time.Time, time.Time, error) {
+	var after, before time.Time
+	if r == "" {
+		return after, before, nil
+	}
+	lower, upper, err := splitRange(r)
+	if err != nil {
+		return after, before, err
+	}
+	if lower != "" {
+		after, err = parseTime(lower)
+		if err != nil {
+			return after, before, err
+		}
+	}
+	if upper != "" {
+		before, err = parseTime(upper)
+		if err != nil {
+			return after, before, err
+		}
+	}
+	return after, before, nil
+}
+
+func splitRange(r string) (string, string, error) {
+	parts := strings.Split(r, "..")
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("range %q is not written as MIN..MAX", r)
+	}
+	return parts[0], parts[1], nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("can't parse time %q", s)
+}
+
+// parseBytes parses a byte count with an optional unit like K, KB or KiB,
+// all units are binary like the ones printed by formatBytes.
+func parseBytes(s string) (int64, error) {
+	number := strings.TrimRightFunc(s, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(s[len(number):]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.Errorf("can't parse size %q", s)
+	}
+	multiplier := int64(1)
+	if unit != "" {
+		exp := strings.Index("KMGTPE", unit)
+		if exp < 0 || len(unit) != 1 {
+			return 0, errors.Errorf("unknown unit in size %q", s)
+		}
+		for i := 0; i <= exp; i++ {
+			multiplier *= 1024
+		}
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,96 @@
+package seal
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindInIndex(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index")
+	dirs := testIndexDirs()
+	dirs[0].Seal.Files[0].Name = "IMG_4411.CR2"
+	dirs[0].Seal.Files[0].Modified = time.Date(2019, 5, 1, 12, 0, 0, 0, time.Local)
+	dirs[1].Seal.Files[0].Name = "img_4412.cr2"
+	opts := &IndexOptions{Volume: "drive-1"}
+	require.NoError(t, DirsToIndex(indexPath, dirs, "base", StorageTypeMemory, opts))
+	defer DropMemoryIndex(indexPath)
+
+	find := func(query FindQuery) []string {
+		hits, err := FindInIndex(indexPath, StorageTypeMemory, &query)
+		require.NoError(t, err)
+		var paths []string
+		for _, h := range hits {
+			assert.Equal(t, "drive-1", h.Volume)
+			paths = append(paths, h.Path)
+		}
+		return paths
+	}
+
+	assert.Equal(t, []string{"IMG_4411.CR2"}, find(FindQuery{Glob: "IMG_4411.CR2"}))
+	assert.Equal(t, []string{"IMG_4411.CR2", "sub/img_4412.cr2"}, find(FindQuery{Glob: "img_*.cr2", IgnoreCase: true}))
+	assert.Equal(t, []string{"IMG_4411.CR2", "sub/img_4412.cr2"}, find(FindQuery{Glob: "[A-Z]MG_44[0-9][0-9].cr2", IgnoreCase: true}))
+	assert.Equal(t, []string{"sub/img_4412.cr2"}, find(FindQuery{Glob: "sub/*"}))
+	assert.Equal(t, []string{"sub/img_4412.cr2"}, find(FindQuery{Regex: regexp.MustCompile(`^sub/.*\.cr2$`)}))
+	assert.Equal(t, []string{"c"}, find(FindQuery{Glob: "*", MinSize: 2}))
+	assert.Equal(t, []string{"IMG_4411.CR2"}, find(FindQuery{Glob: "*", ModifiedAfter: time.Date(2019, 1, 1, 0, 0, 0, 0, time.Local)}))
+
+	hashA := hex.EncodeToString(dirs[0].Seal.Files[0].SHA256)
+	assert.Equal(t, []string{"IMG_4411.CR2", "b", "sub/img_4412.cr2"}, find(FindQuery{HashPrefix: hashA[:5]}))
+	assert.Empty(t, find(FindQuery{HashPrefix: "ff"}))
+	assert.Equal(t, 6, len(find(FindQuery{HashPrefix: "0"})))
+	assert.Empty(t, find(FindQuery{HashPrefix: "F"}))
+	for _, prefix := range []string{"z", hashA[:3] + "z"} {
+		_, err := FindInIndex(indexPath, StorageTypeMemory, &FindQuery{HashPrefix: prefix})
+		assert.Error(t, err, prefix)
+	}
+	assert.Equal(t, []string{"sub/d"}, find(FindQuery{Glob: "d", All: true}))
+	assert.Empty(t, find(FindQuery{Glob: "d"}))
+}
+
+func TestFoldGlob(t *testing.T) {
+	for _, c := range []struct {
+		glob, name string
+		match      bool
+	}{
+		{"img_*.cr2", "IMG_4411.CR2", true},
+		{"[A-C]*", "b", true},
+		{"[^A-C]*", "b", false},
+		{"a\\*b", "a*B", true},
+		{"a\\*b", "axb", false},
+		{"[\\]x]", "X", true},
+		{"*", "a/b", false},
+		{"?.txt", "ä.TXT", true},
+	} {
+		re, err := foldGlob(c.glob)
+		require.NoError(t, err, c.glob)
+		assert.Equal(t, c.match, re.MatchString(c.name), c.glob)
+	}
+	_, err := foldGlob("[a-")
+	assert.Error(t, err)
+}
+
+func TestParseBytes(t *testing.T) {
+	for s, want := range map[string]int64{
+		"10":     10,
+		"2K":     2048,
+		"1.5GiB": 3 << 29,
+		"3 MB":   3 << 20,
+	} {
+		got, err := parseBytes(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	_, err := parseBytes("10X")
+	assert.Error(t, err)
+
+	lower, upper, err := parseSizeRange("..1M")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), lower)
+	assert.Equal(t, int64(1<<20), upper)
+}
@@ -0,0 +1,104 @@
+package seal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+var errReadOnlyFS = errors.New("can't write seal files to a read only file system")
+
+// WriteFS is a file system that seal files can be written to.
+type WriteFS interface {
+	fs.FS
+	// WriteFile creates or replaces the file name with data.
+	WriteFile(name string, data []byte) error
+}
+
+// OSFS returns the local file system. Unlike os.DirFS it isn't rooted,
+// names are OS paths that are relative to the working directory or
+// absolute. Stat doesn't follow symlinks, like the rest of seal.
+func OSFS() WriteFS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) WriteFile(name string, data []byte) error {
+	return os.WriteFile(name, data, 0666)
+}
+
+// DirFS returns the local directory tree at root as a file system.
+// Unlike os.DirFS, Stat doesn't follow symlinks and seal files
+// can be written to it.
+func DirFS(root string) WriteFS {
+	return dirFS(root)
+}
+
+type dirFS string
+
+// join returns the OS path of a name. The root keeps a trailing "."
+// so that its name is "." like in other file systems.
+func (d dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return string(d) + string(filepath.Separator) + ".", nil
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	fullPath, err := d.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPath)
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	fullPath, err := d.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(fullPath)
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fullPath, err := d.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(fullPath)
+}
+
+func (d dirFS) WriteFile(name string, data []byte) error {
+	fullPath, err := d.join("write", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fullPath, data, 0666)
+}
+
+// orOSFS returns fsys, or the local file system if it is nil.
+func orOSFS(fsys fs.FS) fs.FS {
+	if fsys == nil {
+		return osFS{}
+	}
+	return fsys
+}
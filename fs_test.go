@@ -0,0 +1,92 @@
+package seal
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memFS is a MapFS that seal files can be written to.
+type memFS struct {
+	fstest.MapFS
+}
+
+func (m memFS) WriteFile(name string, data []byte) error {
+	m.MapFS[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: time.Now()}
+	return nil
+}
+
+// faultyFS fails to open one file.
+type faultyFS struct {
+	memFS
+	fail string
+}
+
+func (f faultyFS) Open(name string) (fs.File, error) {
+	if name == f.fail {
+		return nil, errors.New("injected fault")
+	}
+	return f.memFS.Open(name)
+}
+
+func testMemFS() memFS {
+	modified := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	return memFS{fstest.MapFS{
+		"a.txt":     {Data: []byte("a"), ModTime: modified},
+		"sub/c.txt": {Data: []byte("cc"), ModTime: modified},
+		"sub/d.txt": {Data: []byte("ddd"), ModTime: modified},
+	}}
+}
+
+func TestSealFS(t *testing.T) {
+	fsys := testMemFS()
+	dirs, err := NewSealer(SealOptions{FS: fsys}).Seal(".")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(dirs))
+	assert.Contains(t, fsys.MapFS, SealFile)
+	assert.Contains(t, fsys.MapFS, "sub/"+SealFile)
+
+	root, err := loadSealFS(fsys, ".")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), root.TotalSize)
+
+	dirs, err = NewVerifier(VerifyOptions{FS: fsys}).Verify(".")
+	require.NoError(t, err)
+	for _, dir := range dirs {
+		assert.True(t, dir.HashDiff.Identical, dir.Path)
+	}
+
+	fsys.MapFS["sub/d.txt"].Data = []byte("xxx")
+	dirs, err = NewVerifier(VerifyOptions{FS: fsys}).Verify(".")
+	require.NoError(t, err)
+	for _, dir := range dirs {
+		assert.Equal(t, dir.Path != "sub", dir.HashDiff.Identical, dir.Path)
+	}
+}
+
+func TestSealFSErrors(t *testing.T) {
+	readOnly := testMemFS().MapFS
+	_, err := NewSealer(SealOptions{FS: readOnly}).Seal(".")
+	assert.Error(t, err)
+	dirs, err := NewSealer(SealOptions{FS: readOnly}).Scan(".", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(dirs))
+
+	// files that can't be read are logged and left out of the seal
+	fsys := faultyFS{memFS: testMemFS(), fail: "sub/d.txt"}
+	dirs, err = NewSealer(SealOptions{FS: fsys}).Seal(".")
+	require.NoError(t, err)
+	sub, err := loadSealFS(fsys, "sub")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sub.Files))
+	assert.Equal(t, "c.txt", sub.Files[0].Name)
+
+	fsys.fail = "sub/" + SealFile
+	_, err = NewVerifier(VerifyOptions{FS: fsys}).Verify(".")
+	assert.Error(t, err)
+}
@@ -0,0 +1,418 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const generationsMetaKey = "generations"
+
+// Generation is a snapshot of the indexed directory tree. Every run
+// of IndexPath adds a generation with the hash of the root seal.
+//
+// Seals are never removed from the index, so the tree of every
+// generation can be walked from its root hash. Directory hashes
+// don't include the names of files though, so if the names in a
+// directory change but the contents don't, older generations
+// show the latest names.
+type Generation struct {
+	Number int
+	Time   time.Time
+	SHA256 []byte
+	Size   int64
+}
+
+func historyCmd() *cobra.Command {
+	var jsonOutput bool
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "lists the generations of an index",
+		Long: `Lists the generations of the index passed with --file. A generation is
+added every time a directory is indexed. Generations are selected by
+their number, or by a time which selects the last generation before it.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gens, err := Generations(IndexFile, StorageType(IndexStorageType))
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(gens)
+			}
+			for _, g := range gens {
+				fmt.Printf("%d\t%s\t%s\t%s\n", g.Number, g.Time.Format("2006-01-02 15:04:05"),
+					formatBytes(g.Size), Base64(g.SHA256))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the generations as JSON")
+
+	var at string
+	showCmd := &cobra.Command{
+		Use:   "show [PATH]",
+		Short: "lists the files of a directory in a generation",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "."
+			if len(args) > 0 {
+				path = args[0]
+			}
+			seals, err := ShowGeneration(IndexFile, StorageType(IndexStorageType), at, path)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(seals)
+			}
+			for _, s := range seals {
+				fmt.Printf("%s\t%s\t%s\n", s.File.Modified.Format("2006-01-02 15:04"), formatBytes(s.File.Size), s.Path)
+			}
+			return nil
+		},
+	}
+	showCmd.Flags().StringVar(&at, "at", "", "generation number or time, defaults to the latest generation")
+	showCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the files as JSON")
+	cmd.AddCommand(showCmd)
+
+	diffCmd := &cobra.Command{
+		Use:   "diff A B",
+		Short: "lists the files that changed between two generations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("need two generations to diff")
+			}
+			diff, err := DiffGenerations(IndexFile, StorageType(IndexStorageType), args[0], args[1])
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(diff)
+			}
+			diff.Print(os.Stdout)
+			return nil
+		},
+	}
+	diffCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the differences as JSON")
+	cmd.AddCommand(diffCmd)
+	return cmd
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// loadGenerations returns the generations stored in the index.
+func loadGenerations(storage IndexStorage) ([]Generation, error) {
+	buf, err := storage.GetMeta(generationsMetaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMeta")
+	}
+	var gens []Generation
+	if len(buf) == 0 {
+		return gens, nil
+	}
+	err = json.Unmarshal(buf, &gens)
+	return gens, errors.Wrap(err, "json.Unmarshal")
+}
+
+// addGeneration stores a new generation for the root seal.
+func addGeneration(storage IndexStorage, root *DirSeal, t time.Time) error {
+	gens, err := loadGenerations(storage)
+	if err != nil {
+		return err
+	}
+	if len(gens) > 0 && bytes.Equal(gens[len(gens)-1].SHA256, root.SHA256) {
+		// nothing changed since the last generation
+		return nil
+	}
+	gens = append(gens, Generation{
+		Number: len(gens) + 1,
+		Time:   t,
+		SHA256: root.SHA256,
+		Size:   root.TotalSize,
+	})
+	buf, err := json.Marshal(gens)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+	return errors.Wrap(storage.SetMeta(generationsMetaKey, buf), "SetMeta")
+}
+
+// Generations returns all generations of an index.
+func Generations(indexPath string, t StorageType) ([]Generation, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+	return loadGenerations(storage)
+}
+
+// selectGeneration finds a generation by number, or the last
+// generation at or before a time. An empty selector selects
+// the latest generation.
+func selectGeneration(gens []Generation, selector string) (*Generation, error) {
+	if len(gens) == 0 {
+		return nil, errors.New("index has no generations")
+	}
+	if selector == "" {
+		return &gens[len(gens)-1], nil
+	}
+	number, err := strconv.Atoi(selector)
+	if err == nil {
+		if number < 1 || number > len(gens) {
+			return nil, errors.Errorf("no generation %d", number)
+		}
+		return &gens[number-1], nil
+	}
+	at, err := parseTime(selector)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(gens), func(i int) bool {
+		return gens[i].Time.After(at)
+	})
+	if i == 0 {
+		return nil, errors.Errorf("no generation before %s", at)
+	}
+	return &gens[i-1], nil
+}
+
+// loadDirSeal looks up the seal of a directory by path and hash.
+func loadDirSeal(storage IndexStorage, path string, hash []byte) (*DirSeal, error) {
+	seals, err := storage.LoadHashPrefix(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadHashPrefix")
+	}
+	for _, s := range seals {
+		if s.Dir != nil && s.Path == path && bytes.Equal(s.Dir.SHA256, hash) {
+			return s.Dir, nil
+		}
+	}
+	return nil, errors.Errorf("no seal for %q with hash %s in the index", path, Base64(hash))
+}
+
+// generationDir walks from the root of the generation down to the
+// directory at path and returns its seal.
+func generationDir(storage IndexStorage, gen *Generation, path string) (*DirSeal, error) {
+	dir, err := loadDirSeal(storage, ".", gen.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	if path == "." {
+		return dir, nil
+	}
+	current := "."
+	for _, name := range strings.Split(path, "/") {
+		var sub *FileSeal
+		for _, f := range dir.Files {
+			if f.Name == name && f.IsDir && f.exists() {
+				sub = f
+				break
+			}
+		}
+		if sub == nil {
+			return nil, errors.Errorf("%q doesn't exist in generation %d", path, gen.Number)
+		}
+		current = filepath.Join(current, name)
+		dir, err = loadDirSeal(storage, current, sub.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dir, nil
+}
+
+// walkGeneration calls fn for every existing file below the
+// directory at path with the given seal.
+func walkGeneration(storage IndexStorage, path string, dir *DirSeal, fn func(path string, f *FileSeal)) error {
+	for _, f := range dir.Files {
+		if !f.exists() {
+			continue
+		}
+		filePath := filepath.Join(path, f.Name)
+		if !f.IsDir {
+			fn(filePath, f)
+			continue
+		}
+		sub, err := loadDirSeal(storage, filePath, f.SHA256)
+		if err != nil {
+			return err
+		}
+		err = walkGeneration(storage, filePath, sub, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShowGeneration returns all files below path as they were
+// in the generation selected by number or time.
+func ShowGeneration(indexPath string, t StorageType, selector, path string) ([]StoredSeal, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+
+	gens, err := loadGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := selectGeneration(gens, selector)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := generationDir(storage, gen, path)
+	if err != nil {
+		return nil, err
+	}
+	out := []StoredSeal{}
+	err = walkGeneration(storage, filepath.Clean(path), dir, func(path string, f *FileSeal) {
+		out = append(out, StoredSeal{Path: path, File: f})
+	})
+	return out, err
+}
+
+// GenerationDiff lists the files that were added, removed
+// or changed between two generations.
+type GenerationDiff struct {
+	A, B    Generation
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// DiffGenerations compares two generations selected by number or
+// time. Directories with the same hash in both generations are
+// skipped, so only the changed parts of the tree are read.
+func DiffGenerations(indexPath string, t StorageType, selectorA, selectorB string) (*GenerationDiff, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+
+	gens, err := loadGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	a, err := selectGeneration(gens, selectorA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := selectGeneration(gens, selectorB)
+	if err != nil {
+		return nil, err
+	}
+	diff := &GenerationDiff{A: *a, B: *b}
+	err = diff.diffDirs(storage, ".", a.SHA256, b.SHA256)
+	return diff, err
+}
+
+func (d *GenerationDiff) diffDirs(storage IndexStorage, path string, hashA, hashB []byte) error {
+	if bytes.Equal(hashA, hashB) {
+		return nil
+	}
+	filesA, err := generationFiles(storage, path, hashA)
+	if err != nil {
+		return err
+	}
+	filesB, err := generationFiles(storage, path, hashB)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range filesA {
+		names = append(names, name)
+	}
+	for name := range filesB {
+		if filesA[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fa, fb := filesA[name], filesB[name]
+		filePath := filepath.Join(path, name)
+		var subA, subB []byte
+		if fa != nil && fa.IsDir {
+			subA = fa.SHA256
+		}
+		if fb != nil && fb.IsDir {
+			subB = fb.SHA256
+		}
+		if subA != nil || subB != nil {
+			err := d.diffDirs(storage, filePath, subA, subB)
+			if err != nil {
+				return err
+			}
+		}
+		fileA := fa != nil && !fa.IsDir
+		fileB := fb != nil && !fb.IsDir
+		switch {
+		case fileA && fileB:
+			if !bytes.Equal(fa.SHA256, fb.SHA256) {
+				d.Changed = append(d.Changed, filePath)
+			}
+		case fileA:
+			d.Removed = append(d.Removed, filePath)
+		case fileB:
+			d.Added = append(d.Added, filePath)
+		}
+	}
+	return nil
+}
+
+// generationFiles returns the existing files of a directory by name,
+// or no files if the directory doesn't exist in the generation.
+func generationFiles(storage IndexStorage, path string, hash []byte) (map[string]*FileSeal, error) {
+	files := map[string]*FileSeal{}
+	if hash == nil {
+		return files, nil
+	}
+	dir, err := loadDirSeal(storage, path, hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range dir.Files {
+		if f.exists() {
+			files[f.Name] = f
+		}
+	}
+	return files, nil
+}
+
+// Print writes the differences with colors for added,
+// removed and changed files.
+func (d *GenerationDiff) Print(w io.Writer) {
+	fmt.Fprintf(w, "generation %d (%s) to %d (%s)\n", d.A.Number, d.A.Time.Format("2006-01-02 15:04"),
+		d.B.Number, d.B.Time.Format("2006-01-02 15:04"))
+	for _, p := range d.Added {
+		fmt.Fprintln(w, color.GreenString("+ %s", p))
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintln(w, color.RedString("- %s", p))
+	}
+	for _, p := range d.Changed {
+		fmt.Fprintln(w, color.YellowString("~ %s", p))
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+}
@@ -0,0 +1,71 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerations(t *testing.T) {
+	SetupTestDir(t)
+	indexFile := filepath.Join(t.TempDir(), "index")
+	defer DropMemoryIndex(indexFile)
+	index := func() {
+		_, err := SealPath(TestDir, nil)
+		require.NoError(t, err)
+		require.NoError(t, IndexPath(TestDir, indexFile, StorageTypeMemory, nil, nil))
+	}
+	index()
+	index() // unchanged trees don't add generations
+
+	require.NoError(t, os.Remove(TestDir+"/sub/d.txt"))
+	randomFile(t, TestDir+"/sub/e.txt", 4)
+	randomFile(t, TestDir+"/a.txt", 5)
+	index()
+
+	gens, err := Generations(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(gens))
+	assert.Equal(t, 2, gens[1].Number)
+
+	paths := func(seals []StoredSeal) []string {
+		var out []string
+		for _, s := range seals {
+			out = append(out, s.Path)
+		}
+		return out
+	}
+	first, err := ShowGeneration(indexFile, StorageTypeMemory, "1", ".")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "sub/c.txt", "sub/d.txt"}, paths(first))
+	latest, err := ShowGeneration(indexFile, StorageTypeMemory, "", "sub")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub/c.txt", "sub/e.txt"}, paths(latest))
+
+	diff, err := DiffGenerations(indexFile, StorageTypeMemory, "1", "2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub/e.txt"}, diff.Added)
+	assert.Equal(t, []string{"sub/d.txt"}, diff.Removed)
+	assert.Equal(t, []string{"a.txt"}, diff.Changed)
+}
+
+func TestSelectGeneration(t *testing.T) {
+	gens := []Generation{
+		{Number: 1, Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)},
+		{Number: 2, Time: time.Date(2025, 2, 1, 0, 0, 0, 0, time.Local)},
+		{Number: 3, Time: time.Date(2025, 4, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for selector, number := range map[string]int{"": 3, "1": 1, "2025-03-01": 2, "2025-02-01": 2} {
+		gen, err := selectGeneration(gens, selector)
+		require.NoError(t, err, selector)
+		assert.Equal(t, number, gen.Number, selector)
+	}
+	for _, selector := range []string{"0", "4", "2024-12-31", "yesterday"} {
+		_, err := selectGeneration(gens, selector)
+		assert.Error(t, err, selector)
+	}
+}
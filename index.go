@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -29,48 +28,117 @@ var (
 	IndexProgressInterval = 15 * time.Second
 )
 
-func IndexPath(path, indexFile string, prefixes []string) error {
+func IndexPath(path, indexFile string, t StorageType, prefixes []string, opts *IndexOptions) error {
 	log.Printf("indexing %q with prefixes %q", path, prefixes)
 	start := time.Now()
-	dirs, err := indexDirectories(path, true, prefixes)
+	walk := walkOptions{Prefixes: prefixes, Before: Before}
+	if PrintIndexProgress {
+		walk.ProgressInterval = IndexProgressInterval
+	}
+	if opts != nil {
+		walk.OnEvent = opts.OnEvent
+	}
+	dirs, err := walkDirectories(path, true, walk)
 	if err != nil {
 		return errors.Wrap(err, "indexDirectories")
 	}
 	log.Println("loaded", len(dirs), "directories with seals in", time.Since(start))
 
+	// the indexed directory names the volume if no name is set
+	if opts == nil || opts.Volume == "" {
+		volume, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrap(err, "Abs")
+		}
+		withVolume := IndexOptions{}
+		if opts != nil {
+			withVolume = *opts
+		}
+		withVolume.Volume = volume
+		opts = &withVolume
+	}
+
 	start = time.Now()
-	err = DirsToIndex(indexFile, dirs, path, StorageTypeSQLite)
+	err = DirsToIndex(indexFile, dirs, path, t, opts)
 	if err != nil {
 		return errors.Wrap(err, "DirsToIndex")
 	}
 	log.Println("indexed", len(dirs), "directories in", time.Since(start))
+
+	root := filepath.Clean(path)
+	for _, dir := range dirs {
+		if dir.Path == root && dir.Seal != nil {
+			return errors.Wrap(recordGeneration(indexFile, t, dir.Seal, opts), "recordGeneration")
+		}
+	}
 	return nil
 }
 
+// recordGeneration adds a generation for the root seal to the index,
+// which is opened with the same options as for adding the seals.
+func recordGeneration(indexFile string, t StorageType, root *DirSeal, opts *IndexOptions) error {
+	storage, err := openStorage(t, indexFile, opts)
+	if err != nil {
+		return errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+	return addGeneration(storage, root, time.Now())
+}
+
+// walkOptions select the directories of a walk.
+type walkOptions struct {
+	// Prefixes limit the walk to relative path prefixes.
+	Prefixes []string
+	// Before skips directories that were sealed after this time.
+	Before time.Time
+	// ProgressInterval logs the progress of the walk if it is set.
+	ProgressInterval time.Duration
+	// OnEvent receives a PhaseChanged event when the walk starts.
+	OnEvent EventHandler
+	// FS is walked instead of the local file system if it is set.
+	FS fs.FS
+}
+
 // indexDirectories returns all subdirectories with info about their depth.
-// The deepest nested directories are sorted first.
+// The deepest nested directories are sorted first. Like ScanPath, it
+// takes Before and the progress from the package level variables used
+// by the command line, library code uses walkDirectories.
 func indexDirectories(dirPath string, loadSeals bool, prefixes []string) ([]Dir, error) {
-	info, err := os.Lstat(dirPath)
+	opts := walkOptions{Prefixes: prefixes, Before: Before}
+	if PrintIndexProgress {
+		opts.ProgressInterval = IndexProgressInterval
+	}
+	return walkDirectories(dirPath, loadSeals, opts)
+}
+
+// walkDirectories is indexDirectories with explicit options.
+func walkDirectories(dirPath string, loadSeals bool, opts walkOptions) ([]Dir, error) {
+	fsys := orOSFS(opts.FS)
+	info, err := fs.Stat(fsys, dirPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Lstat")
+		return nil, errors.Wrap(err, "Stat")
 	}
 	if !info.IsDir() {
 		return nil, fmt.Errorf("%q is not a directory", dirPath)
 	}
 
-	if !Before.IsZero() {
+	if !opts.Before.IsZero() {
 		loadSeals = true
 	}
+	if opts.OnEvent != nil {
+		opts.OnEvent(PhaseChanged{Phase: "walking"})
+	}
 
+	printProgress := opts.ProgressInterval > 0
 	var tick *time.Ticker
-	if PrintIndexProgress {
-		tick = time.NewTicker(IndexProgressInterval)
+	if printProgress {
+		tick = time.NewTicker(opts.ProgressInterval)
 		defer tick.Stop()
 	}
 
 	skipped := 0
 	out := []Dir{}
-	err = filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+	err = fs.WalkDir(fsys, dirPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			log.Println(color.YellowString("can't index %q: %v", path, err))
 			return nil
@@ -83,33 +151,33 @@ func indexDirectories(dirPath string, loadSeals bool, prefixes []string) ([]Dir,
 		if err != nil {
 			return errors.Wrap(err, "filepath.Rel")
 		}
-		if !isInPrefixes(relPath, prefixes) {
+		if !isInPrefixes(relPath, opts.Prefixes) {
 			return fs.SkipDir
 		}
 
 		var seal *DirSeal
 		if loadSeals {
-			seal, err = loadSeal(path)
+			seal, err = loadSealFS(fsys, path)
 			if seal == nil {
 				skipped++
 				return fs.SkipDir
 			}
 		}
-		if !Before.IsZero() {
-			if err == nil && seal.Sealed.After(Before) {
+		if !opts.Before.IsZero() {
+			if err == nil && seal.Sealed.After(opts.Before) {
 				skipped++
 				return fs.SkipDir
 			}
 		}
 
 		path = filepath.Clean(path)
-		parts := strings.Split(path, "/")
-		out = append(out, Dir{Path: path, Depth: len(parts), Seal: seal})
+		depth := pathDepth(path)
+		out = append(out, Dir{Path: path, Depth: depth, Seal: seal})
 
-		if PrintIndexProgress {
+		if printProgress {
 			select {
 			case <-tick.C:
-				log.Printf("indexing %q in depth %d", path, len(parts))
+				log.Printf("indexing %q in depth %d", path, depth)
 			default:
 			}
 		}
@@ -120,7 +188,7 @@ func indexDirectories(dirPath string, loadSeals bool, prefixes []string) ([]Dir,
 		return nil, errors.Wrap(err, "WalkDir")
 	}
 
-	if PrintIndexProgress {
+	if printProgress {
 		log.Println("indexed", len(out), "directories and skipped", skipped)
 	}
 
@@ -131,6 +199,15 @@ func indexDirectories(dirPath string, loadSeals bool, prefixes []string) ([]Dir,
 	return out, nil
 }
 
+// pathDepth returns the number of path elements, the
+// root "." of a file system has depth 0.
+func pathDepth(path string) int {
+	if path == "." {
+		return 0
+	}
+	return len(strings.Split(path, "/"))
+}
+
 func isInPrefixes(path string, prefixes []string) bool {
 	if len(prefixes) == 0 {
 		return true
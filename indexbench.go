@@ -1,9 +1,12 @@
 package seal
 
 import (
+	"fmt"
+	"io/fs"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
@@ -46,70 +49,72 @@ func indexBenchCmd() *cobra.Command {
 	return cmd
 }
 
-const (
-	benchIndexBolt   = "./benchindex_bolt.out"
-	benchIndexSqlite = "./benchindex_sqlite.out"
-	benchIndexPebble = "./benchindex_pebble.out"
+var (
+	benchStorageTypes = []StorageType{StorageTypeSQLite, StorageTypePebble}
+	benchFormats      = []RecordFormat{FormatJSON, FormatBinary}
 )
 
+func benchIndexPath(t StorageType, format RecordFormat) string {
+	return fmt.Sprintf("./benchindex_%s_%s.out", t, format)
+}
+
+// IndexBenchWrite writes the same generated directories to every
+// storage type in every record format, and reports write times
+// and the size of the index on disk.
 func IndexBenchWrite() error {
 	start := time.Now()
 	dirs := generateDirs(100e3)
 	log.Println("generated", len(dirs), "directories with seals in", time.Since(start))
 
-	start = time.Now()
-	indexFile := benchIndexBolt
-	err := os.Remove(indexFile)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
 	path := "basedir"
-	// err = DirsToIndex(indexFile, dirs, path, StorageTypeBoltDB)
-	took := time.Since(start)
-	// log.Println("indexed", len(dirs), "directories with seals in", took, "with", putOps, "writes")
-	// log.Printf("BoltDB %v average write time", time.Duration(float64(took)/float64(putOps)))
-	// if err != nil {
-	// 	return err
-	// }
-
-	putOps = 0
-
-	start = time.Now()
-	indexFile = benchIndexSqlite
-	err = os.Remove(indexFile)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	err = DirsToIndex(indexFile, dirs, path, StorageTypeSQLite)
-	took = time.Since(start)
-	log.Println("indexed", len(dirs), "directories with seals in", took, "with", putOps, "writes")
-	log.Printf("SQLite %v average write time", time.Duration(float64(took)/float64(putOps)))
-	if err != nil {
-		return err
-	}
-
-	putOps = 0
-
-	start = time.Now()
-	indexFile = benchIndexPebble
-	err = os.RemoveAll(indexFile)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+	for _, t := range benchStorageTypes {
+		for _, format := range benchFormats {
+			indexFile := benchIndexPath(t, format)
+			err := os.RemoveAll(indexFile)
+			if err != nil {
+				return err
+			}
+
+			putOps = 0
+			start = time.Now()
+			err = DirsToIndex(indexFile, dirs, path, t, &IndexOptions{Format: format})
+			took := time.Since(start)
+			if err != nil {
+				return err
+			}
+			size, err := diskSize(indexFile)
+			if err != nil {
+				return errors.Wrap(err, "diskSize")
+			}
+			log.Println("indexed", len(dirs), "directories with seals in", took, "with", putOps, "writes")
+			log.Printf("%s %s %v average write time, %s on disk", t, format,
+				time.Duration(float64(took)/float64(putOps)), formatBytes(size))
+		}
 	}
-
-	err = DirsToIndex(indexFile, dirs, path, StorageTypePebble)
-	took = time.Since(start)
-	log.Println("indexed", len(dirs), "directories with seals in", took, "with", putOps, "writes")
-	log.Printf("Pebble %v average write time", time.Duration(float64(took)/float64(putOps)))
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
+// diskSize returns the size of a file, or of all files
+// in a directory for storage types like Pebble.
+func diskSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randomString(length int) string {
@@ -196,28 +201,26 @@ func (g *dirGenerator) nextDir() {
 	g.toFill = append(g.toFill, g.current)
 }
 
+// IndexBenchRead reads all indices written by IndexBenchWrite
+// and reports the read throughput.
 func IndexBenchRead() error {
-	path := benchIndexSqlite
-	log.Println("loading", path, "index as SQLite")
-	PrintIndexProgress = true
-	start := time.Now()
-	index, err := LoadIndex(path, StorageTypeSQLite)
-	if err != nil {
-		return errors.Wrap(err, "LoadIndex SQLite")
+	for _, t := range benchStorageTypes {
+		for _, format := range benchFormats {
+			path := benchIndexPath(t, format)
+			log.Println("loading", path, "index as", t, format)
+			start := time.Now()
+			index, err := LoadIndex(path, t)
+			if err != nil {
+				return errors.Wrapf(err, "LoadIndex %s %s", t, format)
+			}
+			took := time.Since(start)
+			seals := 0
+			for _, group := range index.ByHash {
+				seals += len(group)
+			}
+			log.Printf("loading %d seals from %s %s took %v, %.0f seals/s",
+				seals, t, format, took, float64(seals)/took.Seconds())
+		}
 	}
-	took := time.Since(start)
-	log.Println("loading", len(index.ByHash), "hashes from SQLite took", took)
-
-	path = benchIndexPebble
-	log.Println("loading", path, "index as Pebble")
-	PrintIndexProgress = true
-	start = time.Now()
-	index, err = LoadIndex(path, StorageTypePebble)
-	if err != nil {
-		return errors.Wrap(err, "LoadIndex Pebble")
-	}
-	took = time.Since(start)
-	log.Println("loading", len(index.ByHash), "hashes from Pebble took", took)
-
 	return nil
 }
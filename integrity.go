@@ -0,0 +1,287 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const merkleRootMetaKey = "merkle_root"
+
+func indexCheckCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "checks the integrity of the index passed with --file",
+		Long: `Checks the checksums of all records and the order of the index, that
+the hashes of all directory seals match their files, that all files
+and directories in directory seals are in the index, and recomputes
+the Merkle root of the index. Writes to the index clear the stored
+root, the next check stores it again if everything else is fine.
+
+The checksums and the Merkle root are unkeyed, so they detect
+corruption of the index, not tampering: anyone who can edit the
+index can recompute both. Sign the seal files with seal --sign-key
+to detect changes by others.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if IndexFile == "" {
+				return errors.New("need an index file to check")
+			}
+			check, err := CheckIndex(IndexFile, StorageType(IndexStorageType))
+			if err != nil {
+				return err
+			}
+			check.Print(os.Stdout)
+			if !check.OK() {
+				return errors.New("index check failed")
+			}
+			return nil
+		},
+	}
+}
+
+// merkleTree builds a Merkle tree over leaves that are added in
+// order, only keeping one hash per level of the tree in memory.
+// Leaves and inner nodes use different prefixes like RFC 6962.
+type merkleTree struct {
+	levels [][]byte
+	leaves int
+}
+
+func (m *merkleTree) add(leaf []byte) {
+	m.leaves++
+	h := leaf
+	for level := 0; ; level++ {
+		if level == len(m.levels) {
+			m.levels = append(m.levels, h)
+			return
+		}
+		if m.levels[level] == nil {
+			m.levels[level] = h
+			return
+		}
+		h = merkleNode(m.levels[level], h)
+		m.levels[level] = nil
+	}
+}
+
+// root combines the remaining levels from the bottom up.
+// The root of an empty tree is the hash of nothing.
+func (m *merkleTree) root() []byte {
+	var root []byte
+	for _, h := range m.levels {
+		if h == nil {
+			continue
+		}
+		if root == nil {
+			root = h
+		} else {
+			root = merkleNode(h, root)
+		}
+	}
+	if root == nil {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return root
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// sealLeaf returns the Merkle leaf of a stored seal. It hashes the
+// binary encoding of the seal, so the root doesn't depend on the
+// storage type or record format of the index. The SHA256 of
+// directory seals covers their whole directory tree.
+func sealLeaf(s *StoredSeal) ([]byte, error) {
+	record, err := encodeRecord(FormatBinary, s)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(record)
+	return h.Sum(nil), nil
+}
+
+// merkleRoot computes the Merkle root over all seals of the index,
+// in the order of their hashes and paths.
+func merkleRoot(storage IndexStorage) ([]byte, error) {
+	tree := &merkleTree{}
+	it := IterateByHash(storage)
+	for it.Next() {
+		s := it.Seal()
+		leaf, err := sealLeaf(&s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sealLeaf %q", s.Path)
+		}
+		tree.add(leaf)
+	}
+	if it.Err() != nil {
+		return nil, errors.Wrap(it.Err(), "IterateByHash")
+	}
+	return tree.root(), nil
+}
+
+// markMerkleRootStale clears the stored Merkle root after a write.
+// The root covers the order of all seals, so it can't be updated
+// incrementally. Instead of reading the whole index on every write,
+// the next index check computes and stores it again.
+// It detects corruption, it doesn't protect against tampering.
+func markMerkleRootStale(storage IndexStorage) error {
+	return errors.Wrap(storage.SetMeta(merkleRootMetaKey, []byte{}), "SetMeta")
+}
+
+// IndexCheck is the result of checking an index.
+type IndexCheck struct {
+	Records int
+	Dirs    int
+
+	// OrderErrors are seals that weren't returned in hash and path order.
+	OrderErrors []string
+	// BadDirHashes are directory seals with a SHA256 that doesn't
+	// match their files.
+	BadDirHashes []string
+	// MissingSeals are files and directories of directory seals
+	// that aren't in the index.
+	MissingSeals []string
+
+	StoredRoot   []byte
+	ComputedRoot []byte
+	// RootUpdated is true if the index changed since the last
+	// check, and the computed root was stored.
+	RootUpdated bool
+}
+
+// OK is true if no problems were found.
+func (c *IndexCheck) OK() bool {
+	return len(c.OrderErrors) == 0 && len(c.BadDirHashes) == 0 &&
+		len(c.MissingSeals) == 0 && bytes.Equal(c.StoredRoot, c.ComputedRoot)
+}
+
+// CheckIndex reads all seals of the index, which checks the checksums
+// of all records, and validates the structure and the Merkle root.
+// Reading stops at the first record that can't be decoded. If the
+// index was written since the last check, the computed root is
+// stored when no other problems were found.
+func CheckIndex(indexPath string, t StorageType) (*IndexCheck, error) {
+	storage, err := openStorage(t, indexPath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "openStorage")
+	}
+	defer storage.Close()
+
+	check := &IndexCheck{}
+	check.StoredRoot, err = storage.GetMeta(merkleRootMetaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMeta")
+	}
+
+	tree := &merkleTree{}
+	stored := map[string]bool{}
+	var references []*StoredSeal
+	var last *StoredSeal
+	it := IterateByHash(storage)
+	for it.Next() {
+		s := it.Seal()
+		check.Records++
+		if last != nil {
+			c := bytes.Compare(last.hash(), s.hash())
+			if c > 0 || c == 0 && last.Path >= s.Path {
+				check.OrderErrors = append(check.OrderErrors, s.Path)
+			}
+		}
+		last = &s
+
+		leaf, err := sealLeaf(&s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sealLeaf %q", s.Path)
+		}
+		tree.add(leaf)
+		stored[string(hashKey(s.hash(), s.Path))] = true
+
+		if s.Dir == nil {
+			continue
+		}
+		check.Dirs++
+		if !dirHashMatches(s.Dir) {
+			check.BadDirHashes = append(check.BadDirHashes, s.Path)
+		}
+		for _, f := range s.Dir.Files {
+			if f.exists() {
+				references = append(references, &StoredSeal{Path: filepath.Join(s.Path, f.Name), File: f})
+			}
+		}
+	}
+	if it.Err() != nil {
+		return nil, errors.Wrap(it.Err(), "read index")
+	}
+	check.ComputedRoot = tree.root()
+
+	for _, r := range references {
+		if !stored[string(hashKey(r.hash(), r.Path))] {
+			check.MissingSeals = append(check.MissingSeals, r.Path)
+		}
+	}
+
+	if len(check.StoredRoot) == 0 && len(check.OrderErrors) == 0 &&
+		len(check.BadDirHashes) == 0 && len(check.MissingSeals) == 0 {
+		err = storage.SetMeta(merkleRootMetaKey, check.ComputedRoot)
+		if err != nil {
+			return nil, errors.Wrap(err, "SetMeta")
+		}
+		check.StoredRoot = check.ComputedRoot
+		check.RootUpdated = true
+	}
+	return check, nil
+}
+
+// dirHashMatches recomputes the hash of a directory seal
+// from its files, without changing the seal.
+func dirHashMatches(d *DirSeal) bool {
+	recomputed := *d
+	recomputed.Files = append([]*FileSeal{}, d.Files...)
+	err := recomputed.hash()
+	if err != nil {
+		log.Println(color.YellowString("can't hash seal %q: %v", d.Name, err))
+		return false
+	}
+	return bytes.Equal(recomputed.SHA256, d.SHA256)
+}
+
+// Print writes the problems found by the check.
+func (c *IndexCheck) Print(w io.Writer) {
+	fmt.Fprintf(w, "checked %d seals of %d directories\n", c.Records, c.Dirs)
+	for _, p := range c.OrderErrors {
+		fmt.Fprintln(w, color.RedString("out of order: %s", p))
+	}
+	for _, p := range c.BadDirHashes {
+		fmt.Fprintln(w, color.RedString("directory hash doesn't match its files: %s", p))
+	}
+	for _, p := range c.MissingSeals {
+		fmt.Fprintln(w, color.RedString("missing in the index: %s", p))
+	}
+	switch {
+	case c.RootUpdated:
+		fmt.Fprintln(w, color.GreenString("index changed since the last check, stored Merkle root %s", Base64(c.ComputedRoot)))
+	case len(c.StoredRoot) == 0:
+		fmt.Fprintln(w, color.YellowString("no Merkle root stored, computed %s", Base64(c.ComputedRoot)))
+	case !bytes.Equal(c.StoredRoot, c.ComputedRoot):
+		fmt.Fprintln(w, color.RedString("Merkle root %s doesn't match stored root %s",
+			Base64(c.ComputedRoot), Base64(c.StoredRoot)))
+	default:
+		fmt.Fprintln(w, color.GreenString("Merkle root %s matches", Base64(c.ComputedRoot)))
+	}
+}
@@ -0,0 +1,78 @@
+package seal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleTree(t *testing.T) {
+	empty := &merkleTree{}
+	assert.Equal(t, 32, len(empty.root()))
+
+	leaves := [][]byte{{1}, {2}, {3}}
+	tree := &merkleTree{}
+	for _, l := range leaves {
+		tree.add(l)
+	}
+	assert.Equal(t, merkleNode(merkleNode(leaves[0], leaves[1]), leaves[2]), tree.root())
+}
+
+func TestCheckIndex(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	indexFile := filepath.Join(t.TempDir(), "index")
+	defer DropMemoryIndex(indexFile)
+	require.NoError(t, IndexPath(TestDir, indexFile, StorageTypeMemory, nil, nil))
+
+	check, err := CheckIndex(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	assert.True(t, check.OK())
+	assert.True(t, check.RootUpdated)
+	assert.Equal(t, 2, check.Dirs)
+	assert.Equal(t, 5, check.Records)
+	check, err = CheckIndex(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	assert.True(t, check.OK())
+	assert.False(t, check.RootUpdated)
+
+	// change a file in the root seal without updating its hash
+	storage, err := OpenMemory(indexFile, nil)
+	require.NoError(t, err)
+	root, err := loadSeal(TestDir)
+	require.NoError(t, err)
+	root.Files[0].Size++
+	root.Files = root.Files[:1]
+	require.NoError(t, storage.AddSeals([]*StoredSeal{{Path: ".", Dir: root}}))
+
+	check, err = CheckIndex(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	assert.False(t, check.OK())
+	assert.Equal(t, []string{"."}, check.BadDirHashes)
+	assert.NotEqual(t, check.StoredRoot, check.ComputedRoot)
+
+	// corrupt the bytes of a record
+	for k, v := range storage.data.hashes {
+		v[len(v)-1]++
+		storage.data.hashes[k] = v
+		break
+	}
+	_, err = CheckIndex(indexFile, StorageTypeMemory)
+	assert.Error(t, err)
+}
+
+func TestCheckIndexMissingSeals(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	defer DropMemoryIndex(indexFile)
+	dirs := testIndexDirs()
+	require.NoError(t, DirsToIndex(indexFile, dirs[:1], "base", StorageTypeMemory, nil))
+
+	check, err := CheckIndex(indexFile, StorageTypeMemory)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub"}, check.MissingSeals)
+	assert.Empty(t, check.StoredRoot, "roots are only stored for good indices")
+	assert.False(t, check.RootUpdated)
+}
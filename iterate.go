@@ -0,0 +1,232 @@
+package seal
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// SealIterator iterates over stored seals in a fixed order.
+// Next has to be called before the first seal, and iteration
+// ends when it returns false. Err returns the error that
+// stopped the iteration, if there was one.
+type SealIterator interface {
+	Next() bool
+	Seal() StoredSeal
+	Err() error
+}
+
+// IterateByHash iterates over all seals of the storage ordered by hash
+// and path. Only one page of seals is kept in memory at a time.
+func IterateByHash(storage IndexStorage) SealIterator {
+	return &pageIterator{load: func(last *StoredSeal) ([]StoredSeal, error) {
+		var hash []byte
+		if last != nil {
+			hash = last.hash()
+		}
+		return storage.LoadAfterHash(hash, loadFromIndex)
+	}}
+}
+
+// IterateByPath iterates over all seals of the storage ordered by path
+// and hash. Only one page of seals is kept in memory at a time.
+func IterateByPath(storage IndexStorage) SealIterator {
+	return &pageIterator{load: func(last *StoredSeal) ([]StoredSeal, error) {
+		var path string
+		if last != nil {
+			path = last.Path
+		}
+		return storage.LoadAfterPath(path, loadFromIndex)
+	}}
+}
+
+// pageIterator loads the next page after the last seal of the
+// current page whenever the current page is used up.
+type pageIterator struct {
+	load func(last *StoredSeal) ([]StoredSeal, error)
+	page []StoredSeal
+	i    int
+	done bool
+	err  error
+}
+
+func (it *pageIterator) Next() bool {
+	if it.i+1 < len(it.page) {
+		it.i++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+
+	var last *StoredSeal
+	if len(it.page) > 0 {
+		last = &it.page[len(it.page)-1]
+	}
+	page, err := it.load(last)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if len(page) == 0 {
+		it.done = true
+		return false
+	}
+	it.page = page
+	it.i = 0
+	return true
+}
+
+func (it *pageIterator) Seal() StoredSeal {
+	return it.page[it.i]
+}
+
+func (it *pageIterator) Err() error {
+	return it.err
+}
+
+// sliceIterator iterates over seals that are already in memory.
+type sliceIterator struct {
+	seals []StoredSeal
+	i     int
+}
+
+func (it *sliceIterator) Next() bool {
+	it.i++
+	return it.i <= len(it.seals)
+}
+
+func (it *sliceIterator) Seal() StoredSeal {
+	return it.seals[it.i-1]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func sortByHash(seals []StoredSeal) {
+	sort.Slice(seals, func(i, j int) bool {
+		c := bytes.Compare(seals[i].hash(), seals[j].hash())
+		if c != 0 {
+			return c < 0
+		}
+		return seals[i].Path < seals[j].Path
+	})
+}
+
+func sortByPath(seals []StoredSeal) {
+	sort.Slice(seals, func(i, j int) bool {
+		if seals[i].Path != seals[j].Path {
+			return seals[i].Path < seals[j].Path
+		}
+		return bytes.Compare(seals[i].hash(), seals[j].hash()) < 0
+	})
+}
+
+// groupIterator reads groups of consecutive seals with the same key.
+type groupIterator struct {
+	it      SealIterator
+	key     func(s *StoredSeal) string
+	pending *StoredSeal
+	started bool
+}
+
+func hashGroups(it SealIterator) *groupIterator {
+	return &groupIterator{it: it, key: func(s *StoredSeal) string {
+		return string(s.hash())
+	}}
+}
+
+func pathGroups(it SealIterator) *groupIterator {
+	return &groupIterator{it: it, key: func(s *StoredSeal) string {
+		return s.Path
+	}}
+}
+
+// next returns the next group, or nil after the last group.
+func (g *groupIterator) next() ([]StoredSeal, error) {
+	if !g.started {
+		g.started = true
+		if g.it.Next() {
+			s := g.it.Seal()
+			g.pending = &s
+		}
+	}
+	if g.pending == nil {
+		return nil, g.it.Err()
+	}
+
+	group := []StoredSeal{*g.pending}
+	g.pending = nil
+	key := g.key(&group[0])
+	for g.it.Next() {
+		s := g.it.Seal()
+		if g.key(&s) != key {
+			g.pending = &s
+			break
+		}
+		group = append(group, s)
+	}
+	return group, g.it.Err()
+}
+
+// sealSource provides the seals of an index or a directory
+// tree ordered by hash or path.
+type sealSource interface {
+	iterateByHash() SealIterator
+	iterateByPath() SealIterator
+	Close() error
+}
+
+// storageSource streams seals from an index.
+type storageSource struct {
+	storage IndexStorage
+}
+
+func (s *storageSource) iterateByHash() SealIterator {
+	return IterateByHash(s.storage)
+}
+
+func (s *storageSource) iterateByPath() SealIterator {
+	return IterateByPath(s.storage)
+}
+
+func (s *storageSource) Close() error {
+	return s.storage.Close()
+}
+
+// sliceSource holds all seals of a directory tree in memory.
+type sliceSource struct {
+	seals []StoredSeal
+}
+
+func (s *sliceSource) iterateByHash() SealIterator {
+	sortByHash(s.seals)
+	return &sliceIterator{seals: s.seals}
+}
+
+func (s *sliceSource) iterateByPath() SealIterator {
+	sortByPath(s.seals)
+	return &sliceIterator{seals: s.seals}
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+// dirsSource turns directories with seals into a sliceSource
+// with paths relative to the base path.
+func dirsSource(dirs []Dir, basePath string) (*sliceSource, error) {
+	source := &sliceSource{}
+	for i := range dirs {
+		stored, err := storedSeals(&dirs[i], basePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "storedSeals")
+		}
+		for _, s := range stored {
+			source.seals = append(source.seals, *s)
+		}
+	}
+	return source, nil
+}
@@ -0,0 +1,204 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest holds the seals of all directories of a tree in one file,
+// by their path relative to the root. It is a WriteFS that only
+// contains the seal files of these directories, so that trees which
+// can't hold seal files, like archives and read only media, can be
+// sealed and verified against it.
+type Manifest struct {
+	// Root is the name of the sealed directory or archive.
+	Root   string
+	Sealed time.Time
+	Dirs   map[string]*DirSeal
+}
+
+// NewManifest returns an empty manifest.
+func NewManifest() *Manifest {
+	return &Manifest{Dirs: map[string]*DirSeal{}}
+}
+
+// LoadManifest loads a manifest file.
+func LoadManifest(manifestPath string) (*Manifest, error) {
+	buf, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+	m := NewManifest()
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+	if m.Dirs == nil {
+		m.Dirs = map[string]*DirSeal{}
+	}
+	return m, nil
+}
+
+// loadOrNewManifest loads a manifest file, or returns
+// an empty manifest if the file doesn't exist yet.
+func loadOrNewManifest(manifestPath string) (*Manifest, error) {
+	m, err := LoadManifest(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewManifest(), nil
+	}
+	return m, err
+}
+
+// Save writes the manifest file. It is written to a temporary file
+// first, so that an interrupted write doesn't lose the existing seals.
+func (m *Manifest) Save(manifestPath string) error {
+	m.Sealed = time.Now()
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+	tmpPath := manifestPath + ".tmp"
+	err = os.WriteFile(tmpPath, append(buf, '\n'), 0666)
+	if err != nil {
+		return errors.Wrap(err, "WriteFile")
+	}
+	return errors.Wrap(os.Rename(tmpPath, manifestPath), "Rename")
+}
+
+// Open opens the seal file of a directory.
+func (m *Manifest) Open(name string) (fs.File, error) {
+	seal, ok := m.Dirs[path.Dir(name)]
+	if !fs.ValidPath(name) || path.Base(name) != SealFile || !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	buf, err := json.Marshal(seal)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
+	}
+	e := &archiveEntry{name: SealFile, mode: 0644, size: int64(len(buf)), modTime: m.Sealed}
+	return e.open(bytes.NewReader(buf)), nil
+}
+
+// WriteFile stores the seal file of a directory.
+func (m *Manifest) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || path.Base(name) != SealFile {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	var seal DirSeal
+	err := json.Unmarshal(data, &seal)
+	if err != nil {
+		return errors.Wrap(err, "json.Unmarshal")
+	}
+	m.Dirs[path.Dir(name)] = &seal
+	return nil
+}
+
+// sidecarFS reads and writes seal files in seals instead of fsys,
+// all other files are read from fsys. If rootName is set, it is
+// used as the name of the root directory.
+type sidecarFS struct {
+	fsys     fs.FS
+	seals    fs.FS
+	rootName string
+}
+
+// renamedInfo is a FileInfo with a different name.
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (r renamedInfo) Name() string {
+	return r.name
+}
+
+func (s *sidecarFS) Open(name string) (fs.File, error) {
+	if path.Base(name) == SealFile {
+		return s.seals.Open(name)
+	}
+	return s.fsys.Open(name)
+}
+
+func (s *sidecarFS) Stat(name string) (fs.FileInfo, error) {
+	if path.Base(name) == SealFile {
+		return fs.Stat(s.seals, name)
+	}
+	info, err := fs.Stat(s.fsys, name)
+	if err == nil && name == "." && s.rootName != "" {
+		info = renamedInfo{FileInfo: info, name: s.rootName}
+	}
+	return info, err
+}
+
+func (s *sidecarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.fsys, name)
+}
+
+func (s *sidecarFS) WriteFile(name string, data []byte) error {
+	seals, ok := s.seals.(WriteFS)
+	if !ok || path.Base(name) != SealFile {
+		return errReadOnlyFS
+	}
+	return seals.WriteFile(name, data)
+}
+
+// manifestTreeFS returns the directory tree at dirPath with the seal
+// files of the manifest. The root keeps the name of the directory, so
+// that the seals match the seal files of the tree.
+func manifestTreeFS(dirPath string, m *Manifest) (*sidecarFS, error) {
+	abs, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Abs")
+	}
+	return &sidecarFS{fsys: DirFS(dirPath), seals: m, rootName: filepath.Base(abs)}, nil
+}
+
+// SealToManifest seals the directory tree at dirPath like Seal, but
+// stores the seals in the manifest file instead of seal files in every
+// directory. The paths of the returned directories are relative to
+// dirPath. An existing manifest is updated like seal files.
+func SealToManifest(dirPath, manifestPath string, opts SealOptions) ([]Dir, error) {
+	m, err := loadOrNewManifest(manifestPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "loadOrNewManifest")
+	}
+	fsys, err := manifestTreeFS(dirPath, m)
+	if err != nil {
+		return nil, err
+	}
+	opts.FS = fsys
+	dirs, err := NewSealer(opts).Seal(".")
+	if err != nil {
+		return nil, errors.Wrap(err, "Seal")
+	}
+
+	if opts.WriteLock != nil {
+		opts.WriteLock.Lock()
+		defer opts.WriteLock.Unlock()
+	}
+	m.Root = fsys.rootName
+	return dirs, errors.Wrap(m.Save(manifestPath), "Save")
+}
+
+// VerifyManifest verifies the directory tree at dirPath against the
+// seals in the manifest file. The paths of the returned directories
+// are relative to dirPath.
+func VerifyManifest(dirPath, manifestPath string, opts VerifyOptions) ([]Dir, error) {
+	m, err := LoadManifest(manifestPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadManifest")
+	}
+	fsys, err := manifestTreeFS(dirPath, m)
+	if err != nil {
+		return nil, err
+	}
+	opts.FS = fsys
+	return NewVerifier(opts).Verify(".")
+}
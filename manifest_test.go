@@ -0,0 +1,65 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealToManifest(t *testing.T) {
+	SetupTestDir(t)
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+
+	dirs, err := SealToManifest(TestDir, manifestPath, SealOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(dirs))
+	_, err = os.Stat(filepath.Join(TestDir, SealFile))
+	assert.True(t, os.IsNotExist(err), "no seal files in the tree")
+
+	m, err := LoadManifest(manifestPath)
+	require.NoError(t, err)
+	assert.Equal(t, "testdir", m.Root)
+	require.Contains(t, m.Dirs, ".")
+	require.Contains(t, m.Dirs, "sub")
+
+	// the manifest holds the same seals as seal files
+	_, err = SealPath(TestDir, nil)
+	require.NoError(t, err)
+	root, err := loadSeal(TestDir)
+	require.NoError(t, err)
+	assert.Equal(t, root.Name, m.Dirs["."].Name)
+	assert.Equal(t, root.SHA256, m.Dirs["."].SHA256)
+
+	dirs, err = VerifyManifest(TestDir, manifestPath, VerifyOptions{})
+	require.NoError(t, err)
+	for _, dir := range dirs {
+		assert.True(t, dir.HashDiff.Identical, dir.Path)
+	}
+
+	randomFile(t, TestDir+"/sub/c.txt", 5)
+	dirs, err = VerifyManifest(TestDir, manifestPath, VerifyOptions{})
+	require.NoError(t, err)
+	for _, dir := range dirs {
+		assert.Equal(t, dir.Path != "sub", dir.HashDiff.Identical, dir.Path)
+	}
+
+	// sealing again keeps the old version in the manifest
+	_, err = SealToManifest(TestDir, manifestPath, SealOptions{})
+	require.NoError(t, err)
+	m, err = LoadManifest(manifestPath)
+	require.NoError(t, err)
+	oldVersions := 0
+	for _, f := range m.Dirs["sub"].Files {
+		if f.OldVersion {
+			oldVersions++
+			assert.Equal(t, "c.txt", f.Name)
+		}
+	}
+	assert.Equal(t, 1, oldVersions)
+
+	_, err = VerifyManifest(TestDir, filepath.Join(t.TempDir(), "missing.json"), VerifyOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,370 @@
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Actions of a PlanStep.
+const (
+	PlanCopy   = "copy"
+	PlanDelete = "delete"
+	PlanLink   = "link"
+)
+
+// Formats in which a plan can be written.
+const (
+	PlanFormatJSON  = "json"
+	PlanFormatShell = "shell"
+	PlanFormatRsync = "rsync"
+)
+
+// Plan is an ordered list of file operations. Copies read from
+// the source root and write to the target root, all other
+// steps only work in the target root.
+type Plan struct {
+	SourceRoot string `json:",omitempty"`
+	TargetRoot string `json:",omitempty"`
+	Steps      []PlanStep
+}
+
+// PlanStep is a single file operation. Path is relative to the
+// roots of the plan. For links, Source is the path of the file
+// that Path gets linked to. SHA256 is the expected hash of the
+// file, it is checked before deleting or linking and after copying.
+type PlanStep struct {
+	Action string
+	Path   string
+	Source string `json:",omitempty"`
+	IsDir  bool   `json:",omitempty"`
+	Size   int64
+	SHA256 []byte
+}
+
+// WritePlanFile writes the plan to a file in the given format.
+func WritePlanFile(planFile string, plan *Plan, format string) error {
+	f, err := os.Create(planFile)
+	if err != nil {
+		return errors.Wrap(err, "Create")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = WritePlan(w, plan, format)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Flush")
+	}
+	return f.Close()
+}
+
+// WritePlan writes the plan as JSON, as a shell script, or as a
+// list of copied files for the --files-from option of rsync.
+func WritePlan(w io.Writer, plan *Plan, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return errors.Wrap(enc.Encode(plan), "Encode")
+	case PlanFormatShell:
+		writeShellPlan(w, plan)
+		return nil
+	case PlanFormatRsync:
+		for _, step := range plan.Steps {
+			if step.Action != PlanCopy {
+				return errors.Errorf("rsync plans can only copy, not %s %q", step.Action, step.Path)
+			}
+			fmt.Fprintln(w, step.Path)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown plan format %q", format)
+	}
+}
+
+func writeShellPlan(w io.Writer, plan *Plan) {
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "# plan created by seal")
+	if plan.TargetRoot == "" {
+		fmt.Fprintln(w, "# paths are relative to the target directory")
+	}
+	fmt.Fprintln(w, "set -e")
+	fmt.Fprintln(w)
+
+	for _, step := range plan.Steps {
+		target := shellQuote(filepath.Join(plan.TargetRoot, step.Path))
+		switch step.Action {
+		case PlanCopy:
+			fmt.Fprintf(w, "mkdir -p -- %s\n", shellQuote(filepath.Dir(filepath.Join(plan.TargetRoot, step.Path))))
+			fmt.Fprintf(w, "cp -p -- %s %s\n", shellQuote(filepath.Join(plan.SourceRoot, step.Path)), target)
+		case PlanDelete:
+			if step.IsDir {
+				fmt.Fprintf(w, "rm -rf -- %s\n", target)
+			} else {
+				fmt.Fprintf(w, "rm -f -- %s\n", target)
+			}
+		case PlanLink:
+			fmt.Fprintf(w, "ln -f -- %s %s\n", shellQuote(filepath.Join(plan.TargetRoot, step.Source)), target)
+		}
+	}
+}
+
+// ReadPlanFile reads a plan in JSON format.
+func ReadPlanFile(planFile string) (*Plan, error) {
+	f, err := os.Open(planFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open")
+	}
+	defer f.Close()
+
+	var plan Plan
+	err = json.NewDecoder(f).Decode(&plan)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Decode")
+	}
+	return &plan, nil
+}
+
+func applyPlanCmd() *cobra.Command {
+	var sourceRoot, targetRoot string
+	var opts ApplyOptions
+	cmd := &cobra.Command{
+		Use:   "apply-plan PLAN",
+		Short: "executes a JSON plan and verifies all copied files",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one plan file to apply")
+			}
+			plan, err := ReadPlanFile(args[0])
+			if err != nil {
+				return errors.Wrap(err, "ReadPlanFile")
+			}
+			if sourceRoot != "" {
+				plan.SourceRoot = sourceRoot
+			}
+			if targetRoot != "" {
+				plan.TargetRoot = targetRoot
+			}
+			start := time.Now()
+			err = ApplyPlan(plan, opts)
+			log.Println("ran for", time.Since(start))
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&sourceRoot, "source-root", "", "directory that files are copied from, overrides the plan")
+	cmd.Flags().StringVar(&targetRoot, "target-root", "", "directory that files are copied to, overrides the plan")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "only print the steps of the plan")
+	cmd.Flags().BoolVar(&opts.AllowUnhashed, "allow-unhashed", false, "delete and link files without a SHA256 in the plan, like from quick scans")
+	return cmd
+}
+
+// ApplyOptions configure ApplyPlan.
+type ApplyOptions struct {
+	// DryRun only logs the steps.
+	DryRun bool
+	// AllowUnhashed runs delete and link steps without a SHA256,
+	// which are refused otherwise.
+	AllowUnhashed bool
+}
+
+// ApplyPlan executes all steps of the plan. The plan is checked
+// before any step runs. Failed steps are logged and don't stop the
+// following steps from running.
+func ApplyPlan(plan *Plan, opts ApplyOptions) error {
+	if plan.TargetRoot == "" {
+		return errors.New("plan has no target root")
+	}
+	for _, step := range plan.Steps {
+		err := checkStep(step, opts)
+		if err != nil {
+			return errors.Wrapf(err, "%s %q", step.Action, step.Path)
+		}
+	}
+	failed := 0
+	for _, step := range plan.Steps {
+		if opts.DryRun {
+			log.Println(step.Action, step.Path)
+			continue
+		}
+		err := applyStep(plan, step)
+		if err != nil {
+			failed++
+			log.Println(color.RedString("can't %s %q: %v", step.Action, step.Path, err))
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d steps failed", failed, len(plan.Steps))
+	}
+	log.Println("applied", len(plan.Steps), "steps")
+	return nil
+}
+
+// checkStep returns an error if the step works outside of the
+// roots of the plan, or would delete or link unverified files.
+func checkStep(step PlanStep, opts ApplyOptions) error {
+	if !fs.ValidPath(step.Path) || step.Path == "." {
+		return errors.New("path isn't a relative path in the root")
+	}
+	if step.Action == PlanLink && (!fs.ValidPath(step.Source) || step.Source == ".") {
+		return errors.Errorf("link source %q isn't a relative path in the root", step.Source)
+	}
+	if len(step.SHA256) == 0 && !opts.AllowUnhashed && (step.Action == PlanDelete || step.Action == PlanLink) {
+		return errors.New("step has no SHA256, it can only run with --allow-unhashed")
+	}
+	return nil
+}
+
+func applyStep(plan *Plan, step PlanStep) error {
+	target := filepath.Join(plan.TargetRoot, filepath.FromSlash(step.Path))
+	switch step.Action {
+	case PlanCopy:
+		if plan.SourceRoot == "" {
+			return errors.New("plan has no source root")
+		}
+		return copyVerified(filepath.Join(plan.SourceRoot, filepath.FromSlash(step.Path)), target, step.SHA256)
+	case PlanDelete:
+		if step.IsDir {
+			err := checkDirHash(target, step.SHA256)
+			if err != nil {
+				return err
+			}
+			return errors.Wrap(os.RemoveAll(target), "RemoveAll")
+		}
+		err := checkFileHash(target, step.SHA256)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(os.Remove(target), "Remove")
+	case PlanLink:
+		source := filepath.Join(plan.TargetRoot, filepath.FromSlash(step.Source))
+		err := checkFileHash(source, step.SHA256)
+		if err != nil {
+			return err
+		}
+		err = checkFileHash(target, step.SHA256)
+		if err != nil {
+			return err
+		}
+		tmp := target + ".seal-link"
+		err = os.Link(source, tmp)
+		if err != nil {
+			return errors.Wrap(err, "Link")
+		}
+		return errors.Wrap(os.Rename(tmp, target), "Rename")
+	default:
+		return errors.Errorf("unknown action %q", step.Action)
+	}
+}
+
+// copyVerified copies a file with its modification time and checks
+// the hash of the written file before moving it to the target path.
+func copyVerified(source, target string, hash []byte) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return errors.Wrap(err, "Stat")
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return errors.Wrap(err, "MkdirAll")
+	}
+
+	tmp := target + ".seal-copy"
+	err = copyFile(source, tmp, info.Mode().Perm())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = checkFileHash(tmp, hash)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Chtimes")
+	}
+	return errors.Wrap(os.Rename(tmp, target), "Rename")
+}
+
+func copyFile(source, target string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return errors.Wrap(err, "Open")
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Wrap(err, "Create")
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return errors.Wrap(err, "Copy")
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return errors.Wrap(err, "Sync")
+	}
+	return errors.Wrap(out.Close(), "Close")
+}
+
+// checkFileHash hashes the file and compares it to the expected hash.
+// Nothing is checked if no hash is expected.
+func checkFileHash(filePath string, hash []byte) error {
+	if len(hash) == 0 {
+		return nil
+	}
+	have, err := hashFile(filePath)
+	if err != nil {
+		return errors.Wrap(err, "hashFile")
+	}
+	if !bytes.Equal(have, hash) {
+		return errors.Errorf("SHA256 of %q doesn't match", filePath)
+	}
+	return nil
+}
+
+// checkDirHash compares the hash in the seal file of the directory
+// to the expected hash, and verifies all files of the directory tree
+// against its seal files, so that the hash matches the contents.
+// Nothing is checked if no hash is expected.
+func checkDirHash(dirPath string, hash []byte) error {
+	if len(hash) == 0 {
+		return nil
+	}
+	seal, err := loadSeal(dirPath)
+	if err != nil {
+		return errors.Wrap(err, "loadSeal")
+	}
+	if !bytes.Equal(seal.SHA256, hash) {
+		return errors.Errorf("SHA256 of %q doesn't match", dirPath)
+	}
+	dirs, err := NewVerifier(VerifyOptions{}).Verify(dirPath)
+	if err != nil {
+		return errors.Wrap(err, "Verify")
+	}
+	for _, dir := range dirs {
+		if !dir.HashDiff.Identical {
+			return errors.Errorf("%q doesn't match its seal", dir.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package seal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncPlan(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+
+	target := t.TempDir()
+	randomFile(t, filepath.Join(target, "a.txt"), 9)     // outdated
+	randomFile(t, filepath.Join(target, "extra.txt"), 1) // only in target
+
+	source := CompareSource{Path: TestDir, Type: SourceSeals}
+	backup := CompareSource{Path: target, Type: SourceScan}
+	report, err := Compare(source, backup, CompareOptions{Plan: true, PlanDelete: true})
+	require.NoError(t, err)
+	assert.Equal(t, []CoverageFile{{Path: "extra.txt", Size: 2656, OtherPath: "a.txt"}}, report.BInA.MovedFiles)
+
+	plan := report.Plan
+	assert.Equal(t, TestDir, plan.SourceRoot)
+	assert.Equal(t, target, plan.TargetRoot)
+	require.Equal(t, 4, len(plan.Steps))
+	assert.Equal(t, PlanStep{Action: PlanCopy, Path: "a.txt", Size: 2656, SHA256: plan.Steps[0].SHA256}, plan.Steps[0])
+	assert.Equal(t, "sub/c.txt", plan.Steps[1].Path)
+	assert.Equal(t, "sub/d.txt", plan.Steps[2].Path)
+	assert.Equal(t, PlanDelete, plan.Steps[3].Action)
+	assert.Equal(t, "extra.txt", plan.Steps[3].Path)
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	require.NoError(t, WritePlanFile(planFile, plan, PlanFormatJSON))
+	plan, err = ReadPlanFile(planFile)
+	require.NoError(t, err)
+	require.NoError(t, ApplyPlan(plan, ApplyOptions{}))
+
+	report, err = Compare(source, backup, CompareOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, CoverageCount{Files: 3, Bytes: 7968}, report.AInB.SamePath)
+	assert.Equal(t, CoverageCount{Files: 3, Bytes: 7968}, report.BInA.SamePath)
+	assert.True(t, report.AInB.Complete())
+	assert.True(t, report.BInA.Complete())
+}
+
+func TestApplyPlanChecksHashes(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	seal, err := loadSeal(TestDir + "/sub")
+	require.NoError(t, err)
+
+	// the file changed after the plan was created
+	randomFile(t, TestDir+"/sub/d.txt", 7)
+	plan := &Plan{
+		TargetRoot: TestDir,
+		Steps: []PlanStep{{
+			Action: PlanDelete,
+			Path:   "sub/d.txt",
+			SHA256: seal.Files[1].SHA256,
+		}},
+	}
+	assert.Error(t, ApplyPlan(plan, ApplyOptions{}))
+	_, err = os.Stat(TestDir + "/sub/d.txt")
+	assert.NoError(t, err)
+}
+
+func TestDupesPlan(t *testing.T) {
+	setupDupesTestDir(t)
+
+	report, err := DupesFromPaths([]string{TestDir}, nil)
+	require.NoError(t, err)
+	plan := report.Plan("hardlink")
+	require.NoError(t, absolutePlan(plan))
+	assert.Equal(t, 3, len(plan.Steps))
+	require.NoError(t, ApplyPlan(plan, ApplyOptions{}))
+
+	a, err := os.Stat(TestDir + "/a.txt")
+	require.NoError(t, err)
+	e, err := os.Stat(TestDir + "/e.txt")
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(a, e))
+}
+
+func TestApplyPlanChecksSteps(t *testing.T) {
+	SetupTestDir(t)
+	_, err := SealPath(TestDir, nil)
+	require.NoError(t, err)
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	randomFile(t, outside, 1)
+	a, err := hashFile(outside)
+	require.NoError(t, err)
+
+	// edited plans can't reach outside of the target root
+	for _, step := range []PlanStep{
+		{Action: PlanDelete, Path: "../" + filepath.Base(outside), SHA256: a},
+		{Action: PlanDelete, Path: outside, SHA256: a},
+		{Action: PlanDelete, Path: ".", IsDir: true, SHA256: a},
+		{Action: PlanLink, Path: "a.txt", Source: "../outside.txt", SHA256: a},
+	} {
+		plan := &Plan{TargetRoot: filepath.Join(TestDir, "sub"), Steps: []PlanStep{step}}
+		assert.Error(t, ApplyPlan(plan, ApplyOptions{}), step.Path)
+	}
+	_, err = os.Stat(outside)
+	assert.NoError(t, err)
+
+	// steps without hashes only run when they are allowed
+	plan := &Plan{TargetRoot: TestDir, Steps: []PlanStep{{Action: PlanDelete, Path: "a.txt"}}}
+	assert.Error(t, ApplyPlan(plan, ApplyOptions{}))
+	_, err = os.Stat(TestDir + "/a.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, ApplyPlan(plan, ApplyOptions{AllowUnhashed: true}))
+
+	// directories are verified before they are deleted
+	seal, err := loadSeal(TestDir + "/sub")
+	require.NoError(t, err)
+	randomFile(t, TestDir+"/sub/d.txt", 7)
+	plan = &Plan{TargetRoot: TestDir, Steps: []PlanStep{{Action: PlanDelete, Path: "sub", IsDir: true, SHA256: seal.SHA256}}}
+	assert.Error(t, ApplyPlan(plan, ApplyOptions{}))
+	_, err = os.Stat(TestDir + "/sub/d.txt")
+	assert.NoError(t, err)
+	randomFile(t, TestDir+"/sub/d.txt", 3)
+	assert.NoError(t, ApplyPlan(plan, ApplyOptions{}))
+	_, err = os.Stat(TestDir + "/sub")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,153 @@
+package seal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// IsTerminal reports if the file is an interactive terminal.
+func IsTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// progressLineWidth limits the status line, so that it
+// fits on one line of most terminals.
+const progressLineWidth = 120
+
+// ProgressUI shows the progress of a Sealer or Verifier in a status
+// line that is redrawn in place on a terminal. Pass its Handle method
+// as the OnEvent option.
+type ProgressUI struct {
+	out     io.Writer
+	tracker ProgressTracker
+
+	mu     sync.Mutex
+	logOut io.Writer
+	shown  bool
+}
+
+// NewProgressUI returns a ProgressUI that draws to out,
+// which should be a terminal.
+func NewProgressUI(out io.Writer) *ProgressUI {
+	return &ProgressUI{out: out}
+}
+
+// Handle adds an event to the displayed progress.
+func (u *ProgressUI) Handle(e Event) {
+	u.tracker.Handle(e)
+}
+
+// Start redraws the status line at every interval until stop is
+// called. While it runs, log output is printed above the status line.
+func (u *ProgressUI) Start(interval time.Duration) (stop func()) {
+	u.mu.Lock()
+	u.logOut = log.Writer()
+	u.mu.Unlock()
+	log.SetOutput(u)
+
+	tick := time.NewTicker(interval)
+	done := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-tick.C:
+				u.draw()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		tick.Stop()
+		close(done)
+		<-finished
+
+		u.mu.Lock()
+		u.clear()
+		fmt.Fprintln(u.out, u.status())
+		u.shown = false
+		logOut := u.logOut
+		u.mu.Unlock()
+		log.SetOutput(logOut)
+	}
+}
+
+// Write writes log output above the status line.
+func (u *ProgressUI) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.clear()
+	n, err := u.logOut.Write(p)
+	u.redraw()
+	return n, err
+}
+
+func (u *ProgressUI) draw() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.clear()
+	u.redraw()
+}
+
+// clear removes the status line, the caller holds the lock.
+func (u *ProgressUI) clear() {
+	if u.shown {
+		fmt.Fprint(u.out, "\r\x1b[2K")
+		u.shown = false
+	}
+}
+
+// redraw prints the status line, the caller holds the lock.
+func (u *ProgressUI) redraw() {
+	fmt.Fprint(u.out, u.status())
+	u.shown = true
+}
+
+// status formats the progress as one line.
+func (u *ProgressUI) status() string {
+	p := u.tracker.Snapshot()
+	parts := []string{fmt.Sprintf("%s %5.1f%%", p.Phase, p.Done()*100)}
+	if p.Bytes > 0 {
+		parts = append(parts, fmt.Sprintf("%s / %s", formatBytes(p.BytesDone), formatBytes(p.Bytes)))
+	}
+	if p.BytesDone > 0 {
+		parts = append(parts, formatBytes(int64(p.BytesPerSecond))+"/s")
+	}
+	if p.ETA > 0 {
+		parts = append(parts, "ETA "+formatETA(p.ETA))
+	}
+	parts = append(parts, fmt.Sprintf("dirs %d/%d", p.DirsDone, p.Dirs))
+	if p.Diffs > 0 {
+		parts = append(parts, fmt.Sprintf("diffs %d", p.Diffs))
+	}
+	line := strings.Join(parts, "  ")
+
+	// shorten the current file from the left to fit the line, by
+	// runes so that multi-byte characters aren't cut in half
+	room := progressLineWidth - len(line) - 2
+	file := []rune(p.File)
+	if room < 4 {
+		return line
+	}
+	if len(file) > room {
+		file = append([]rune("..."), file[len(file)-room+3:]...)
+	}
+	return line + "  " + string(file)
+}
+
+// formatETA formats a remaining time in whole seconds.
+func formatETA(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
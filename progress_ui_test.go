@@ -0,0 +1,52 @@
+package seal
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressUI(t *testing.T) {
+	out := &bytes.Buffer{}
+	ui := NewProgressUI(out)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ui.tracker.now = func() time.Time { return now }
+
+	ui.Handle(PhaseChanged{Phase: "hashing", Dirs: 1, Bytes: 4 << 30})
+	ui.Handle(FileStarted{Path: "dir/" + strings.Repeat("x", 200)})
+	ui.Handle(HashProgress{Bytes: 1 << 30})
+	now = now.Add(10 * time.Second)
+	ui.Handle(DiffFound{})
+
+	status := ui.status()
+	assert.Contains(t, status, "hashing  25.0%")
+	assert.Contains(t, status, "1.0 GiB / 4.0 GiB")
+	assert.Contains(t, status, "102.4 MiB/s")
+	assert.Contains(t, status, "ETA 30s")
+	assert.Contains(t, status, "diffs 1")
+	assert.Contains(t, status, "...xxx")
+	assert.Equal(t, progressLineWidth, len(status))
+
+	ui.Handle(FileStarted{Path: "dir/" + strings.Repeat("ü", 200)})
+	wide := ui.status()
+	assert.True(t, utf8.ValidString(wide))
+	assert.Equal(t, progressLineWidth, utf8.RuneCountInString(wide))
+	ui.Handle(FileStarted{Path: "dir/" + strings.Repeat("x", 200)})
+
+	// log lines are printed above the status line
+	defer log.SetOutput(log.Writer())
+	logOut := &bytes.Buffer{}
+	log.SetOutput(logOut)
+	stop := ui.Start(time.Hour)
+	ui.draw()
+	log.Print("hello")
+	stop()
+	assert.Contains(t, logOut.String(), "hello")
+	assert.Equal(t, logOut, log.Writer())
+	assert.True(t, strings.HasPrefix(out.String(), status+"\r\x1b[2K"+status+"\r\x1b[2K"+status+"\n"))
+}
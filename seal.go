@@ -1,13 +1,14 @@
 package seal
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/json"
 	"io"
 	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
 	"sync"
 	"time"
 
@@ -16,12 +17,10 @@ import (
 )
 
 var (
+	// PrintSealing and PrintAllSealing configure the
+	// Sealer that is used by SealPath.
 	PrintSealing    = false
 	PrintAllSealing = false
-	sealingMeta     sync.Mutex
-	sealingFile     string
-	dirsCount       int
-	dirsDone        int
 
 	filesToIgnore = map[string]bool{
 		SealFile:    true,
@@ -29,75 +28,276 @@ var (
 	}
 )
 
+// SealOptions configure a Sealer. The zero value seals
+// all directories without logging the progress.
+type SealOptions struct {
+	// Prefixes limit sealing to directories with these relative path prefixes.
+	Prefixes []string
+	// Before skips directories that were sealed after this time.
+	Before time.Time
+	// FS is the file system that is sealed, directory paths are names
+	// in it. Seal writes seal files and needs a WriteFS, Scan works
+	// with any fs.FS. The local file system is used if it is nil.
+	FS fs.FS
+
+	// PrintProgress logs the progress every ProgressInterval,
+	// PrintAll logs every directory that is sealed.
+	PrintProgress    bool
+	PrintAll         bool
+	ProgressInterval time.Duration
+	// PrintChanges logs missing and changed files
+	// when seal files are updated.
+	PrintChanges bool
+
+	// WriteLock is held while seal files are written, if it is set.
+	WriteLock sync.Locker
+	// SigningKey signs the written seals, if it is set.
+	SigningKey ed25519.PrivateKey
+
+	// OnEvent receives the progress events, if it is set.
+	OnEvent EventHandler
+}
+
+// Sealer seals directory trees. It owns the progress and counters of
+// its runs, so that different Sealers can run at the same time.
+type Sealer struct {
+	opts     SealOptions
+	fsys     fs.FS
+	progress *progress
+}
+
+// NewSealer returns a Sealer that uses the options.
+func NewSealer(opts SealOptions) *Sealer {
+	return &Sealer{opts: opts, fsys: orOSFS(opts.FS), progress: newProgress()}
+}
+
+// progress is the state of a running seal or verification.
+// The tracker is updated by the events of the Sealer.
+type progress struct {
+	tracker ProgressTracker
+
+	mu              sync.Mutex
+	file            string
+	nonRegularFiles map[os.FileMode]int
+}
+
+func newProgress() *progress {
+	return &progress{nonRegularFiles: map[os.FileMode]int{}}
+}
+
+func (p *progress) setFile(file string) {
+	p.mu.Lock()
+	p.file = file
+	p.mu.Unlock()
+}
+
+func (p *progress) skipped(mode os.FileMode) {
+	p.mu.Lock()
+	p.nonRegularFiles[mode]++
+	p.mu.Unlock()
+}
+
+// logEvery logs the progress at every interval until stop is called.
+func (p *progress) logEvery(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-tick.C:
+				s := p.tracker.Snapshot()
+				p.mu.Lock()
+				file := p.file
+				p.mu.Unlock()
+				if s.BytesDone > 0 {
+					log.Printf("%.1f%% done, %s/s, ETA %s, %s %s", s.Done()*100, formatBytes(int64(s.BytesPerSecond)),
+						formatETA(s.ETA), s.Phase, file)
+				} else {
+					log.Printf("%.1f%% done, %s %s", s.Done()*100, s.Phase, file)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		tick.Stop()
+		close(done)
+	}
+}
+
+// logSkipped logs the counts of skipped non regular files.
+func (p *progress) logSkipped() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nonRegularFiles) > 0 {
+		log.Println("skipped non regular files:")
+		for mode, count := range p.nonRegularFiles {
+			log.Println(mode.String(), count)
+		}
+	}
+}
+
+// NonRegularFiles returns how many files of each non regular
+// type were skipped by the Sealer.
+func (s *Sealer) NonRegularFiles() map[os.FileMode]int {
+	p := s.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := map[os.FileMode]int{}
+	for mode, count := range p.nonRegularFiles {
+		out[mode] = count
+	}
+	return out
+}
+
+// emit updates the progress with the event and passes it on.
+func (s *Sealer) emit(e Event) {
+	s.progress.tracker.Handle(e)
+	if s.opts.OnEvent != nil {
+		s.opts.OnEvent(e)
+	}
+}
+
+// Progress returns the progress of the current phase.
+func (s *Sealer) Progress() Progress {
+	return s.progress.tracker.Snapshot()
+}
+
+// walk returns the directories below dirPath that match the options.
+func (s *Sealer) walk(dirPath string, loadSeals bool) ([]Dir, error) {
+	opts := walkOptions{
+		Prefixes: s.opts.Prefixes,
+		Before:   s.opts.Before,
+		FS:       s.fsys,
+		OnEvent:  s.opts.OnEvent,
+	}
+	if s.opts.PrintProgress {
+		opts.ProgressInterval = s.opts.ProgressInterval
+	}
+	return walkDirectories(dirPath, loadSeals, opts)
+}
+
 // SealPath calculates seals for the given path and all subdirectories
 // and writes them into a seal JSON file per directory.
 func SealPath(dirPath string, prefixes []string) ([]Dir, error) {
-	if PrintSealing {
+	return NewSealer(SealOptions{
+		Prefixes:         prefixes,
+		Before:           Before,
+		PrintProgress:    PrintSealing,
+		PrintAll:         PrintAllSealing,
+		ProgressInterval: PrintInterval,
+		PrintChanges:     PrintSealing,
+		WriteLock:        &WriteLock,
+	}).Seal(dirPath)
+}
+
+// Seal calculates seals for the given path and all subdirectories
+// and writes them into a seal JSON file per directory.
+func (s *Sealer) Seal(dirPath string) ([]Dir, error) {
+	if _, ok := s.fsys.(WriteFS); !ok {
+		return nil, errReadOnlyFS
+	}
+	if s.opts.PrintProgress {
 		log.Println("indexing", dirPath)
 	}
 	loadSeals := false
-	dirs, err := indexDirectories(dirPath, loadSeals, prefixes)
+	dirs, err := s.walk(dirPath, loadSeals)
 	if err != nil {
 		return nil, errors.Wrap(err, "indexDirectories")
 	}
 
-	dirsCount = len(dirs)
-
-	if PrintSealing {
-		tick := time.NewTicker(PrintInterval)
-		defer tick.Stop()
-		stop := make(chan bool)
-		go func() {
-			for {
-				select {
-				case <-tick.C:
-					sealingMeta.Lock()
-					log.Printf("%.1f%% done, sealing %s", float64(dirsDone)/float64(dirsCount)*100, sealingFile)
-					sealingMeta.Unlock()
-				case <-stop:
-					return
-				}
-			}
-		}()
+	var total int64
+	for _, dir := range dirs {
+		total += dirFileBytes(s.fsys, dir.Path)
+	}
+	s.emit(PhaseChanged{Phase: "sealing", Dirs: len(dirs), Bytes: total})
+	if s.opts.PrintProgress {
+		stop := s.progress.logEvery(s.opts.ProgressInterval)
+		defer stop()
 	}
 
-	for _, dir := range dirs {
-		if PrintAllSealing {
+	for i, dir := range dirs {
+		if s.opts.PrintAll {
 			log.Println("sealing", dir.Path)
 		}
+		s.emit(DirStarted{Path: dir.Path})
 		hash := true
-		seal, err := sealDir(dir.Path, hash)
+		seal, err := s.sealDir(dir.Path, hash)
 		if err != nil {
 			return nil, errors.Wrapf(err, "sealDir %q", dir.Path)
 		}
 
-		dir.Seal = seal
+		dirs[i].Seal = seal
 
-		err = seal.UpdateSeal(dir.Path, PrintSealing)
+		err = seal.updateSeal(s.fsys, dir.Path, s.opts.PrintChanges, s.opts.WriteLock, s.opts.SigningKey)
 		if err != nil {
 			log.Println(color.RedString("can't update seal: %v", err))
 		}
+		s.emit(DirDone{Path: dir.Path})
+	}
+
+	s.progress.logSkipped()
+	return dirs, nil
+}
 
-		sealingMeta.Lock()
-		dirsDone++
-		sealingMeta.Unlock()
+// ScanPath calculates seals for the given path and all subdirectories
+// like SealPath, but only keeps them in memory without writing seal files.
+// Seals of subdirectories outside of the prefixes are loaded from disk.
+func ScanPath(dirPath string, hash bool, prefixes []string) ([]Dir, error) {
+	return NewSealer(SealOptions{Prefixes: prefixes, Before: Before}).Scan(dirPath, hash)
+}
+
+// Scan calculates seals like Seal, but only keeps them in memory
+// without writing seal files. Seals of subdirectories outside of
+// the prefixes are loaded from disk.
+func (s *Sealer) Scan(dirPath string, hash bool) ([]Dir, error) {
+	loadSeals := false
+	dirs, err := s.walk(dirPath, loadSeals)
+	if err != nil {
+		return nil, errors.Wrap(err, "indexDirectories")
 	}
 
-	if len(nonRegularFiles) > 0 {
-		log.Println("skipped non regular files:")
-		for mode, count := range nonRegularFiles {
-			log.Println(mode.String(), count)
+	scanned := map[string]*DirSeal{}
+	loadScanned := func(dirPath string) (*DirSeal, error) {
+		seal, ok := scanned[path.Clean(dirPath)]
+		if ok {
+			return seal, nil
+		}
+		return loadSealFS(s.fsys, dirPath)
+	}
+
+	s.emit(PhaseChanged{Phase: "scanning", Dirs: len(dirs)})
+	for i, dir := range dirs {
+		s.emit(DirStarted{Path: dir.Path})
+		seal, err := s.sealDirWith(dir.Path, hash, loadScanned)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sealDir %q", dir.Path)
 		}
+		dirs[i].Seal = seal
+		scanned[dir.Path] = seal
+		s.emit(DirDone{Path: dir.Path})
 	}
 	return dirs, nil
 }
 
 // sealDir turns all files and subdirectories into a DirSeal.
-func sealDir(dirPath string, hash bool) (*DirSeal, error) {
+func (s *Sealer) sealDir(dirPath string, hash bool) (*DirSeal, error) {
+	return s.sealDirWith(dirPath, hash, func(dirPath string) (*DirSeal, error) {
+		return loadSealFS(s.fsys, dirPath)
+	})
+}
+
+// sealDirWith is like sealDir, but uses loadSub to get the
+// seals of subdirectories.
+func (s *Sealer) sealDirWith(dirPath string, hash bool, loadSub func(string) (*DirSeal, error)) (*DirSeal, error) {
 	// basic info from the directory itself
-	info, err := os.Lstat(dirPath)
+	info, err := fs.Stat(s.fsys, dirPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Lstat")
+		return nil, errors.Wrap(err, "Stat")
 	}
 	seal := &DirSeal{
 		Name:     info.Name(),
@@ -106,13 +306,13 @@ func sealDir(dirPath string, hash bool) (*DirSeal, error) {
 	}
 
 	// add information from all files and subdirectories to seal
-	files, err := os.ReadDir(dirPath)
+	files, err := fs.ReadDir(s.fsys, dirPath)
 	if err != nil {
 		return seal, errors.Wrap(err, "ReadDir")
 	}
 
 	for _, file := range files {
-		err = addFileToSeal(seal, dirPath, file, hash)
+		err = s.addFileToSeal(seal, dirPath, file, hash, loadSub)
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				log.Println(color.YellowString("file doesn't exist: %v", err))
@@ -132,37 +332,41 @@ func sealDir(dirPath string, hash bool) (*DirSeal, error) {
 	return seal, errors.Wrap(err, "WriteSeal")
 }
 
-var nonRegularFiles = map[os.FileMode]int{}
-
 // addFileToSeal appends a FileSeal to the DirSeal.
-func addFileToSeal(seal *DirSeal, dirPath string, file fs.DirEntry, hash bool) error {
+func (s *Sealer) addFileToSeal(seal *DirSeal, dirPath string, file fs.DirEntry, hash bool, loadSub func(string) (*DirSeal, error)) error {
 	if filesToIgnore[file.Name()] {
 		return nil
 	}
-	fullPath := filepath.Join(dirPath, file.Name())
-
-	sealingMeta.Lock()
-	sealingFile = fullPath
-	sealingMeta.Unlock()
+	fullPath := path.Join(dirPath, file.Name())
+	s.progress.setFile(fullPath)
 
 	var f *FileSeal
 	var err error
 	if file.IsDir() {
-		f, err = sealSubDir(fullPath)
+		f, err = sealSubDir(fullPath, loadSub)
 		if err != nil {
 			return errors.Wrap(err, "sealSubDir")
 		}
 	} else {
 		if !file.Type().IsRegular() {
-			// log.Printf("not a regular file %s %q", file.Type().String(), fullPath)
-			nonRegularFiles[file.Type()]++
+			s.progress.skipped(file.Type())
 			return nil
 		}
 
-		f, err = sealFile(fullPath, hash)
+		var report func(int64)
+		if hash {
+			s.emit(FileStarted{Path: fullPath})
+			report = func(n int64) {
+				s.emit(HashProgress{Path: fullPath, Bytes: n})
+			}
+		}
+		f, err = sealFile(s.fsys, fullPath, hash, report)
 		if err != nil {
 			return errors.Wrap(err, "sealFile")
 		}
+		if hash {
+			s.emit(FileHashed{Path: fullPath, Bytes: f.Size})
+		}
 	}
 
 	seal.Files = append(seal.Files, f)
@@ -170,11 +374,12 @@ func addFileToSeal(seal *DirSeal, dirPath string, file fs.DirEntry, hash bool) e
 	return nil
 }
 
-// sealFile turns a normal file into a FileSeal.
-func sealFile(filePath string, hash bool) (*FileSeal, error) {
-	info, err := os.Lstat(filePath)
+// sealFile turns a normal file into a FileSeal. If report is
+// set, it is called with the bytes hashed since the last call.
+func sealFile(fsys fs.FS, filePath string, hash bool, report func(int64)) (*FileSeal, error) {
+	info, err := fs.Stat(fsys, filePath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Lstat")
+		return nil, errors.Wrap(err, "Stat")
 	}
 
 	if info.IsDir() {
@@ -193,30 +398,73 @@ func sealFile(filePath string, hash bool) (*FileSeal, error) {
 		return seal, nil
 	}
 
-	seal.SHA256, err = hashFile(filePath)
+	seal.SHA256, err = hashFileProgress(fsys, filePath, report)
 	return seal, errors.Wrap(err, "hashFile")
 }
 
 // hashFile hashes a normal file with SHA256.
 func hashFile(filePath string) ([]byte, error) {
+	return hashFileProgress(osFS{}, filePath, nil)
+}
+
+// hashProgressBytes is how often hashFileProgress reports progress.
+const hashProgressBytes = 64 << 20
+
+// hashFileProgress is hashFile, but calls report with the number
+// of hashed bytes after every hashProgressBytes.
+func hashFileProgress(fsys fs.FS, filePath string, report func(int64)) ([]byte, error) {
 	fileHash := sha256.New()
-	f, err := os.Open(filePath)
+	f, err := fsys.Open(filePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "Open")
 	}
 	defer f.Close()
 
-	_, err = io.Copy(fileHash, f)
-	if err != nil {
-		return nil, errors.Wrap(err, "Copy")
+	if report == nil {
+		_, err = io.Copy(fileHash, f)
+		if err != nil {
+			return nil, errors.Wrap(err, "Copy")
+		}
+		return fileHash.Sum(nil), nil
+	}
+	for {
+		n, err := io.CopyN(fileHash, f, hashProgressBytes)
+		if n > 0 {
+			report(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Copy")
+		}
 	}
-
 	return fileHash.Sum(nil), nil
 }
 
-// sealSubDir turns the seal file of a subdirectory into a FileSeal.
-func sealSubDir(dirPath string) (*FileSeal, error) {
-	dirSeal, err := loadSeal(dirPath)
+// dirFileBytes sums the sizes of the regular files in a directory,
+// to know in advance how many bytes will be hashed.
+func dirFileBytes(fsys fs.FS, dirPath string) int64 {
+	files, err := fs.ReadDir(fsys, dirPath)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, file := range files {
+		if filesToIgnore[file.Name()] || !file.Type().IsRegular() {
+			continue
+		}
+		info, err := file.Info()
+		if err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// sealSubDir turns the seal of a subdirectory into a FileSeal.
+func sealSubDir(dirPath string, loadSub func(string) (*DirSeal, error)) (*FileSeal, error) {
+	dirSeal, err := loadSub(dirPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "loadSeal")
 	}
@@ -236,7 +484,12 @@ func sealSubDir(dirPath string) (*FileSeal, error) {
 // loadSeal loads the seal file of a directory.
 // Don't include the seal file itself in the path.
 func loadSeal(dirPath string) (*DirSeal, error) {
-	f, err := os.Open(filepath.Join(dirPath, SealFile))
+	return loadSealFS(osFS{}, dirPath)
+}
+
+// loadSealFS loads the seal file of a directory in fsys.
+func loadSealFS(fsys fs.FS, dirPath string) (*DirSeal, error) {
+	f, err := fsys.Open(path.Join(dirPath, SealFile))
 	if err != nil {
 		return nil, errors.Wrap(err, "Open")
 	}
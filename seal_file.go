@@ -1,14 +1,17 @@
 package seal
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"io/fs"
 	"log"
-	"os"
 	"path"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -32,6 +35,8 @@ type DirSeal struct {
 	Sealed    time.Time
 	// Verified  time.Time
 	Files []*FileSeal
+	// Signature is set if the seal was signed with a key.
+	Signature *SealSignature `json:",omitempty"`
 }
 
 // FileSeal represents one file inside a directory.
@@ -59,8 +64,19 @@ func (f *FileSeal) exists() bool {
 // UpdateSeal writes the seal to the directory in JSON format,
 // joining it with the files seals of an al existing file.
 func (d *DirSeal) UpdateSeal(dirPath string, printChanges bool) error {
-	loaded, err := loadSeal(dirPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	return d.updateSeal(osFS{}, dirPath, printChanges, &WriteLock, nil)
+}
+
+// updateSeal is UpdateSeal for a directory in fsys, holding the
+// lock while the seal file is written if it is set. The seal is
+// signed with the key if it is set.
+func (d *DirSeal) updateSeal(fsys fs.FS, dirPath string, printChanges bool, lock sync.Locker, key ed25519.PrivateKey) error {
+	writeFS, ok := fsys.(WriteFS)
+	if !ok {
+		return errReadOnlyFS
+	}
+	loaded, err := loadSealFS(fsys, dirPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return errors.Wrap(err, "loadSeal")
 	}
 	if loaded != nil {
@@ -68,19 +84,30 @@ func (d *DirSeal) UpdateSeal(dirPath string, printChanges bool) error {
 	}
 
 	d.sort()
+	if key != nil {
+		d.sign(key)
+	}
 
-	WriteLock.Lock()
-	defer WriteLock.Unlock()
+	if lock != nil {
+		lock.Lock()
+		defer lock.Unlock()
+	}
 
-	file, err := os.Create(path.Join(dirPath, SealFile))
+	buf, err := d.encodeFile()
 	if err != nil {
-		return errors.Wrap(err, "Create seal")
+		return errors.Wrap(err, "Encode seal")
 	}
-	defer file.Close()
-	enc := json.NewEncoder(file)
+	err = writeFS.WriteFile(path.Join(dirPath, SealFile), buf)
+	return errors.Wrap(err, "WriteFile seal")
+}
+
+// encodeFile encodes the seal like it is stored in seal files.
+func (d *DirSeal) encodeFile() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
 	enc.SetIndent("", "\t")
-	err = enc.Encode(d)
-	return errors.Wrap(err, "Encode seal")
+	err := enc.Encode(d)
+	return buf.Bytes(), err
 }
 
 // joinWithExisting adds deleted and changed files of a
@@ -122,7 +149,7 @@ func (d *DirSeal) joinWithExisting(existing *DirSeal, printChanges bool, dirPath
 
 // sort sorts the file array by names.
 func (d *DirSeal) sort() {
-	sort.Slice(d.Files, func(i, j int) bool {
+	sort.SliceStable(d.Files, func(i, j int) bool {
 		return d.Files[i].Name < d.Files[j].Name
 	})
 }
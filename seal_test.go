@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -183,3 +185,33 @@ func findFile(t *testing.T, file *FileSeal, expected []*ExpectedFile) {
 		}
 	}
 }
+
+func TestConcurrentSealers(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+		randomFile(t, filepath.Join(dir, "a.txt"), 1)
+		randomFile(t, filepath.Join(dir, "sub", "b.txt"), int64(i))
+		for j := 0; j <= i; j++ {
+			require.NoError(t, os.Symlink("a.txt", filepath.Join(dir, "link"+string(rune('a'+j)))))
+		}
+
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			sealer := NewSealer(SealOptions{})
+			dirs, err := sealer.Seal(dir)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(dirs))
+			assert.Equal(t, i+1, sealer.NonRegularFiles()[os.ModeSymlink])
+
+			verified, err := NewVerifier(VerifyOptions{}).Verify(dir)
+			assert.NoError(t, err)
+			for _, d := range verified {
+				assert.True(t, d.HashDiff.Identical, d.Path)
+			}
+		}(i, dir)
+	}
+	wg.Wait()
+}
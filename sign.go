@@ -0,0 +1,196 @@
+package seal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func keygenCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "keygen KEYFILE",
+		Short: "generates an ed25519 key pair for signing seals",
+		Long: `Generates an ed25519 key pair for signing seals. The private key is
+written to KEYFILE and the public key to KEYFILE.pub, both PEM encoded.
+Pass the private key to seal --sign-key and the public key to
+verify --verify-key.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("need one key file path")
+			}
+			keyID, err := GenerateSigningKey(args[0])
+			if err != nil {
+				return err
+			}
+			log.Printf("wrote key %s to %q and %q", keyID, args[0], args[0]+".pub")
+			return nil
+		},
+	}
+}
+
+// SealSignature is an ed25519 signature of a DirSeal, made with
+// the key with the KeyID.
+type SealSignature struct {
+	KeyID     string
+	Signature []byte
+}
+
+// signatureContext is prepended to the signed bytes of a seal, so
+// that the signatures can't be used for other messages.
+const signatureContext = "seal signature v1\x00"
+
+// KeyID identifies a public key by the start of its SHA256.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signedBytes returns the bytes of the seal that are signed. The
+// name of the directory is left out, so that signed trees can be
+// moved and renamed. The seal is encoded like binary records, which
+// don't depend on time zones like JSON does, and leave out the
+// signature itself.
+func (d *DirSeal) signedBytes() []byte {
+	unnamed := *d
+	unnamed.Name = ""
+	w := &binaryWriter{buf: []byte(signatureContext)}
+	w.dirSeal(&unnamed)
+	return w.buf
+}
+
+// sign signs the seal with the key, replacing an existing signature.
+func (d *DirSeal) sign(key ed25519.PrivateKey) {
+	d.Signature = &SealSignature{
+		KeyID:     KeyID(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, d.signedBytes()),
+	}
+}
+
+// checkSignature returns an error if the seal isn't signed by
+// one of the keys, or if the signature is invalid.
+func (d *DirSeal) checkSignature(keys []ed25519.PublicKey) error {
+	if d.Signature == nil {
+		return errors.New("seal isn't signed")
+	}
+	for _, key := range keys {
+		if KeyID(key) != d.Signature.KeyID {
+			continue
+		}
+		if !ed25519.Verify(key, d.signedBytes(), d.Signature.Signature) {
+			return errors.Errorf("invalid signature of key %s", d.Signature.KeyID)
+		}
+		return nil
+	}
+	return errors.Errorf("seal is signed by unknown key %s", d.Signature.KeyID)
+}
+
+// GenerateSigningKey writes a new private key to keyPath and its
+// public key to keyPath.pub, and returns the key ID. Existing files
+// are not overwritten.
+func GenerateSigningKey(keyPath string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", errors.Wrap(err, "GenerateKey")
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", errors.Wrap(err, "MarshalPKCS8PrivateKey")
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", errors.Wrap(err, "MarshalPKIXPublicKey")
+	}
+	err = writeNewFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "write private key")
+	}
+	err = writeNewFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	if err != nil {
+		return "", errors.Wrap(err, "write public key")
+	}
+	return KeyID(pub), nil
+}
+
+// writeNewFile writes a file that must not exist yet.
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readPEMKey parses the first PEM block of a key file.
+func readPEMKey(keyPath string) (interface{}, error) {
+	buf, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.Errorf("no PEM key in %q", keyPath)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, errors.Errorf("unknown PEM block %q in %q", block.Type, keyPath)
+	}
+}
+
+// LoadSigningKey reads an ed25519 private key written by keygen.
+func LoadSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	key, err := readPEMKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%q isn't an ed25519 private key", keyPath)
+	}
+	return priv, nil
+}
+
+// LoadVerifyKey reads an ed25519 public key, or the
+// public key of a private key written by keygen.
+func LoadVerifyKey(keyPath string) (ed25519.PublicKey, error) {
+	key, err := readPEMKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, errors.Errorf("%q isn't an ed25519 key", keyPath)
+	}
+}
+
+// signatureFailures counts the directories whose seals
+// have missing or invalid signatures.
+func signatureFailures(dirs []Dir) int {
+	var n int
+	for _, dir := range dirs {
+		if dir.HashDiff != nil && dir.HashDiff.SignatureError != nil {
+			n++
+		}
+	}
+	return n
+}
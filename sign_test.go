@@ -0,0 +1,77 @@
+package seal
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignSeals(t *testing.T) {
+	SetupTestDir(t)
+	keyPath := filepath.Join(t.TempDir(), "seal.key")
+	keyID, err := GenerateSigningKey(keyPath)
+	require.NoError(t, err)
+	_, err = GenerateSigningKey(keyPath)
+	assert.Error(t, err, "existing key files")
+	priv, err := LoadSigningKey(keyPath)
+	require.NoError(t, err)
+	pub, err := LoadVerifyKey(keyPath + ".pub")
+	require.NoError(t, err)
+	assert.Equal(t, keyID, KeyID(pub))
+
+	verify := func(keys ...ed25519.PublicKey) map[string]error {
+		dirs, err := NewVerifier(VerifyOptions{VerifyKeys: keys}).Verify(TestDir)
+		require.NoError(t, err)
+		errs := map[string]error{}
+		for _, dir := range dirs {
+			errs[filepath.Base(dir.Path)] = dir.HashDiff.SignatureError
+		}
+		return errs
+	}
+
+	_, err = NewSealer(SealOptions{}).Seal(TestDir)
+	require.NoError(t, err)
+	assert.Error(t, verify(pub)["sub"], "unsigned seal")
+
+	_, err = NewSealer(SealOptions{SigningKey: priv}).Seal(TestDir)
+	require.NoError(t, err)
+	for name, err := range verify(pub) {
+		assert.NoError(t, err, name)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.Error(t, verify(other.Public().(ed25519.PublicKey))["sub"], "unknown key")
+
+	// an edited seal file with recomputed hashes keeps the old signature
+	sub := filepath.Join(TestDir, "sub")
+	seal, err := loadSeal(sub)
+	require.NoError(t, err)
+	seal.Sealed = seal.Sealed.Add(-time.Hour)
+	buf, err := seal.encodeFile()
+	require.NoError(t, err)
+	require.NoError(t, osFS{}.WriteFile(filepath.Join(sub, SealFile), buf))
+	errs := verify(pub)
+	assert.Error(t, errs["sub"])
+	assert.NoError(t, errs["testdir"])
+}
+
+func TestSignatureRecords(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	seal := &DirSeal{Name: "dir", TotalSize: 3, Sealed: time.Now(),
+		Files: []*FileSeal{{Name: "a", Size: 3, SHA256: []byte{1, 2, 3}}}}
+	require.NoError(t, seal.hash())
+	seal.sign(priv)
+
+	buf, err := encodeSeal(FormatBinary, &StoredSeal{Path: "dir", Dir: seal})
+	require.NoError(t, err)
+	decoded, err := decodeSeal(buf)
+	require.NoError(t, err)
+	require.NotNil(t, decoded.Dir.Signature)
+	decoded.Dir.Name = "renamed"
+	assert.NoError(t, decoded.Dir.checkSignature([]ed25519.PublicKey{priv.Public().(ed25519.PublicKey)}))
+}
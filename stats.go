@@ -0,0 +1,325 @@
+package seal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func statsCmd() *cobra.Command {
+	var (
+		top        int
+		jsonOutput bool
+	)
+	cmd := &cobra.Command{
+		Use:   "stats [PATH]",
+		Short: "prints statistics about an index or a sealed directory tree",
+		Long: `Prints statistics about the contents of an index or the seal files of a
+directory tree. Without a path, the index passed with --file is used.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source := CompareSource{Path: IndexFile}
+			if len(args) > 0 {
+				source.Path = args[0]
+			}
+			if source.Path == "" {
+				return errors.New("need a path argument or an index file for stats")
+			}
+			if top < 0 {
+				return errors.Errorf("--top must not be negative, got %d", top)
+			}
+			if !source.isTree() {
+				source.Type = IndexStorageType
+			}
+			stats, err := SourceStats(source, PathPrefixes, top)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "\t")
+				return enc.Encode(stats)
+			}
+			stats.Print(os.Stdout)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&top, "top", 10, "number of extensions, directories and seals in the top lists")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the statistics as JSON")
+	return cmd
+}
+
+// Stats describe the contents of an index. Only existing files are
+// counted in the totals, deleted files and old versions are
+// counted separately.
+type Stats struct {
+	Dirs  int
+	Files int
+	Bytes int64
+
+	Deleted     CoverageCount
+	OldVersions CoverageCount
+
+	// Duplicates are all copies of files except the first one.
+	Duplicates     CoverageCount
+	DuplicateRatio float64
+
+	OldestSeal time.Time
+	NewestSeal time.Time
+
+	SizeHistogram []SizeBucket
+	Extensions    []ExtensionStats
+	LargestDirs   []PathSize
+	OldestSeals   []PathSealed
+}
+
+// SizeBucket counts the files smaller than MaxSize, and not in a smaller
+// bucket. The last bucket has no MaxSize and holds all larger files.
+type SizeBucket struct {
+	MaxSize int64 `json:",omitempty"`
+	CoverageCount
+}
+
+// ExtensionStats counts the files with the same extension.
+type ExtensionStats struct {
+	Extension string
+	CoverageCount
+}
+
+// PathSize is a directory with its total size.
+type PathSize struct {
+	Path string
+	Size int64
+}
+
+// PathSealed is a file with the time when it was sealed.
+type PathSealed struct {
+	Path   string
+	Sealed time.Time
+}
+
+var histogramSizes = []int64{1 << 10, 16 << 10, 256 << 10, 4 << 20, 64 << 20, 1 << 30, 16 << 30}
+
+// SourceStats collects the statistics of an index or a directory
+// tree, with top lists of the given length. A negative top keeps
+// all entries in the lists.
+func SourceStats(source CompareSource, prefixes []string, top int) (*Stats, error) {
+	s, err := source.open(walkOptions{Prefixes: prefixes})
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer s.Close()
+
+	c := &statsCollector{
+		top:        top,
+		extensions: map[string]*ExtensionStats{},
+		stats:      &Stats{},
+	}
+	for _, size := range histogramSizes {
+		c.stats.SizeHistogram = append(c.stats.SizeHistogram, SizeBucket{MaxSize: size})
+	}
+	c.stats.SizeHistogram = append(c.stats.SizeHistogram, SizeBucket{})
+
+	groups := hashGroups(s.iterateByHash())
+	for {
+		group, err := groups.next()
+		if err != nil {
+			return nil, errors.Wrap(err, "read seals")
+		}
+		if group == nil {
+			break
+		}
+		c.addGroup(group)
+	}
+	return c.result(), nil
+}
+
+type statsCollector struct {
+	top        int
+	stats      *Stats
+	extensions map[string]*ExtensionStats
+}
+
+// addGroup adds seals that share the same hash.
+func (c *statsCollector) addGroup(group []StoredSeal) {
+	copies := 0
+	for i := range group {
+		s := &group[i]
+		if s.Dir != nil {
+			c.addDir(s)
+			continue
+		}
+		if !c.addFile(s) {
+			continue
+		}
+		if copies > 0 {
+			c.stats.Duplicates.add(s.File.Size)
+		}
+		copies++
+	}
+}
+
+func (c *statsCollector) addDir(s *StoredSeal) {
+	st := c.stats
+	st.Dirs++
+	c.addSealed(s.Path, s.Dir.Sealed, false)
+	st.LargestDirs = append(st.LargestDirs, PathSize{Path: s.Path, Size: s.Dir.TotalSize})
+	if c.top < 0 {
+		// all directories are kept and sorted once in result
+		return
+	}
+	sort.SliceStable(st.LargestDirs, func(i, j int) bool {
+		return st.LargestDirs[i].Size > st.LargestDirs[j].Size
+	})
+	if len(st.LargestDirs) > c.top {
+		st.LargestDirs = st.LargestDirs[:c.top]
+	}
+}
+
+// addFile counts a file and reports if it exists.
+func (c *statsCollector) addFile(s *StoredSeal) bool {
+	st := c.stats
+	f := s.File
+	if f.OldVersion {
+		st.OldVersions.add(f.Size)
+		return false
+	}
+	if f.Deleted {
+		st.Deleted.add(f.Size)
+		return false
+	}
+
+	st.Files++
+	st.Bytes += f.Size
+	for i := range st.SizeHistogram {
+		b := &st.SizeHistogram[i]
+		if b.MaxSize == 0 || f.Size < b.MaxSize {
+			b.add(f.Size)
+			break
+		}
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(f.Name), "."))
+	e := c.extensions[ext]
+	if e == nil {
+		e = &ExtensionStats{Extension: ext}
+		c.extensions[ext] = e
+	}
+	e.add(f.Size)
+
+	c.addSealed(s.Path, f.Sealed, true)
+	return true
+}
+
+func (c *statsCollector) addSealed(path string, sealed time.Time, isFile bool) {
+	st := c.stats
+	if sealed.IsZero() {
+		return
+	}
+	if st.OldestSeal.IsZero() || sealed.Before(st.OldestSeal) {
+		st.OldestSeal = sealed
+	}
+	if sealed.After(st.NewestSeal) {
+		st.NewestSeal = sealed
+	}
+	if !isFile || c.top == 0 {
+		return
+	}
+	if c.top < 0 {
+		// all files are kept and sorted once in result
+		st.OldestSeals = append(st.OldestSeals, PathSealed{Path: path, Sealed: sealed})
+		return
+	}
+	if len(st.OldestSeals) == c.top && !sealed.Before(st.OldestSeals[c.top-1].Sealed) {
+		return
+	}
+	st.OldestSeals = append(st.OldestSeals, PathSealed{Path: path, Sealed: sealed})
+	sort.SliceStable(st.OldestSeals, func(i, j int) bool {
+		return st.OldestSeals[i].Sealed.Before(st.OldestSeals[j].Sealed)
+	})
+	if len(st.OldestSeals) > c.top {
+		st.OldestSeals = st.OldestSeals[:c.top]
+	}
+}
+
+func (c *statsCollector) result() *Stats {
+	st := c.stats
+	if st.Bytes > 0 {
+		st.DuplicateRatio = float64(st.Duplicates.Bytes) / float64(st.Bytes)
+	}
+	for _, e := range c.extensions {
+		st.Extensions = append(st.Extensions, *e)
+	}
+	sort.Slice(st.Extensions, func(i, j int) bool {
+		if st.Extensions[i].Bytes != st.Extensions[j].Bytes {
+			return st.Extensions[i].Bytes > st.Extensions[j].Bytes
+		}
+		return st.Extensions[i].Extension < st.Extensions[j].Extension
+	})
+	if c.top >= 0 && len(st.Extensions) > c.top {
+		st.Extensions = st.Extensions[:c.top]
+	}
+	if c.top < 0 {
+		sort.SliceStable(st.LargestDirs, func(i, j int) bool {
+			return st.LargestDirs[i].Size > st.LargestDirs[j].Size
+		})
+		sort.SliceStable(st.OldestSeals, func(i, j int) bool {
+			return st.OldestSeals[i].Sealed.Before(st.OldestSeals[j].Sealed)
+		})
+	}
+	return st
+}
+
+// Print writes the statistics as tables.
+func (st *Stats) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "directories\t%d\t\t\n", st.Dirs)
+	fmt.Fprintf(tw, "files\t%d\t%s\t\n", st.Files, formatBytes(st.Bytes))
+	fmt.Fprintf(tw, "deleted\t%d\t%s\t\n", st.Deleted.Files, formatBytes(st.Deleted.Bytes))
+	fmt.Fprintf(tw, "old versions\t%d\t%s\t\n", st.OldVersions.Files, formatBytes(st.OldVersions.Bytes))
+	fmt.Fprintf(tw, "duplicates\t%d\t%s\t%.1f%%\t\n", st.Duplicates.Files, formatBytes(st.Duplicates.Bytes), st.DuplicateRatio*100)
+	tw.Flush()
+	if !st.OldestSeal.IsZero() {
+		fmt.Fprintf(w, "sealed between %s and %s\n", st.OldestSeal.Format("2006-01-02"), st.NewestSeal.Format("2006-01-02"))
+	}
+
+	fmt.Fprintln(w, "\nfile sizes")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for i, b := range st.SizeHistogram {
+		label := "< " + formatBytes(b.MaxSize)
+		if b.MaxSize == 0 && i > 0 {
+			label = ">= " + formatBytes(st.SizeHistogram[i-1].MaxSize)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\n", label, b.Files, formatBytes(b.Bytes))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\ntop extensions")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for _, e := range st.Extensions {
+		ext := e.Extension
+		if ext == "" {
+			ext = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\n", ext, e.Files, formatBytes(e.Bytes))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nlargest directories")
+	for _, d := range st.LargestDirs {
+		fmt.Fprintf(w, "%10s  %s\n", formatBytes(d.Size), d.Path)
+	}
+
+	fmt.Fprintln(w, "\noldest seals")
+	for _, s := range st.OldestSeals {
+		fmt.Fprintf(w, "%s  %s\n", s.Sealed.Format("2006-01-02 15:04"), s.Path)
+	}
+}
@@ -0,0 +1,42 @@
+package seal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceStats(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index")
+	dirs := testIndexDirs()
+	dirs[0].Seal.TotalSize = 4
+	dirs[0].Seal.Files[0].Name = "a.JPG"
+	dirs[0].Seal.Files[1].Name = "b.jpg"
+	dirs[0].Seal.Files[2].Sealed = time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, DirsToIndex(indexPath, dirs, "base", StorageTypeMemory, nil))
+	defer DropMemoryIndex(indexPath)
+
+	stats, err := SourceStats(CompareSource{Path: indexPath, Type: string(StorageTypeMemory)}, nil, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Dirs)
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, int64(5), stats.Bytes)
+	assert.Equal(t, CoverageCount{Files: 1, Bytes: 2}, stats.OldVersions)
+	assert.Equal(t, CoverageCount{Files: 2, Bytes: 2}, stats.Duplicates)
+	assert.Equal(t, 0.4, stats.DuplicateRatio)
+	assert.Equal(t, CoverageCount{Files: 4, Bytes: 5}, stats.SizeHistogram[0].CoverageCount)
+	assert.Equal(t, []ExtensionStats{{Extension: "", CoverageCount: CoverageCount{Files: 2, Bytes: 3}}}, stats.Extensions)
+	assert.Equal(t, []PathSize{{Path: ".", Size: 4}}, stats.LargestDirs)
+	require.Equal(t, 1, len(stats.OldestSeals))
+	assert.Equal(t, "c", stats.OldestSeals[0].Path)
+
+	// the command rejects a negative top, the library keeps all entries
+	stats, err = SourceStats(CompareSource{Path: indexPath, Type: string(StorageTypeMemory)}, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []PathSize{{Path: ".", Size: 4}, {Path: "sub", Size: 0}}, stats.LargestDirs)
+	require.Equal(t, 4, len(stats.OldestSeals))
+	assert.Equal(t, "c", stats.OldestSeals[0].Path)
+}
@@ -1,7 +1,12 @@
 package seal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,32 +16,240 @@ var PrintDirsToIndex = true
 
 const loadFromIndex = 10e3
 
+const volumeMetaKey = "volume"
+
+// indexVolume returns the volume name stored in the index.
+func indexVolume(storage IndexStorage) (string, error) {
+	volume, err := storage.GetMeta(volumeMetaKey)
+	return string(volume), errors.Wrap(err, "GetMeta")
+}
+
 type StorageType string
 
+// StorageTypeAuto detects the storage type of an existing index,
+// new indices are created as SQLite.
+const StorageTypeAuto StorageType = ""
+
+// IndexStorage stores one StoredSeal per hash and path combination,
+// so that identical files and directories are all kept in the index.
+//
+// LoadAfterHash returns seals ordered by hash and path, starting after
+// the given hash. The count is a soft limit, all seals sharing the hash
+// of the last returned seal are always returned together, so that
+// paginating by hash never skips duplicates.
+//
+// LoadAfterPath works the same way, but orders seals by path and hash.
+//
+// LoadHashPrefix returns all seals with a hash that starts with
+// the prefix, ordered by hash and path.
+//
+// AddSeals stores seals that were already turned into StoredSeals,
+// like the seals read from another index.
+//
+// GetMeta and SetMeta store metadata about the index, GetMeta
+// returns nil for keys that aren't set.
 type IndexStorage interface {
 	AddDir(dir *Dir, basePath string) error
+	AddSeals(seals []*StoredSeal) error
 	LoadAfterHash(hash []byte, count int) ([]StoredSeal, error)
+	LoadAfterPath(path string, count int) ([]StoredSeal, error)
+	LoadHashPrefix(prefix []byte) ([]StoredSeal, error)
+	GetMeta(key string) ([]byte, error)
+	SetMeta(key string, value []byte) error
 	Close() error
 }
 
-func openStorage(t StorageType, path string) (IndexStorage, error) {
+// StoredSeal is a single directory or file seal stored in the index.
+// The path is relative to the base path of the index.
+type StoredSeal struct {
+	Path string
+	Dir  *DirSeal
+	File *FileSeal
+}
+
+// hash returns the SHA256 of the stored directory or file.
+func (s *StoredSeal) hash() []byte {
+	if s.Dir != nil {
+		return s.Dir.SHA256
+	}
+	return s.File.SHA256
+}
+
+// exists is false for deleted files and old versions of files.
+func (s *StoredSeal) exists() bool {
+	return s.Dir != nil || s.File.exists()
+}
+
+// sealed returns when the stored directory or file was sealed.
+func (s *StoredSeal) sealed() time.Time {
+	if s.Dir != nil {
+		return s.Dir.Sealed
+	}
+	return s.File.Sealed
+}
+
+// newerThan reports if s describes the current state of a path
+// better than other. Existing files are preferred over deleted
+// files and old versions, otherwise the later seal wins.
+func (s *StoredSeal) newerThan(other *StoredSeal) bool {
+	if s.exists() != other.exists() {
+		return s.exists()
+	}
+	return s.sealed().After(other.sealed())
+}
+
+// storedSeals turns a directory and all the files of its seal into
+// the seals that get stored in the index. A file that was deleted
+// and restored with the same content is in the seal twice, only the
+// newer of both seals with the same hash and path is returned.
+func storedSeals(dir *Dir, basePath string) ([]*StoredSeal, error) {
+	path, err := filepath.Rel(basePath, dir.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "filepath.Rel")
+	}
+	toStore := []*StoredSeal{{
+		Path: path,
+		Dir:  dir.Seal,
+	}}
+	type sealKey struct{ hash, path string }
+	index := map[sealKey]int{}
+	for _, file := range dir.Seal.Files {
+		if file.IsDir {
+			continue
+		}
+		s := &StoredSeal{
+			Path: filepath.Join(path, file.Name),
+			File: file,
+		}
+		key := sealKey{string(file.SHA256), s.Path}
+		if i, ok := index[key]; ok {
+			if s.newerThan(toStore[i]) {
+				toStore[i] = s
+			}
+			continue
+		}
+		index[key] = len(toStore)
+		toStore = append(toStore, s)
+	}
+	return toStore, nil
+}
+
+func openStorage(t StorageType, path string, opts *IndexOptions) (IndexStorage, error) {
+	if t == StorageTypeAuto {
+		var err error
+		t, err = DetectStorageType(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "DetectStorageType")
+		}
+	}
+	if opts != nil && opts.Entries && t != StorageTypeSQLite {
+		return nil, errors.Errorf("the entries table is only supported by sqlite, not %s", t)
+	}
+	if len(IndexPassphrase) > 0 && (opts == nil || len(opts.Passphrase) == 0) {
+		withPassphrase := IndexOptions{}
+		if opts != nil {
+			withPassphrase = *opts
+		}
+		withPassphrase.Passphrase = IndexPassphrase
+		opts = &withPassphrase
+	}
+	storage, err := openStorageType(t, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.Volume != "" {
+		err = storage.SetMeta(volumeMetaKey, []byte(opts.Volume))
+		if err != nil {
+			storage.Close()
+			return nil, errors.Wrap(err, "SetMeta")
+		}
+	}
+	return storage, nil
+}
+
+func openStorageType(t StorageType, path string, opts *IndexOptions) (IndexStorage, error) {
 	switch t {
 	case StorageTypeBoltDB:
-		storage, err := OpenBoltDB(path)
+		storage, err := OpenBoltDB(path, opts)
 		return storage, errors.Wrap(err, "OpenBoltDB")
 	case StorageTypeSQLite:
-		storage, err := OpenSqlite(path)
+		storage, err := OpenSqlite(path, opts)
 		return storage, errors.Wrap(err, "OpenSqlite")
 	case StorageTypePebble:
-		storage, err := OpenPebble(path)
+		storage, err := OpenPebble(path, opts)
 		return storage, errors.Wrap(err, "OpenPebble")
+	case StorageTypeMemory:
+		storage, err := OpenMemory(path, opts)
+		return storage, errors.Wrap(err, "OpenMemory")
 	default:
 		return nil, errors.Errorf("unknown storage type %q", t)
 	}
 }
 
-func DirsToIndex(indexPath string, dirs []Dir, basePath string, t StorageType) error {
-	storage, err := openStorage(t, indexPath)
+var (
+	sqliteHeader = []byte("SQLite format 3\x00")
+	boltMagic    = uint32(0xED0CDAED)
+)
+
+// DetectStorageType returns the storage type of the index at path,
+// based on the header of index files or the layout of index
+// directories. Paths that don't exist yet are SQLite indices.
+func DetectStorageType(path string) (StorageType, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return StorageTypeSQLite, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Stat")
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return "", errors.Wrap(err, "ReadDir")
+		}
+		if len(entries) == 0 {
+			return "", errors.Errorf("can't detect the storage type of empty directory %q, set it with --storage", path)
+		}
+		for _, e := range entries {
+			if e.Name() == "CURRENT" {
+				return StorageTypePebble, nil
+			}
+		}
+		return "", errors.Errorf("directory %q is not a Pebble index", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "Open")
+	}
+	defer f.Close()
+	header := make([]byte, 32)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", errors.Wrap(err, "Read")
+	}
+	header = header[:n]
+	if n == 0 {
+		return "", errors.Errorf("can't detect the storage type of empty file %q, set it with --storage", path)
+	}
+
+	if bytes.HasPrefix(header, sqliteHeader) {
+		return StorageTypeSQLite, nil
+	}
+	// the first page of a BoltDB file is a meta page, its magic
+	// number follows the 16 byte page header
+	if n >= 20 {
+		magic := header[16:20]
+		if binary.LittleEndian.Uint32(magic) == boltMagic || binary.BigEndian.Uint32(magic) == boltMagic {
+			return StorageTypeBoltDB, nil
+		}
+	}
+	return "", errors.Errorf("file %q is neither a SQLite nor a BoltDB index", path)
+}
+
+func DirsToIndex(indexPath string, dirs []Dir, basePath string, t StorageType, opts *IndexOptions) error {
+	storage, err := openStorage(t, indexPath, opts)
 	if err != nil {
 		return errors.Wrap(err, "openStorage")
 	}
@@ -48,11 +261,23 @@ func DirsToIndex(indexPath string, dirs []Dir, basePath string, t StorageType) e
 		defer tick.Stop()
 	}
 
+	var onEvent EventHandler
+	if opts != nil && opts.OnEvent != nil {
+		onEvent = opts.OnEvent
+		onEvent(PhaseChanged{Phase: "indexing", Dirs: len(dirs)})
+	}
+
 	for i, dir := range dirs {
+		if onEvent != nil {
+			onEvent(DirStarted{Path: dir.Path})
+		}
 		err := storage.AddDir(&dir, basePath)
 		if err != nil {
 			return errors.Wrap(err, "AddDir")
 		}
+		if onEvent != nil {
+			onEvent(DirDone{Path: dir.Path})
+		}
 		if PrintIndexProgress {
 			select {
 			case <-tick.C:
@@ -61,6 +286,10 @@ func DirsToIndex(indexPath string, dirs []Dir, basePath string, t StorageType) e
 			}
 		}
 	}
+	err = markMerkleRootStale(storage)
+	if err != nil {
+		return errors.Wrap(err, "markMerkleRootStale")
+	}
 	flusher, ok := storage.(interface{ Flush() error })
 	if ok {
 		err := flusher.Flush()
@@ -71,14 +300,48 @@ func DirsToIndex(indexPath string, dirs []Dir, basePath string, t StorageType) e
 	return nil
 }
 
+// LoadedIndex holds all seals of an index in memory. ByHash holds
+// all seals with the same hash, ByPath holds the newest seal of a path.
 type LoadedIndex struct {
 	Dirs   []Dir
-	ByHash map[string]*StoredSeal
+	ByHash map[string][]*StoredSeal
 	ByPath map[string]*StoredSeal
 }
 
+func newLoadedIndex() *LoadedIndex {
+	return &LoadedIndex{
+		ByHash: map[string][]*StoredSeal{},
+		ByPath: map[string]*StoredSeal{},
+	}
+}
+
+// add adds a seal to the Dirs, ByHash and ByPath fields.
+func (l *LoadedIndex) add(s StoredSeal) error {
+	if s.Dir != nil && s.File != nil {
+		return errors.Errorf("both dir and file set for %q", s.Path)
+	}
+	if s.Dir == nil && s.File == nil {
+		return errors.Errorf("neither dir or file are set for %q", s.Path)
+	}
+	if s.Dir != nil {
+		l.Dirs = append(l.Dirs, Dir{
+			Path: s.Path,
+			//Depth?
+			Seal: s.Dir,
+		})
+	}
+	hash := string(s.hash())
+	l.ByHash[hash] = append(l.ByHash[hash], &s)
+
+	existing := l.ByPath[s.Path]
+	if existing == nil || s.newerThan(existing) {
+		l.ByPath[s.Path] = &s
+	}
+	return nil
+}
+
 func LoadIndex(indexPath string, t StorageType) (*LoadedIndex, error) {
-	storage, err := openStorage(t, indexPath)
+	storage, err := openStorage(t, indexPath, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "openStorage")
 	}
@@ -90,44 +353,12 @@ func LoadIndex(indexPath string, t StorageType) (*LoadedIndex, error) {
 		defer tick.Stop()
 	}
 
-	var lastHash []byte
-
-	out := &LoadedIndex{
-		ByHash: map[string]*StoredSeal{},
-		ByPath: map[string]*StoredSeal{},
-	}
-	hashes := 0
-	for {
-		stored, err := storage.LoadAfterHash(lastHash, loadFromIndex)
-		hashes += len(stored)
+	out := newLoadedIndex()
+	it := IterateByHash(storage)
+	for it.Next() {
+		err = out.add(it.Seal())
 		if err != nil {
-			return nil, errors.Wrap(err, "LoadAfterHash")
-		}
-		if err == nil && len(stored) == 0 {
-			break
-		}
-
-		for _, s := range stored {
-			sCopy := s
-			if s.Dir != nil && s.File != nil {
-				return nil, errors.Errorf("both dir and file set for %q", s.Path)
-			}
-			if s.Dir != nil {
-				out.Dirs = append(out.Dirs, Dir{
-					Path: s.Path,
-					//Depth?
-					Seal: s.Dir,
-				})
-				out.ByHash[string(s.Dir.SHA256)] = &sCopy
-				out.ByPath[string(s.Path)] = &sCopy
-				lastHash = s.Dir.SHA256
-			} else if s.File != nil {
-				out.ByHash[string(s.File.SHA256)] = &sCopy
-				out.ByPath[string(s.Path)] = &sCopy
-				lastHash = s.File.SHA256
-			} else {
-				return nil, errors.Errorf("neither dir or file are set for %q", s.Path)
-			}
+			return nil, err
 		}
 
 		if PrintIndexProgress {
@@ -138,5 +369,8 @@ func LoadIndex(indexPath string, t StorageType) (*LoadedIndex, error) {
 			}
 		}
 	}
+	if it.Err() != nil {
+		return nil, errors.Wrap(it.Err(), "LoadAfterHash")
+	}
 	return out, nil
 }
@@ -1,8 +1,7 @@
 package seal
 
 import (
-	"encoding/json"
-	"path/filepath"
+	"bytes"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,13 +13,16 @@ const StorageTypeBoltDB StorageType = "boltdb"
 var (
 	pathsBucket  = []byte("paths")
 	hashesBucket = []byte("hashes")
+	metaBucket   = []byte("meta")
 )
 
 type BoltIndex struct {
-	db *bbolt.DB
+	db     *bbolt.DB
+	format RecordFormat
+	cipher *indexCipher
 }
 
-func OpenBoltDB(indexPath string) (*BoltIndex, error) {
+func OpenBoltDB(indexPath string, opts *IndexOptions) (*BoltIndex, error) {
 	db, err := bbolt.Open(indexPath, 0644, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, errors.Wrap(err, "bbolt.Open")
@@ -35,71 +37,208 @@ func OpenBoltDB(indexPath string) (*BoltIndex, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
-	return &BoltIndex{db: db}, errors.Wrap(err, "setup db")
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setup db")
+	}
+
+	index := &BoltIndex{db: db}
+	index.cipher, err = setupCipher(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupCipher")
+	}
+	index.format, err = setupFormat(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupFormat")
+	}
+	return index, nil
 }
 
 func (i *BoltIndex) Close() error {
 	return i.db.Close()
 }
 
-type StoredSeal struct {
-	Path string
-	Dir  *DirSeal
-	File *FileSeal
+// hashKey orders seals by hash and path. The hash has a fixed length,
+// so the path can be appended without a separator.
+func hashKey(hash []byte, path string) []byte {
+	key := make([]byte, 0, len(hash)+len(path))
+	key = append(key, hash...)
+	return append(key, path...)
+}
+
+// pathKey orders seals by path and hash. Paths never contain a zero
+// byte, so it is used to separate path and hash.
+func pathKey(path string, hash []byte) []byte {
+	key := make([]byte, 0, len(path)+1+len(hash))
+	key = append(key, path...)
+	key = append(key, 0)
+	return append(key, hash...)
 }
 
 func (i *BoltIndex) AddDir(dir *Dir, basePath string) error {
-	path, err := filepath.Rel(basePath, dir.Path)
+	toStore, err := storedSeals(dir, basePath)
 	if err != nil {
-		return errors.Wrap(err, "filepath.Rel")
-	}
-	toStore := []*StoredSeal{{
-		Path: path,
-		Dir:  dir.Seal,
-	}}
-	for _, file := range dir.Seal.Files {
-		if file.IsDir {
-			continue
-		}
-		toStore = append(toStore, &StoredSeal{
-			Path: filepath.Join(path, file.Name),
-			File: file,
-		})
+		return errors.Wrap(err, "storedSeals")
 	}
+	return i.AddSeals(toStore)
+}
+
+func (i *BoltIndex) AddSeals(toStore []*StoredSeal) error {
 	return i.db.Update(func(tx *bbolt.Tx) error {
 		hashes := tx.Bucket(hashesBucket)
 		paths := tx.Bucket(pathsBucket)
 
 		for _, s := range toStore {
-			var hash []byte
-			if s.Dir != nil {
-				hash = s.Dir.SHA256
-			} else {
-				hash = s.File.SHA256
-			}
-			buf, err := json.Marshal(s)
+			hash := s.hash()
+			buf, err := i.cipher.encode(i.format, s)
 			if err != nil {
-				return errors.Wrap(err, "json.Marshal")
+				return errors.Wrap(err, "encode")
 			}
-			err = hashes.Put(hash, buf)
+			err = hashes.Put(hashKey(hash, i.cipher.keyPath(s.Path)), buf)
 			if err != nil {
 				return errors.Wrap(err, "hashes.Put")
 			}
-			err = paths.Put([]byte(s.Path), hash)
+			putOps++
+			if i.cipher != nil {
+				continue
+			}
+			err = paths.Put(pathKey(s.Path, hash), []byte{})
 			if err != nil {
 				return errors.Wrap(err, "paths.Put")
 			}
-			putOps += 2
-
+			putOps++
 		}
 		return nil
 	})
 }
 
 func (i *BoltIndex) LoadAfterHash(hash []byte, count int) ([]StoredSeal, error) {
-	return nil, errors.New("not implemented")
+	out := []StoredSeal{}
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(hashesBucket).Cursor()
+
+		var k, v []byte
+		if len(hash) == 0 {
+			k, v = c.First()
+		} else {
+			start := keyUpperBound(hash)
+			if start == nil {
+				return nil
+			}
+			k, v = c.Seek(start)
+		}
+		for ; k != nil; k, v = c.Next() {
+			s, err := i.cipher.decode(v)
+			if err != nil {
+				return errors.Wrap(err, "decode")
+			}
+			if len(out) >= count && !bytes.Equal(s.hash(), out[len(out)-1].hash()) {
+				break
+			}
+			out = append(out, s)
+		}
+		return nil
+	})
+	i.cipher.sortByHash(out)
+	return out, err
+}
+
+func (i *BoltIndex) LoadAfterPath(path string, count int) ([]StoredSeal, error) {
+	if i.cipher != nil {
+		return i.cipher.loadAfterPath(i, path, count)
+	}
+	out := []StoredSeal{}
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		hashes := tx.Bucket(hashesBucket)
+		c := tx.Bucket(pathsBucket).Cursor()
+
+		var k []byte
+		if path == "" {
+			k, _ = c.First()
+		} else {
+			k, _ = c.Seek(pathKeyAfter(path))
+		}
+		for ; k != nil; k, _ = c.Next() {
+			p, hash := splitPathKey(k)
+			if len(out) >= count && p != out[len(out)-1].Path {
+				break
+			}
+			s, err := decodeSeal(hashes.Get(hashKey(hash, p)))
+			if err != nil {
+				return errors.Wrapf(err, "decodeSeal %q", p)
+			}
+			out = append(out, s)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (i *BoltIndex) LoadHashPrefix(prefix []byte) ([]StoredSeal, error) {
+	out := []StoredSeal{}
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(hashesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			s, err := i.cipher.decode(v)
+			if err != nil {
+				return errors.Wrap(err, "decode")
+			}
+			if bytes.HasPrefix(s.hash(), prefix) {
+				out = append(out, s)
+			}
+		}
+		return nil
+	})
+	i.cipher.sortByHash(out)
+	return out, err
+}
+
+func (i *BoltIndex) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get([]byte(key))
+		if v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return i.cipher.openMeta(key, value)
+}
+
+func (i *BoltIndex) SetMeta(key string, value []byte) error {
+	value, err := i.cipher.sealMeta(key, value)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), value)
+	})
+}
+
+// pathKeyAfter returns the smallest key that sorts after
+// all path keys of the given path.
+func pathKeyAfter(path string) []byte {
+	return append([]byte(path), 1)
+}
+
+// splitPathKey splits a key created by pathKey into path and hash.
+func splitPathKey(key []byte) (string, []byte) {
+	i := bytes.IndexByte(key, 0)
+	if i < 0 {
+		return string(key), nil
+	}
+	return string(key[:i]), key[i+1:]
 }
 
 var putOps int
@@ -0,0 +1,245 @@
+package seal
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const StorageTypeMemory StorageType = "memory"
+
+// memoryData uses the same keys as BoltIndex. The sorted keys are
+// cached until the next write.
+type memoryData struct {
+	mu     sync.Mutex
+	hashes map[string][]byte
+	paths  map[string]bool
+	meta   map[string][]byte
+
+	sortedHashes []string
+	sortedPaths  []string
+}
+
+// MemoryStore holds the data of memory indices by path, so that an
+// index can be closed and opened again while the store is in use.
+// Libraries that want their own indices pass a store in
+// IndexOptions.Memory, all others share the store of the process.
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string]*memoryData
+}
+
+// NewMemoryStore returns an empty store for memory indices.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string]*memoryData{}}
+}
+
+// memoryIndices is the store of memory indices opened without
+// IndexOptions.Memory, like the ones of the command line.
+var memoryIndices = NewMemoryStore()
+
+// DropMemoryIndex removes the data of the memory index at indexPath
+// from the store of the process.
+func DropMemoryIndex(indexPath string) {
+	memoryIndices.mu.Lock()
+	delete(memoryIndices.data, indexPath)
+	memoryIndices.mu.Unlock()
+}
+
+// MemoryIndex is an IndexStorage that only lives in memory, for tests
+// and one-off comparisons. Its data is lost with its MemoryStore, or
+// when the process exits.
+type MemoryIndex struct {
+	data   *memoryData
+	format RecordFormat
+	cipher *indexCipher
+}
+
+// OpenMemory opens the memory index at indexPath in the store of
+// opts.Memory, or the store of the process if it isn't set, and
+// creates it if it doesn't exist yet.
+func OpenMemory(indexPath string, opts *IndexOptions) (*MemoryIndex, error) {
+	store := memoryIndices
+	if opts != nil && opts.Memory != nil {
+		store = opts.Memory
+	}
+	store.mu.Lock()
+	data := store.data[indexPath]
+	if data == nil {
+		data = &memoryData{
+			hashes: map[string][]byte{},
+			paths:  map[string]bool{},
+			meta:   map[string][]byte{},
+		}
+		store.data[indexPath] = data
+	}
+	store.mu.Unlock()
+
+	index := &MemoryIndex{data: data}
+	var err error
+	index.cipher, err = setupCipher(index, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "setupCipher")
+	}
+	index.format, err = setupFormat(index, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "setupFormat")
+	}
+	return index, nil
+}
+
+func (i *MemoryIndex) AddDir(dir *Dir, basePath string) error {
+	toStore, err := storedSeals(dir, basePath)
+	if err != nil {
+		return errors.Wrap(err, "storedSeals")
+	}
+	return i.AddSeals(toStore)
+}
+
+func (i *MemoryIndex) AddSeals(toStore []*StoredSeal) error {
+	d := i.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, s := range toStore {
+		buf, err := i.cipher.encode(i.format, s)
+		if err != nil {
+			return errors.Wrap(err, "encode")
+		}
+		d.hashes[string(hashKey(s.hash(), i.cipher.keyPath(s.Path)))] = buf
+		putOps++
+		if i.cipher == nil {
+			d.paths[string(pathKey(s.Path, s.hash()))] = true
+			putOps++
+		}
+	}
+	d.sortedHashes = nil
+	d.sortedPaths = nil
+	return nil
+}
+
+func (d *memoryData) sortKeys() {
+	if d.sortedHashes == nil {
+		d.sortedHashes = make([]string, 0, len(d.hashes))
+		for k := range d.hashes {
+			d.sortedHashes = append(d.sortedHashes, k)
+		}
+		sort.Strings(d.sortedHashes)
+	}
+	if d.sortedPaths == nil {
+		d.sortedPaths = make([]string, 0, len(d.paths))
+		for k := range d.paths {
+			d.sortedPaths = append(d.sortedPaths, k)
+		}
+		sort.Strings(d.sortedPaths)
+	}
+}
+
+// seek returns the index of the first key that is not smaller than start.
+func seek(keys []string, start []byte) int {
+	return sort.SearchStrings(keys, string(start))
+}
+
+func (i *MemoryIndex) LoadAfterHash(hash []byte, count int) ([]StoredSeal, error) {
+	d := i.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sortKeys()
+
+	out := []StoredSeal{}
+	start := 0
+	if len(hash) > 0 {
+		after := keyUpperBound(hash)
+		if after == nil {
+			return out, nil
+		}
+		start = seek(d.sortedHashes, after)
+	}
+	for _, k := range d.sortedHashes[start:] {
+		s, err := i.cipher.decode(d.hashes[k])
+		if err != nil {
+			return nil, errors.Wrap(err, "decode")
+		}
+		if len(out) >= count && !bytes.Equal(s.hash(), out[len(out)-1].hash()) {
+			break
+		}
+		out = append(out, s)
+	}
+	i.cipher.sortByHash(out)
+	return out, nil
+}
+
+func (i *MemoryIndex) LoadAfterPath(path string, count int) ([]StoredSeal, error) {
+	if i.cipher != nil {
+		return i.cipher.loadAfterPath(i, path, count)
+	}
+	d := i.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sortKeys()
+
+	out := []StoredSeal{}
+	start := 0
+	if path != "" {
+		start = seek(d.sortedPaths, pathKeyAfter(path))
+	}
+	for _, k := range d.sortedPaths[start:] {
+		p, hash := splitPathKey([]byte(k))
+		if len(out) >= count && p != out[len(out)-1].Path {
+			break
+		}
+		s, err := decodeSeal(d.hashes[string(hashKey(hash, p))])
+		if err != nil {
+			return nil, errors.Wrapf(err, "decodeSeal %q", p)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (i *MemoryIndex) LoadHashPrefix(prefix []byte) ([]StoredSeal, error) {
+	d := i.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sortKeys()
+
+	out := []StoredSeal{}
+	for _, k := range d.sortedHashes[seek(d.sortedHashes, prefix):] {
+		if !strings.HasPrefix(k, string(prefix)) {
+			break
+		}
+		s, err := i.cipher.decode(d.hashes[k])
+		if err != nil {
+			return nil, errors.Wrap(err, "decode")
+		}
+		if bytes.HasPrefix(s.hash(), prefix) {
+			out = append(out, s)
+		}
+	}
+	i.cipher.sortByHash(out)
+	return out, nil
+}
+
+func (i *MemoryIndex) GetMeta(key string) ([]byte, error) {
+	i.data.mu.Lock()
+	defer i.data.mu.Unlock()
+	return i.cipher.openMeta(key, i.data.meta[key])
+}
+
+func (i *MemoryIndex) SetMeta(key string, value []byte) error {
+	value, err := i.cipher.sealMeta(key, value)
+	if err != nil {
+		return err
+	}
+	i.data.mu.Lock()
+	defer i.data.mu.Unlock()
+	i.data.meta[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (i *MemoryIndex) Close() error {
+	return nil
+}
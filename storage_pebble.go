@@ -1,8 +1,7 @@
 package seal
 
 import (
-	"encoding/json"
-	"path/filepath"
+	"bytes"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/pkg/errors"
@@ -13,18 +12,32 @@ const StorageTypePebble StorageType = "pebble"
 var (
 	pathsPrefix  = []byte("paths/")
 	hashesPrefix = []byte("hashes/")
+	metaPrefix   = []byte("meta/")
 )
 
 type PebbleIndex struct {
-	db *pebble.DB
+	db     *pebble.DB
+	format RecordFormat
+	cipher *indexCipher
 }
 
-func OpenPebble(indexPath string) (*PebbleIndex, error) {
+func OpenPebble(indexPath string, opts *IndexOptions) (*PebbleIndex, error) {
 	db, err := pebble.Open(indexPath, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "pebble.Open")
 	}
-	return &PebbleIndex{db: db}, errors.Wrap(err, "setup db")
+	index := &PebbleIndex{db: db}
+	index.cipher, err = setupCipher(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupCipher")
+	}
+	index.format, err = setupFormat(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupFormat")
+	}
+	return index, nil
 }
 
 func (i *PebbleIndex) Close() error {
@@ -38,46 +51,36 @@ func (i *PebbleIndex) Flush() error {
 var writeOptions = pebble.NoSync
 
 func (i *PebbleIndex) AddDir(dir *Dir, basePath string) error {
-	path, err := filepath.Rel(basePath, dir.Path)
+	toStore, err := storedSeals(dir, basePath)
 	if err != nil {
-		return errors.Wrap(err, "filepath.Rel")
-	}
-	toStore := []*StoredSeal{{
-		Path: path,
-		Dir:  dir.Seal,
-	}}
-	for _, file := range dir.Seal.Files {
-		if file.IsDir {
-			continue
-		}
-		toStore = append(toStore, &StoredSeal{
-			Path: filepath.Join(path, file.Name),
-			File: file,
-		})
+		return errors.Wrap(err, "storedSeals")
 	}
+	return i.AddSeals(toStore)
+}
+
+func (i *PebbleIndex) AddSeals(toStore []*StoredSeal) error {
 	batch := i.db.NewBatch()
 	for _, s := range toStore {
-		var hash []byte
-		if s.Dir != nil {
-			hash = s.Dir.SHA256
-		} else {
-			hash = s.File.SHA256
-		}
-		buf, err := json.Marshal(s)
+		hash := s.hash()
+		buf, err := i.cipher.encode(i.format, s)
 		if err != nil {
-			return errors.Wrap(err, "json.Marshal")
+			return errors.Wrap(err, "encode")
 		}
-		err = batch.Set(append(hashesPrefix, hash...), buf, nil)
+		err = batch.Set(append(hashesPrefix, hashKey(hash, i.cipher.keyPath(s.Path))...), buf, nil)
 		if err != nil {
 			return errors.Wrap(err, "hashes.Put")
 		}
-		err = batch.Set(append(pathsPrefix, s.Path...), hash, nil)
+		putOps++
+		if i.cipher != nil {
+			continue
+		}
+		err = batch.Set(append(pathsPrefix, pathKey(s.Path, hash)...), nil, nil)
 		if err != nil {
 			return errors.Wrap(err, "paths.Put")
 		}
-		putOps += 2
+		putOps++
 	}
-	err = batch.Commit(writeOptions)
+	err := batch.Commit(writeOptions)
 	if err != nil {
 		return errors.Wrap(err, "batch.Commit")
 	}
@@ -96,31 +99,121 @@ func (i *PebbleIndex) LoadAfterHash(hash []byte, count int) ([]StoredSeal, error
 
 	out := []StoredSeal{}
 	for iter.First(); iter.Valid(); iter.Next() {
-		// if len(hash) > 0 && bytes.Equal(iter.Key(), append(hashesPrefix, hash...)) {
-		// 	continue
-		// }
-		err := iter.Error()
+		s, err := i.cipher.decode(iter.Value())
 		if err != nil {
-			return nil, errors.Wrap(err, "iter.Error")
+			iter.Close()
+			return nil, errors.Wrap(err, "decode")
 		}
-		// iter.Key()
-		var s StoredSeal
-		err = json.Unmarshal(iter.Value(), &s)
-		if err != nil {
-			return nil, errors.Wrap(err, "json.Unmarshal")
+		if len(out) >= count && !bytes.Equal(s.hash(), out[len(out)-1].hash()) {
+			break
 		}
 		out = append(out, s)
-		if len(out) >= count {
+	}
+	err := iter.Error()
+	if err != nil {
+		iter.Close()
+		return nil, errors.Wrap(err, "iter.Error")
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "iter.Close")
+	}
+	i.cipher.sortByHash(out)
+	return out, nil
+}
+
+func (i *PebbleIndex) LoadAfterPath(path string, count int) ([]StoredSeal, error) {
+	if i.cipher != nil {
+		return i.cipher.loadAfterPath(i, path, count)
+	}
+	iterOptions := &pebble.IterOptions{
+		LowerBound: pathsPrefix,
+		UpperBound: keyUpperBound(pathsPrefix),
+	}
+	if path != "" {
+		iterOptions.LowerBound = append(append([]byte{}, pathsPrefix...), pathKeyAfter(path)...)
+	}
+	iter := i.db.NewIter(iterOptions)
+
+	out := []StoredSeal{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		p, hash := splitPathKey(iter.Key()[len(pathsPrefix):])
+		if len(out) >= count && p != out[len(out)-1].Path {
 			break
 		}
+		buf, closer, err := i.db.Get(append(append([]byte{}, hashesPrefix...), hashKey(hash, p)...))
+		if err != nil {
+			iter.Close()
+			return nil, errors.Wrapf(err, "Get %q", p)
+		}
+		s, err := decodeSeal(buf)
+		closer.Close()
+		if err != nil {
+			iter.Close()
+			return nil, errors.Wrap(err, "decodeSeal")
+		}
+		out = append(out, s)
+	}
+	err := iter.Error()
+	if err != nil {
+		iter.Close()
+		return nil, errors.Wrap(err, "iter.Error")
 	}
-	err := iter.Close()
+	err = iter.Close()
 	if err != nil {
 		return nil, errors.Wrap(err, "iter.Close")
 	}
 	return out, nil
 }
 
+func (i *PebbleIndex) LoadHashPrefix(prefix []byte) ([]StoredSeal, error) {
+	lower := append(append([]byte{}, hashesPrefix...), prefix...)
+	iter := i.db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: keyUpperBound(lower),
+	})
+
+	out := []StoredSeal{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		s, err := i.cipher.decode(iter.Value())
+		if err != nil {
+			iter.Close()
+			return nil, errors.Wrap(err, "decode")
+		}
+		if bytes.HasPrefix(s.hash(), prefix) {
+			out = append(out, s)
+		}
+	}
+	err := iter.Error()
+	if err != nil {
+		iter.Close()
+		return nil, errors.Wrap(err, "iter.Error")
+	}
+	i.cipher.sortByHash(out)
+	return out, errors.Wrap(iter.Close(), "iter.Close")
+}
+
+func (i *PebbleIndex) GetMeta(key string) ([]byte, error) {
+	buf, closer, err := i.db.Get(append(append([]byte{}, metaPrefix...), key...))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Get")
+	}
+	defer closer.Close()
+	return i.cipher.openMeta(key, append([]byte{}, buf...))
+}
+
+func (i *PebbleIndex) SetMeta(key string, value []byte) error {
+	value, err := i.cipher.sealMeta(key, value)
+	if err != nil {
+		return err
+	}
+	err = i.db.Set(append(append([]byte{}, metaPrefix...), key...), value, pebble.Sync)
+	return errors.Wrap(err, "Set")
+}
+
 func keyUpperBound(b []byte) []byte {
 	end := make([]byte, len(b))
 	copy(end, b)
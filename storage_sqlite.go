@@ -2,9 +2,7 @@ package seal
 
 import (
 	"database/sql"
-	"encoding/base64"
-	"encoding/json"
-	"path/filepath"
+	"encoding/hex"
 
 	"github.com/pkg/errors"
 
@@ -14,25 +12,145 @@ import (
 const StorageTypeSQLite StorageType = "sqlite"
 
 type SqliteIndex struct {
-	db *sql.DB
+	db      *sql.DB
+	format  RecordFormat
+	entries bool
+	cipher  *indexCipher
 }
 
-func OpenSqlite(indexPath string) (*SqliteIndex, error) {
+func OpenSqlite(indexPath string, opts *IndexOptions) (*SqliteIndex, error) {
 	db, err := sql.Open("sqlite3", indexPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "sql.Open")
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS seals (hash TEXT PRIMARY KEY, path TEXT, json BLOB);")
+	err = migrateSqlite(db)
 	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "migrateSqlite")
+	}
+	_, err = db.Exec(createSealsTable)
+	if err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "create table")
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS seal_path ON seals(path)")
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS seal_path_hash ON seals(path, hash)")
 	if err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "create path index")
 	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value BLOB);")
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "create meta table")
+	}
+
+	index := &SqliteIndex{db: db}
+	index.cipher, err = setupCipher(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupCipher")
+	}
+	// checked before setupEntries, which would write the
+	// decrypted seals into the entries table
+	if index.cipher != nil && opts != nil && opts.Entries {
+		db.Close()
+		return nil, errors.New("encrypted indices can't have an entries table")
+	}
+	index.format, err = setupFormat(index, opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupFormat")
+	}
+	index.entries, err = index.setupEntries(opts)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setupEntries")
+	}
+	if index.entries && index.cipher != nil {
+		db.Close()
+		return nil, errors.New("encrypted indices can't have an entries table")
+	}
+	return index, nil
+}
+
+const createSealsTable = `CREATE TABLE IF NOT EXISTS seals (hash TEXT, path TEXT, json BLOB,
+	PRIMARY KEY (hash, path));`
+
+// migrateSqlite converts the seals table of indices from before
+// duplicate hashes were supported. Their table has only the hash as
+// primary key, which is base64 encoded instead of hex. The rows are
+// copied into a table with the current layout.
+func migrateSqlite(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(seals)")
+	if err != nil {
+		return errors.Wrap(err, "table_info")
+	}
+	var columns, keys int
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "Scan")
+		}
+		columns++
+		if pk > 0 {
+			keys++
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "table_info")
+	}
+	if columns == 0 || keys != 1 {
+		return nil
+	}
 
-	return &SqliteIndex{db: db}, errors.Wrap(err, "setup db")
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "db.Begin")
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("ALTER TABLE seals RENAME TO seals_v1")
+	if err != nil {
+		return errors.Wrap(err, "rename table")
+	}
+	_, err = tx.Exec(createSealsTable)
+	if err != nil {
+		return errors.Wrap(err, "create table")
+	}
+	rows, err = tx.Query("SELECT json FROM seals_v1")
+	if err != nil {
+		return errors.Wrap(err, "select")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var buf []byte
+		err = rows.Scan(&buf)
+		if err != nil {
+			return errors.Wrap(err, "Scan")
+		}
+		s, err := decodeSeal(buf)
+		if err != nil {
+			return errors.Wrap(err, "decodeSeal")
+		}
+		_, err = tx.Exec("INSERT INTO seals (hash, path, json) VALUES ($1, $2, $3)",
+			hex.EncodeToString(s.hash()), s.Path, buf)
+		if err != nil {
+			return errors.Wrap(err, "insert")
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "select")
+	}
+	_, err = tx.Exec("DROP TABLE seals_v1")
+	if err != nil {
+		return errors.Wrap(err, "drop table")
+	}
+	return errors.Wrap(tx.Commit(), "tx.Commit")
 }
 
 func (i *SqliteIndex) Close() error {
@@ -40,25 +158,14 @@ func (i *SqliteIndex) Close() error {
 }
 
 func (i *SqliteIndex) AddDir(dir *Dir, basePath string) error {
-	path, err := filepath.Rel(basePath, dir.Path)
+	toStore, err := storedSeals(dir, basePath)
 	if err != nil {
-		return errors.Wrap(err, "filepath.Rel")
-	}
-	toStore := []*StoredSeal{{
-		Path: path,
-		Dir:  dir.Seal,
-	}}
-
-	for _, file := range dir.Seal.Files {
-		if file.IsDir {
-			continue
-		}
-		toStore = append(toStore, &StoredSeal{
-			Path: filepath.Join(path, file.Name),
-			File: file,
-		})
+		return errors.Wrap(err, "storedSeals")
 	}
+	return i.AddSeals(toStore)
+}
 
+func (i *SqliteIndex) AddSeals(toStore []*StoredSeal) error {
 	tx, err := i.db.Begin()
 	if err != nil {
 		return errors.Wrap(err, "db.BeginTx")
@@ -66,26 +173,28 @@ func (i *SqliteIndex) AddDir(dir *Dir, basePath string) error {
 	defer tx.Rollback()
 
 	for _, s := range toStore {
-		var hash []byte
-		if s.Dir != nil {
-			hash = s.Dir.SHA256
-		} else {
-			hash = s.File.SHA256
-		}
-		buf, err := json.Marshal(s)
+		buf, err := i.cipher.encode(i.format, s)
 		if err != nil {
-			return errors.Wrap(err, "json.Marshal")
+			return errors.Wrap(err, "encode")
 		}
 
-		hashString := base64.RawStdEncoding.EncodeToString(hash)
+		// hex keeps the order of the raw hash bytes
+		hashString := hex.EncodeToString(s.hash())
 
 		const insert = `INSERT INTO seals (hash, path, json) VALUES ($1, $2, $3)
-		ON CONFLICT (hash) DO UPDATE SET path = $2, json = $3;`
-		_, err = tx.Exec(insert, hashString, s.Path, buf)
+		ON CONFLICT (hash, path) DO UPDATE SET json = $3;`
+		_, err = tx.Exec(insert, hashString, i.cipher.keyPath(s.Path), buf)
 		if err != nil {
 			return errors.Wrap(err, "insert")
 		}
 		putOps++
+
+		if i.entries {
+			err = insertEntry(tx, s)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	err = tx.Commit()
@@ -97,9 +206,66 @@ func (i *SqliteIndex) AddDir(dir *Dir, basePath string) error {
 }
 
 func (i *SqliteIndex) LoadAfterHash(hash []byte, count int) ([]StoredSeal, error) {
-	hashString := base64.RawStdEncoding.EncodeToString(hash)
-	rows, err := i.db.Query(`SELECT json FROM seals
-	WHERE hash > $1 ORDER BY hash ASC LIMIT $2;`, hashString, count)
+	hashString := hex.EncodeToString(hash)
+	out, err := i.query(`SELECT path, json FROM seals
+	WHERE hash > $1 ORDER BY hash ASC, path ASC LIMIT $2;`, hashString, count)
+	if err != nil || len(out) < count {
+		i.cipher.sortByHash(out)
+		return out, err
+	}
+
+	// complete the group of seals sharing the last hash
+	last := out[len(out)-1]
+	rest, err := i.query(`SELECT path, json FROM seals
+	WHERE hash = $1 AND path > $2 ORDER BY path ASC;`, hex.EncodeToString(last.hash()), i.cipher.keyPath(last.Path))
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, rest...)
+	i.cipher.sortByHash(out)
+	return out, nil
+}
+
+func (i *SqliteIndex) LoadAfterPath(path string, count int) ([]StoredSeal, error) {
+	if i.cipher != nil {
+		return i.cipher.loadAfterPath(i, path, count)
+	}
+	out, err := i.query(`SELECT path, json FROM seals
+	WHERE path > $1 ORDER BY path ASC, hash ASC LIMIT $2;`, path, count)
+	if err != nil || len(out) < count {
+		return out, err
+	}
+
+	// complete the group of seals sharing the last path
+	last := out[len(out)-1]
+	rest, err := i.query(`SELECT path, json FROM seals
+	WHERE path = $1 AND hash > $2 ORDER BY hash ASC;`, last.Path, hex.EncodeToString(last.hash()))
+	if err != nil {
+		return nil, err
+	}
+	return append(out, rest...), nil
+}
+
+func (i *SqliteIndex) LoadHashPrefix(prefix []byte) ([]StoredSeal, error) {
+	lower := hex.EncodeToString(prefix)
+	upper := keyUpperBound([]byte(lower))
+	var out []StoredSeal
+	var err error
+	if upper == nil {
+		out, err = i.query(`SELECT path, json FROM seals
+		WHERE hash >= $1 ORDER BY hash ASC, path ASC;`, lower)
+	} else {
+		out, err = i.query(`SELECT path, json FROM seals
+		WHERE hash >= $1 AND hash < $2 ORDER BY hash ASC, path ASC;`, lower, string(upper))
+	}
+	i.cipher.sortByHash(out)
+	return out, err
+}
+
+// query loads all seals returned by a query that selects the path
+// and json columns.
+func (i *SqliteIndex) query(query string, args ...interface{}) ([]StoredSeal, error) {
+	rows, err := i.db.Query(query, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "db.Query")
 	}
@@ -107,17 +273,39 @@ func (i *SqliteIndex) LoadAfterHash(hash []byte, count int) ([]StoredSeal, error
 
 	out := []StoredSeal{}
 	for rows.Next() {
+		var path string
 		var buf []byte
-		err = rows.Scan(&buf)
+		err = rows.Scan(&path, &buf)
 		if err != nil {
 			return nil, errors.Wrap(err, "rows.Scan")
 		}
-		var s StoredSeal
-		err = json.Unmarshal(buf, &s)
+		s, err := i.cipher.decode(buf)
 		if err != nil {
-			return nil, errors.Wrap(err, "json.Unmarshal")
+			return nil, errors.Wrapf(err, "decode %q", path)
 		}
 		out = append(out, s)
 	}
-	return out, nil
+	return out, errors.Wrap(rows.Err(), "rows.Err")
+}
+
+func (i *SqliteIndex) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := i.db.QueryRow("SELECT value FROM meta WHERE key = $1;", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "db.QueryRow")
+	}
+	return i.cipher.openMeta(key, value)
+}
+
+func (i *SqliteIndex) SetMeta(key string, value []byte) error {
+	value, err := i.cipher.sealMeta(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = i.db.Exec(`INSERT INTO meta (key, value) VALUES ($1, $2)
+	ON CONFLICT (key) DO UPDATE SET value = $2;`, key, value)
+	return errors.Wrap(err, "db.Exec")
 }
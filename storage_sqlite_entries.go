@@ -0,0 +1,144 @@
+package seal
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const entriesMetaKey = "entries"
+
+// The entries table holds the same seals as the seals table, but with
+// one column per field, so that the index can be queried with SQL.
+// Times are stored as UTC text like 2006-01-02 15:04:05, which works
+// with the date and time functions of SQLite and compares correctly.
+// Extensions are lower case without the dot.
+const createEntries = `CREATE TABLE IF NOT EXISTS entries (
+	path TEXT,
+	parent TEXT,
+	name TEXT,
+	extension TEXT,
+	size INTEGER,
+	modified TEXT,
+	sealed TEXT,
+	hash TEXT,
+	is_dir INTEGER,
+	deleted INTEGER,
+	old_version INTEGER,
+	PRIMARY KEY (hash, path)
+);
+CREATE INDEX IF NOT EXISTS entries_path ON entries(path);
+CREATE INDEX IF NOT EXISTS entries_parent ON entries(parent);
+CREATE INDEX IF NOT EXISTS entries_extension ON entries(extension);
+CREATE INDEX IF NOT EXISTS entries_sealed ON entries(sealed);`
+
+const entriesTimeLayout = "2006-01-02 15:04:05"
+
+// setupEntries creates and fills the entries table if the options ask
+// for it, and returns if the index keeps the entries table up to date.
+func (i *SqliteIndex) setupEntries(opts *IndexOptions) (bool, error) {
+	stored, err := i.GetMeta(entriesMetaKey)
+	if err != nil {
+		return false, errors.Wrap(err, "GetMeta")
+	}
+	if len(stored) > 0 {
+		return true, nil
+	}
+	if opts == nil || !opts.Entries {
+		return false, nil
+	}
+
+	_, err = i.db.Exec(createEntries)
+	if err != nil {
+		return false, errors.Wrap(err, "create entries table")
+	}
+
+	// fill the table with the seals that are already in the index
+	it := IterateByPath(i)
+	var page []*StoredSeal
+	for it.Next() {
+		s := it.Seal()
+		page = append(page, &s)
+		if len(page) < loadFromIndex {
+			continue
+		}
+		err = i.addEntries(page)
+		if err != nil {
+			return false, err
+		}
+		page = page[:0]
+	}
+	if it.Err() != nil {
+		return false, errors.Wrap(it.Err(), "IterateByPath")
+	}
+	err = i.addEntries(page)
+	if err != nil {
+		return false, err
+	}
+	return true, errors.Wrap(i.SetMeta(entriesMetaKey, []byte("1")), "SetMeta")
+}
+
+func (i *SqliteIndex) addEntries(seals []*StoredSeal) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+	for _, s := range seals {
+		err = insertEntry(tx, s)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(tx.Commit(), "tx.Commit")
+}
+
+func insertEntry(tx *sql.Tx, s *StoredSeal) error {
+	var parent interface{}
+	if s.Path != "." {
+		parent = filepath.Dir(s.Path)
+	}
+	var (
+		name             string
+		extension        string
+		size             int64
+		modified, sealed time.Time
+		isDir            bool
+		deleted, old     bool
+	)
+	if s.Dir != nil {
+		name = s.Dir.Name
+		size = s.Dir.TotalSize
+		modified = s.Dir.Modified
+		sealed = s.Dir.Sealed
+		isDir = true
+	} else {
+		name = s.File.Name
+		extension = strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+		size = s.File.Size
+		modified = s.File.Modified
+		sealed = s.File.Sealed
+		deleted = s.File.Deleted
+		old = s.File.OldVersion
+	}
+
+	const insert = `INSERT INTO entries (path, parent, name, extension, size, modified,
+	sealed, hash, is_dir, deleted, old_version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	ON CONFLICT (hash, path) DO UPDATE SET parent = $2, name = $3, extension = $4, size = $5,
+	modified = $6, sealed = $7, is_dir = $9, deleted = $10, old_version = $11;`
+	_, err := tx.Exec(insert, s.Path, parent, name, extension, size, entriesTime(modified),
+		entriesTime(sealed), hex.EncodeToString(s.hash()), isDir, deleted, old)
+	return errors.Wrap(err, "insert entry")
+}
+
+// entriesTime formats a time for the entries table, zero times are NULL.
+func entriesTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(entriesTimeLayout)
+}
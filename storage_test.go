@@ -0,0 +1,261 @@
+package seal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	diskStorageTypes = []StorageType{StorageTypeSQLite, StorageTypeBoltDB, StorageTypePebble}
+	testStorageTypes = append(diskStorageTypes, StorageTypeMemory)
+)
+
+// testIndexDirs returns directories where the same content
+// exists at multiple paths.
+func testIndexDirs() []Dir {
+	now := time.Now()
+	hashA := bytes.Repeat([]byte{1}, 32)
+	hashB := bytes.Repeat([]byte{2}, 32)
+	return []Dir{{
+		Path: "base",
+		Seal: &DirSeal{Name: "base", SHA256: bytes.Repeat([]byte{3}, 32), Sealed: now, Files: []*FileSeal{
+			{Name: "a", Size: 1, SHA256: hashA, Sealed: now},
+			{Name: "b", Size: 1, SHA256: hashA, Sealed: now},
+			{Name: "c", Size: 2, SHA256: hashB, Sealed: now},
+			{Name: "sub", IsDir: true, SHA256: bytes.Repeat([]byte{0}, 32)},
+		}},
+	}, {
+		Path: "base/sub",
+		Seal: &DirSeal{Name: "sub", SHA256: bytes.Repeat([]byte{0}, 32), Sealed: now, Files: []*FileSeal{
+			{Name: "a", Size: 1, SHA256: hashA, Sealed: now},
+			{Name: "d", Size: 2, SHA256: hashB, Sealed: now, OldVersion: true},
+		}},
+	}}
+}
+
+func TestStoragePagination(t *testing.T) {
+	for _, storageType := range testStorageTypes {
+		for _, format := range []RecordFormat{FormatJSON, FormatBinary} {
+			t.Run(string(storageType)+"/"+string(format), func(t *testing.T) {
+				testStoragePagination(t, storageType, &IndexOptions{Format: format})
+			})
+		}
+	}
+}
+
+func testStoragePagination(t *testing.T, storageType StorageType, opts *IndexOptions) {
+	indexPath := filepath.Join(t.TempDir(), "index")
+	defer DropMemoryIndex(indexPath)
+	require.NoError(t, DirsToIndex(indexPath, testIndexDirs(), "base", storageType, opts))
+
+	storage, err := openStorage(storageType, indexPath, &IndexOptions{Passphrase: opts.Passphrase})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	var byHash []string
+	var lastHash []byte
+	for {
+		page, err := storage.LoadAfterHash(lastHash, 1)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		for _, s := range page {
+			byHash = append(byHash, s.Path)
+		}
+		lastHash = page[len(page)-1].hash()
+	}
+	assert.Equal(t, []string{"sub", "a", "b", "sub/a", "c", "sub/d", "."}, byHash)
+
+	var byPath []string
+	it := IterateByPath(storage)
+	for it.Next() {
+		byPath = append(byPath, it.Seal().Path)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{".", "a", "b", "c", "sub", "sub/a", "sub/d"}, byPath)
+
+	page, err := storage.LoadAfterPath("b", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, "c", page[0].Path)
+
+	page, err = storage.LoadHashPrefix([]byte{1, 1})
+	require.NoError(t, err)
+	var withPrefix []string
+	for _, s := range page {
+		withPrefix = append(withPrefix, s.Path)
+	}
+	assert.Equal(t, []string{"a", "b", "sub/a"}, withPrefix)
+}
+
+func TestDetectStorageType(t *testing.T) {
+	for _, storageType := range diskStorageTypes {
+		indexPath := filepath.Join(t.TempDir(), "index")
+		require.NoError(t, DirsToIndex(indexPath, testIndexDirs(), "base", storageType, nil))
+		detected, err := DetectStorageType(indexPath)
+		require.NoError(t, err)
+		assert.Equal(t, storageType, detected)
+
+		storage, err := openStorage(StorageTypeAuto, indexPath, nil)
+		require.NoError(t, err)
+		page, err := storage.LoadAfterPath("", 1)
+		require.NoError(t, err)
+		assert.Equal(t, ".", page[0].Path)
+		require.NoError(t, storage.Close())
+	}
+
+	dir := t.TempDir()
+	detected, err := DetectStorageType(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	assert.Equal(t, StorageTypeSQLite, detected)
+
+	_, err = DetectStorageType(dir)
+	assert.Error(t, err, "empty directory")
+
+	emptyFile := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(emptyFile, nil, 0644))
+	_, err = DetectStorageType(emptyFile)
+	assert.Error(t, err, "empty file")
+
+	textFile := filepath.Join(dir, "text")
+	require.NoError(t, os.WriteFile(textFile, []byte("not an index, just some text"), 0644))
+	_, err = DetectStorageType(textFile)
+	assert.Error(t, err, "text file")
+}
+
+func TestSqliteEntries(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index.db")
+	dirs := testIndexDirs()
+	old := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	dirs[0].Seal.Files[0].Name = "clip.MOV"
+	dirs[0].Seal.Files[0].Sealed = old
+	dirs[1].Seal.Files[0].Name = "other.mov"
+	require.NoError(t, DirsToIndex(indexPath, dirs, "base", StorageTypeSQLite, nil))
+
+	// the entries table is filled when it gets enabled
+	storage, err := OpenSqlite(indexPath, &IndexOptions{Entries: true})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	storage, err = OpenSqlite(indexPath, nil)
+	require.NoError(t, err)
+	defer storage.Close()
+	assert.True(t, storage.entries)
+	require.NoError(t, storage.AddDir(&Dir{Path: "base/new", Seal: &DirSeal{
+		Name: "new", SHA256: bytes.Repeat([]byte{4}, 32), Files: []*FileSeal{
+			{Name: "late.mov", Size: 5, SHA256: bytes.Repeat([]byte{5}, 32), Sealed: time.Now()},
+		}}}, "base"))
+
+	var count, size int64
+	err = storage.db.QueryRow(`SELECT count(*), sum(size) FROM entries
+	WHERE extension = 'mov' AND NOT is_dir`).Scan(&count, &size)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, int64(7), size)
+
+	var path string
+	err = storage.db.QueryRow(`SELECT path FROM entries
+	WHERE extension = 'mov' AND sealed < '2020-01-01'`).Scan(&path)
+	require.NoError(t, err)
+	assert.Equal(t, "clip.MOV", path)
+
+	err = storage.db.QueryRow(`SELECT count(*) FROM entries WHERE parent = 'sub' AND old_version`).Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	_, err = openStorage(StorageTypePebble, filepath.Join(t.TempDir(), "pebble"), &IndexOptions{Entries: true})
+	assert.Error(t, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	opts := &IndexOptions{Memory: NewMemoryStore()}
+	require.NoError(t, DirsToIndex("index", testIndexDirs(), "base", StorageTypeMemory, opts))
+	storage, err := openStorage(StorageTypeMemory, "index", opts)
+	require.NoError(t, err)
+	seals, err := storage.LoadAfterPath("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, 7, len(seals))
+
+	other, err := openStorage(StorageTypeMemory, "index", &IndexOptions{Memory: NewMemoryStore()})
+	require.NoError(t, err)
+	seals, err = other.LoadAfterPath("", 10)
+	require.NoError(t, err)
+	assert.Empty(t, seals, "stores don't share indices")
+
+	defer DropMemoryIndex("index")
+	process, err := openStorage(StorageTypeMemory, "index", nil)
+	require.NoError(t, err)
+	seals, err = process.LoadAfterPath("", 10)
+	require.NoError(t, err)
+	assert.Empty(t, seals, "the process store is separate")
+}
+
+func TestMigrateSqlite(t *testing.T) {
+	// an index in the layout from before duplicate hashes
+	indexPath := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", indexPath)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE seals (hash TEXT PRIMARY KEY, path TEXT, json BLOB);")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE INDEX seal_path ON seals(path)")
+	require.NoError(t, err)
+	stored, err := storedSeals(&testIndexDirs()[0], "base")
+	require.NoError(t, err)
+	for _, s := range stored {
+		buf, err := json.Marshal(s)
+		require.NoError(t, err)
+		_, err = db.Exec("INSERT OR REPLACE INTO seals (hash, path, json) VALUES ($1, $2, $3)",
+			base64.RawStdEncoding.EncodeToString(s.hash()), s.Path, buf)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	storage, err := OpenSqlite(indexPath, nil)
+	require.NoError(t, err)
+	page, err := storage.LoadAfterHash(nil, 10)
+	require.NoError(t, err)
+	var paths []string
+	for _, s := range page {
+		paths = append(paths, s.Path)
+	}
+	// one of the seals with the same hash got lost in the old layout
+	assert.Equal(t, []string{"b", "c", "."}, paths)
+
+	// and can be added again with the same hash
+	require.NoError(t, storage.AddSeals([]*StoredSeal{stored[1]}))
+	page, err = storage.LoadAfterPath("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(page))
+	require.NoError(t, storage.Close())
+}
+
+func TestIndexRestoredFile(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, 32)
+	now := time.Now()
+	deleted := &FileSeal{Name: "a", Size: 1, SHA256: hash, Sealed: now.Add(-time.Hour), Deleted: true}
+	restored := &FileSeal{Name: "a", Size: 1, SHA256: hash, Sealed: now}
+	for _, files := range [][]*FileSeal{{deleted, restored}, {restored, deleted}} {
+		indexPath := filepath.Join(t.TempDir(), "index")
+		defer DropMemoryIndex(indexPath)
+		dirs := []Dir{{Path: "base", Seal: &DirSeal{Name: "base", SHA256: hash, Sealed: now, Files: files}}}
+		require.NoError(t, DirsToIndex(indexPath, dirs, "base", StorageTypeMemory, nil))
+
+		storage, err := openStorage(StorageTypeMemory, indexPath, nil)
+		require.NoError(t, err)
+		seals, err := storage.LoadAfterPath("", 10)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(seals))
+		assert.Equal(t, "a", seals[1].Path)
+		assert.True(t, seals[1].exists(), "the restored file isn't deleted")
+	}
+}
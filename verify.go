@@ -1,6 +1,8 @@
 package seal
 
 import (
+	"crypto/ed25519"
+	"io/fs"
 	"log"
 	"time"
 
@@ -8,107 +10,161 @@ import (
 )
 
 var (
+	// PrintVerify and PrintAllVerify configure the
+	// Verifier that is used by VerifyPath.
 	PrintVerify    = false
 	PrintAllVerify = false
-	verifyMode     = ""
 )
 
+// VerifyOptions configure a Verifier. The zero value verifies
+// all directories without logging the progress.
+type VerifyOptions struct {
+	// Prefixes limit verifying to directories with these relative path prefixes.
+	Prefixes []string
+	// Before skips directories that were sealed after this time.
+	Before time.Time
+	// FS is the file system that is verified, the local
+	// file system is used if it is nil.
+	FS fs.FS
+	// PrintDifferences logs the differences of every directory.
+	PrintDifferences bool
+
+	// PrintProgress logs the progress every ProgressInterval,
+	// PrintAll logs every directory that is verified.
+	PrintProgress    bool
+	PrintAll         bool
+	ProgressInterval time.Duration
+
+	// OnEvent receives the progress events and differences, if it is set.
+	OnEvent EventHandler
+	// VerifyKeys are the keys that seals have to be signed with.
+	// Missing or invalid signatures are differences, if it is set.
+	VerifyKeys []ed25519.PublicKey
+}
+
+// Verifier checks directory trees against their seal files. Like the
+// Sealer it owns its progress, so that Verifiers can run at the same time.
+type Verifier struct {
+	opts   VerifyOptions
+	sealer *Sealer
+}
+
+// NewVerifier returns a Verifier that uses the options.
+func NewVerifier(opts VerifyOptions) *Verifier {
+	return &Verifier{
+		opts: opts,
+		sealer: NewSealer(SealOptions{
+			Prefixes:         opts.Prefixes,
+			Before:           opts.Before,
+			FS:               opts.FS,
+			PrintProgress:    opts.PrintProgress,
+			ProgressInterval: opts.ProgressInterval,
+			OnEvent:          opts.OnEvent,
+		}),
+	}
+}
+
 // VerifyPath checks all files and directories against the
 // seal JSON files by comparing metadata and hashing file contents.
 func VerifyPath(dirPath string, printDifferences bool, prefixes []string) ([]Dir, error) {
-	if PrintVerify {
+	return NewVerifier(VerifyOptions{
+		Prefixes:         prefixes,
+		Before:           Before,
+		PrintDifferences: printDifferences,
+		PrintProgress:    PrintVerify,
+		PrintAll:         PrintAllVerify,
+		ProgressInterval: PrintInterval,
+	}).Verify(dirPath)
+}
+
+// Verify checks all files and directories against the seal JSON
+// files, first by comparing metadata and then by hashing file contents.
+func (v *Verifier) Verify(dirPath string) ([]Dir, error) {
+	if v.opts.PrintProgress {
 		log.Println("indexing", dirPath)
 	}
 	loadSeals := false
-	dirs, err := indexDirectories(dirPath, loadSeals, prefixes)
+	dirs, err := v.sealer.walk(dirPath, loadSeals)
 	if err != nil {
 		return nil, errors.Wrap(err, "indexDirectories")
 	}
 
-	dirsCount = len(dirs)
-	verifyMode = "metadata"
-
-	if PrintVerify {
-		tick := time.NewTicker(PrintInterval)
-		defer tick.Stop()
-		stop := make(chan bool)
-		go func() {
-			for {
-				select {
-				case <-tick.C:
-					sealingMeta.Lock()
-					log.Printf("%.1f%% done, %s %s", float64(dirsDone)/float64(dirsCount)*100, verifyMode, sealingFile)
-					sealingMeta.Unlock()
-				case <-stop:
-					return
-				}
-			}
-		}()
+	s := v.sealer
+	s.emit(PhaseChanged{Phase: "metadata", Dirs: len(dirs)})
+	if v.opts.PrintProgress {
+		stop := s.progress.logEvery(v.opts.ProgressInterval)
+		defer stop()
 	}
 
+	// the quick check finds the sizes of all files that get hashed
+	var hashBytes int64
 	checkHash := false
-	for _, dir := range dirs {
-		if PrintAllVerify {
+	for i, dir := range dirs {
+		if v.opts.PrintAll {
 			log.Println("quick checking", dir.Path)
 		}
-		diff, err := verifyDir(dir.Path, checkHash)
+		diff, err := v.verifyDir(dir.Path, checkHash)
 		if err != nil {
 			return nil, errors.Wrapf(err, "quick checking %q", dir.Path)
 		}
-		if printDifferences {
-			diff.PrintDifferences()
+		for _, f := range diff.Have.Files {
+			if !f.IsDir {
+				hashBytes += f.Size
+			}
 		}
-		dir.QuickDiff = diff
-		sealingMeta.Lock()
-		dirsDone++
-		sealingMeta.Unlock()
+		dirs[i].QuickDiff = diff
 	}
 
-	sealingMeta.Lock()
-	dirsDone = 0
-	verifyMode = "hashing"
-	sealingMeta.Unlock()
-
+	s.emit(PhaseChanged{Phase: "hashing", Dirs: len(dirs), Bytes: hashBytes})
 	checkHash = true
-	for _, dir := range dirs {
-		if PrintAllVerify {
+	for i, dir := range dirs {
+		if v.opts.PrintAll {
 			log.Println("hashing", dir.Path)
 		}
-		diff, err := verifyDir(dir.Path, checkHash)
+		diff, err := v.verifyDir(dir.Path, checkHash)
 		if err != nil {
 			return nil, errors.Wrapf(err, "hashing %q", dir.Path)
 		}
-		if printDifferences {
-			diff.PrintDifferences()
-		}
-		dir.HashDiff = diff
-		sealingMeta.Lock()
-		dirsDone++
-		sealingMeta.Unlock()
+		dirs[i].HashDiff = diff
 	}
 
-	if len(nonRegularFiles) > 0 {
-		log.Println("skipped non regular files:")
-		for mode, count := range nonRegularFiles {
-			log.Println(mode.String(), count)
-		}
-	}
+	s.progress.logSkipped()
 	return dirs, nil
 }
 
 // verifyDir diffs the current contents of a directory
 // against the stored seal, with or without hashing.
-func verifyDir(dirPath string, checkHash bool) (*Diff, error) {
-	currentSeal, err := sealDir(dirPath, checkHash)
+// It reports the directory and its differences as events.
+func (v *Verifier) verifyDir(dirPath string, checkHash bool) (*Diff, error) {
+	v.sealer.emit(DirStarted{Path: dirPath})
+	currentSeal, err := v.sealer.sealDir(dirPath, checkHash)
 	if err != nil {
 		return nil, errors.Wrap(err, "sealDir")
 	}
 
-	loadedSeal, err := loadSeal(dirPath)
+	loadedSeal, err := loadSealFS(v.sealer.fsys, dirPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "loadSeal")
 	}
 
 	diff := DiffSeals(loadedSeal, currentSeal, checkHash)
+	if len(v.opts.VerifyKeys) > 0 {
+		diff.SignatureError = loadedSeal.checkSignature(v.opts.VerifyKeys)
+		if diff.SignatureError != nil {
+			diff.Identical = false
+		}
+	}
+	if !diff.Identical {
+		if v.opts.PrintDifferences {
+			diff.PrintDifferences()
+		}
+		v.sealer.emit(DiffFound{Path: dirPath, Diff: diff})
+	}
+	v.sealer.emit(DirDone{Path: dirPath})
 	return diff, nil
 }
+
+// Progress returns the progress of the current phase.
+func (v *Verifier) Progress() Progress {
+	return v.sealer.Progress()
+}